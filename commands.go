@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mozilla.org/cloudops-deployment-proxy/proxyservice"
+	"go.mozilla.org/cloudops-deployment-proxy/proxyservice/jenkinstest"
+
+	"github.com/taskcluster/pulse-go/pulse"
+	"github.com/urfave/cli"
+)
+
+// handlers holds everything built from the global flags
+type handlers struct {
+	Dockerhub   *proxyservice.DockerHubWebhookHandler
+	Hgmo        *proxyservice.HgmoPulseHandler
+	Taskcluster *proxyservice.TaskclusterPulseHandler
+	// Subscriptions consumes the pulse_subscriptions of the config
+	Subscriptions *proxyservice.PulseSubscriptionHandler
+	Admin         *proxyservice.AdminHandler
+	Events        proxyservice.EventStore
+}
+
+// newConfigStore loads --config if set, otherwise the allowlists come from flags
+func newConfigStore(c *cli.Context) (*proxyservice.ConfigStore, error) {
+	if c.GlobalString("config") != "" {
+		return proxyservice.NewConfigStoreFromFile(c.GlobalString("config"))
+	}
+	config := &proxyservice.Config{
+		DockerhubNamespaces: c.GlobalStringSlice("valid-namespace"),
+		HgmoRepos:           c.GlobalStringSlice("hgmo-repo"),
+	}
+	for _, tokenFile := range c.GlobalStringSlice("docker-hub-token-file") {
+		parts := strings.SplitN(tokenFile, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid --docker-hub-token-file %s, expected namespace=path", tokenFile)
+		}
+		if config.DockerhubTokenFiles == nil {
+			config.DockerhubTokenFiles = make(map[string]string)
+		}
+		config.DockerhubTokenFiles[parts[0]] = parts[1]
+	}
+	for _, binding := range c.GlobalStringSlice("taskcluster-binding") {
+		parts := strings.SplitN(binding, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid --taskcluster-binding %s, expected namespace/name=routing-key-pattern", binding)
+		}
+		config.TaskclusterBindings = append(config.TaskclusterBindings, &proxyservice.TaskclusterBinding{
+			Repo:          parts[0],
+			RoutingKey:    parts[1],
+			ImageArtifact: c.GlobalString("taskcluster-image-artifact"),
+		})
+	}
+	return proxyservice.NewConfigStore(config), nil
+}
+
+// newDeployer returns a deployer sending deployments to the target of
+// their route, or to jenkins for routes without one
+func newDeployer(config *proxyservice.ConfigStore, jenkins proxyservice.Jenkins) *proxyservice.RouteDeployer {
+	return proxyservice.NewRouteDeployer(config, proxyservice.NewJenkinsDeployer(jenkins))
+}
+
+func newHandlers(c *cli.Context, config *proxyservice.ConfigStore, deployer proxyservice.Deployer, events proxyservice.EventStore, hgmoSource, taskclusterSource proxyservice.MessageSource) *handlers {
+	dockerhubHandler := proxyservice.NewDockerHubWebhookHandler(
+		c.GlobalBool("disable-docker-hub-callback"),
+		deployer,
+	)
+	dockerhubHandler.CallbackTimeout = c.GlobalDuration("docker-hub-timeout")
+	dockerhubHandler.Config = config
+	dockerhubHandler.Events = events
+
+	hgmoPulseHandler := proxyservice.NewHgmoPulseHandler(
+		deployer,
+		hgmoSource,
+		c.GlobalString("hgmo-pulse-queue"),
+	)
+	hgmoPulseHandler.HgBaseURL = c.GlobalString("hgmo-base-url")
+	hgmoPulseHandler.HgmoTimeout = c.GlobalDuration("hgmo-timeout")
+	hgmoPulseHandler.Config = config
+	hgmoPulseHandler.Events = events
+
+	// the taskcluster consumer has its own source, as
+	// reconnecting replaces the connection of the source
+	taskclusterHandler := proxyservice.NewTaskclusterPulseHandler(
+		deployer,
+		proxyservice.NewTaskclusterQueue(c.GlobalString("taskcluster-root-url"), c.GlobalDuration("taskcluster-timeout")),
+		taskclusterSource,
+		c.GlobalString("taskcluster-pulse-queue"),
+	)
+	taskclusterHandler.QueueTimeout = c.GlobalDuration("taskcluster-timeout")
+	taskclusterHandler.Config = config
+	taskclusterHandler.Events = events
+
+	subscriptionHandler := proxyservice.NewPulseSubscriptionHandler(deployer, config)
+	subscriptionHandler.Events = events
+
+	adminHandler := proxyservice.NewAdminHandler(
+		newAdminAuth(c),
+		dockerhubHandler,
+		hgmoPulseHandler,
+		events,
+	)
+	adminHandler.Config = config
+	adminHandler.Taskcluster = taskclusterHandler
+	adminHandler.Subscriptions = subscriptionHandler
+
+	return &handlers{
+		Dockerhub:     dockerhubHandler,
+		Hgmo:          hgmoPulseHandler,
+		Taskcluster:   taskclusterHandler,
+		Subscriptions: subscriptionHandler,
+		Admin:         adminHandler,
+		Events:        events,
+	}
+}
+
+// newMessageSource returns a function creating sources of pulse messages
+// with the --pulse-client library, each source has its own connection
+func newMessageSource(c *cli.Context, credentials *proxyservice.Credentials) (func() proxyservice.MessageSource, error) {
+	pulseHost := c.GlobalString("pulse-host")
+	switch c.GlobalString("pulse-client") {
+	case "pulse-go":
+		return func() proxyservice.MessageSource {
+			user, password := credentials.Get()
+			conn := pulse.NewConnection(user, password, pulseHost)
+			return proxyservice.NewPulseSource(&conn, credentials)
+		}, nil
+	case "amqp":
+		return func() proxyservice.MessageSource {
+			return proxyservice.NewAMQPSource(pulseHost, credentials)
+		}, nil
+	default:
+		return nil, fmt.Errorf("Unknown pulse client %s, expected pulse-go or amqp", c.GlobalString("pulse-client"))
+	}
+}
+
+// newCredentials returns credentials from flags. If the -file variant of
+// passwordFlag is set the password is read from it and the returned
+// secret file updates the credentials once watched.
+func newCredentials(c *cli.Context, userFlag, passwordFlag string) (*proxyservice.Credentials, *proxyservice.SecretFile, error) {
+	credentials := proxyservice.NewCredentials(c.GlobalString(userFlag), c.GlobalString(passwordFlag))
+	path := c.GlobalString(passwordFlag + "-file")
+	if path == "" {
+		return credentials, nil, nil
+	}
+	secret, err := proxyservice.NewSecretFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	credentials.SetPassword(secret.Value())
+	secret.OnChange(credentials.SetPassword)
+	return credentials, secret, nil
+}
+
+func newJenkins(c *cli.Context) (proxyservice.Jenkins, *proxyservice.SecretFile, error) {
+	passwordFlag := "jenkins-password"
+	apiToken := isSetOrFile(c, "jenkins-api-token")
+	if apiToken {
+		passwordFlag = "jenkins-api-token"
+	}
+	credentials, secret, err := newCredentials(c, "jenkins-user", passwordFlag)
+	if err != nil {
+		return nil, nil, err
+	}
+	jenkins := proxyservice.NewJenkinsServer(c.GlobalString("jenkins-base-url"), credentials)
+	jenkins.APIToken = apiToken
+	jenkins.Timeout = c.GlobalDuration("jenkins-timeout")
+	return jenkins, secret, nil
+}
+
+// newMiddleware returns next wrapped with client address resolution
+// and the --allowlist checks
+func newMiddleware(c *cli.Context, next http.Handler) (http.Handler, error) {
+	allowlist := &proxyservice.Allowlist{Paths: make(map[string]*proxyservice.CIDRFile)}
+	for _, entry := range c.GlobalStringSlice("allowlist") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") {
+			return nil, fmt.Errorf("Invalid --allowlist %s, expected /path=file", entry)
+		}
+		cidrs, err := proxyservice.NewCIDRFile(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		cidrs.Watch(30 * time.Second)
+		allowlist.Paths[parts[0]] = cidrs
+	}
+	clientIP, err := proxyservice.NewClientIP(c.GlobalStringSlice("trusted-proxy")...)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid --trusted-proxy: %v", err)
+	}
+	return clientIP.Middleware(allowlist.Middleware(next)), nil
+}
+
+// newTLSConfig returns the server TLS config from --tls-cert, or nil if
+// TLS is disabled, and a middleware applying the --mtls-path checks
+func newTLSConfig(c *cli.Context) (*tls.Config, func(http.Handler) http.Handler, error) {
+	noClientCerts := func(next http.Handler) http.Handler { return next }
+	if c.GlobalString("tls-cert") == "" {
+		return nil, noClientCerts, nil
+	}
+	certs, err := proxyservice.NewCertificateFile(c.GlobalString("tls-cert"), c.GlobalString("tls-key"))
+	if err != nil {
+		return nil, nil, err
+	}
+	certs.Watch(30 * time.Second)
+	if c.GlobalString("tls-client-ca") == "" {
+		return proxyservice.NewTLSConfig(certs, nil), noClientCerts, nil
+	}
+	clientCAs, err := proxyservice.LoadCertPool(c.GlobalString("tls-client-ca"))
+	if err != nil {
+		return nil, nil, err
+	}
+	paths := c.GlobalStringSlice("mtls-path")
+	if len(paths) == 0 {
+		paths = []string{"/admin/"}
+	}
+	for _, path := range paths {
+		if !strings.HasPrefix(path, "/") {
+			return nil, nil, fmt.Errorf("Invalid --mtls-path %s, expected /path", path)
+		}
+	}
+	required := &proxyservice.ClientCertRequired{Paths: paths}
+	return proxyservice.NewTLSConfig(certs, clientCAs), required.Middleware, nil
+}
+
+// newAdminAuth returns the authenticator built from --admin-token,
+// --admin-tokens-file and --admin-jwks-file, or nil if none is set
+func newAdminAuth(c *cli.Context) proxyservice.Authenticator {
+	var auth proxyservice.Authenticators
+	if c.GlobalString("admin-token") != "" {
+		auth = append(auth, proxyservice.NewStaticToken("admin-token", proxyservice.RoleTrigger, c.GlobalString("admin-token")))
+	}
+	if c.GlobalString("admin-tokens-file") != "" {
+		auth = append(auth, &proxyservice.TokenFile{Path: c.GlobalString("admin-tokens-file")})
+	}
+	if c.GlobalString("admin-jwks-file") != "" {
+		jwt := proxyservice.NewJWTAuthenticator(
+			c.GlobalString("admin-jwks-file"),
+			c.GlobalString("admin-jwt-issuer"),
+			c.GlobalString("admin-jwt-audience"),
+		)
+		jwt.RolesClaim = c.GlobalString("admin-jwt-roles-claim")
+		auth = append(auth, jwt)
+	}
+	if len(auth) == 0 {
+		return nil
+	}
+	return auth
+}
+
+// listen serves server, with TLS if it has a TLS config
+func listen(server *http.Server) error {
+	if server.TLSConfig != nil {
+		// the certificate comes from TLSConfig.GetCertificate
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+func serve(c *cli.Context) error {
+	if err := validateCliContext(c); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	var events proxyservice.EventStore = proxyservice.NewMemoryEventStore(1000)
+	if c.GlobalString("audit-log") != "" {
+		auditLog, err := proxyservice.NewFileEventStore(c.GlobalString("audit-log"))
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		defer auditLog.Close()
+		events = auditLog
+	}
+
+	jenkins, jenkinsSecret, err := newJenkins(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if jenkinsSecret != nil {
+		jenkinsSecret.Watch(30 * time.Second)
+	}
+
+	var newSource func() proxyservice.MessageSource
+	var hgmoSource, taskclusterSource proxyservice.MessageSource
+	pulseCredentials, pulseSecret, err := newCredentials(c, "pulse-username", "pulse-password")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if c.GlobalString("pulse-host") != "" {
+		if newSource, err = newMessageSource(c, pulseCredentials); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		hgmoSource = newSource()
+		taskclusterSource = newSource()
+	}
+
+	config, err := newConfigStore(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if config.Path != "" {
+		config.Watch(30 * time.Second)
+	}
+
+	h := newHandlers(c, config, newDeployer(config, jenkins), events, hgmoSource, taskclusterSource)
+	if rate := c.GlobalFloat64("repo-rate-limit"); rate > 0 {
+		h.Dockerhub.RepoLimiter = proxyservice.NewRateLimiter(rate, c.GlobalInt("repo-rate-burst"))
+	}
+
+	var dockerhub http.Handler = h.Dockerhub
+	if rate := c.GlobalFloat64("client-rate-limit"); rate > 0 {
+		dockerhub = proxyservice.NewRateLimiter(rate, c.GlobalInt("client-rate-burst")).Middleware(dockerhub)
+	}
+	dockerhub = proxyservice.BodyLimit(int64(c.GlobalInt("dockerhub-max-body-size")), dockerhub)
+
+	mux := http.NewServeMux()
+	mux.Handle("/dockerhub", dockerhub)
+	mux.Handle("/dockerhub/", dockerhub)
+	mux.HandleFunc("/__heartbeat__", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	mux.HandleFunc("/__lbheartbeat__", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	// the admin endpoints are on --admin-addr if set, otherwise on the public listener
+	adminMux := mux
+	if c.GlobalString("admin-addr") != "" {
+		adminMux = http.NewServeMux()
+	}
+	if h.Admin.Auth != nil {
+		adminMux.Handle("/admin/", proxyservice.BodyLimit(int64(c.GlobalInt("admin-max-body-size")), h.Admin))
+	}
+
+	if hgmoSource != nil {
+		if err := h.Hgmo.Consume(); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Could not listen to hgmo pulse: %v", err), 1)
+		}
+		reconnect := []func() error{h.Hgmo.Reconnect}
+		if len(config.Get().TaskclusterBindings) > 0 {
+			if err := h.Taskcluster.Consume(); err != nil {
+				return cli.NewExitError(fmt.Sprintf("Could not listen to taskcluster pulse: %v", err), 1)
+			}
+			reconnect = append(reconnect, h.Taskcluster.Reconnect)
+		}
+		if len(config.Get().PulseSubscriptions) > 0 {
+			if err := h.Subscriptions.Consume(newSource); err != nil {
+				return cli.NewExitError(fmt.Sprintf("Could not listen to pulse subscriptions: %v", err), 1)
+			}
+			reconnect = append(reconnect, h.Subscriptions.Reconnect)
+		}
+		if pulseSecret != nil {
+			pulseSecret.OnChange(func(string) {
+				for _, r := range reconnect {
+					if err := r(); err != nil {
+						log.Printf("Keeping pulse connection with previous credentials: %v", err)
+					}
+				}
+			})
+			pulseSecret.Watch(30 * time.Second)
+		}
+	}
+
+	tlsConfig, clientCerts, err := newTLSConfig(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	handler, err := newMiddleware(c, clientCerts(mux))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	servers := []*http.Server{{
+		Addr:      c.GlobalString("addr"),
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}}
+	if adminMux != mux {
+		adminHandler, err := newMiddleware(c, clientCerts(adminMux))
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		servers = append(servers, &http.Server{
+			Addr:      c.GlobalString("admin-addr"),
+			Handler:   adminHandler,
+			TLSConfig: tlsConfig,
+		})
+	}
+
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			errs <- fmt.Errorf("Server on %s crashed: %v", server.Addr, listen(server))
+		}(server)
+	}
+	return cli.NewExitError((<-errs).Error(), 1)
+}
+
+func validateConfig(c *cli.Context) error {
+	cErrors := make([]error, 0)
+	if err := validateCliContext(c); err != nil {
+		cErrors = append(cErrors, err)
+	}
+	if config, err := newConfigStore(c); err != nil {
+		cErrors = append(cErrors, err)
+	} else if err := config.Get().Validate(); err != nil {
+		cErrors = append(cErrors, err)
+	}
+	if _, err := newMiddleware(c, http.NotFoundHandler()); err != nil {
+		cErrors = append(cErrors, err)
+	}
+	if _, _, err := newTLSConfig(c); err != nil {
+		cErrors = append(cErrors, err)
+	}
+	if len(cErrors) > 0 {
+		return cli.NewExitError(cli.NewMultiError(cErrors...).Error(), 1)
+	}
+	fmt.Println("OK")
+	return nil
+}
+
+func simulate(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return cli.NewExitError("simulate expects <dockerhub|hgmo|taskcluster> <fixture.json>", 1)
+	}
+	payload, err := ioutil.ReadFile(c.Args().Get(1))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Could not read fixture: %v", err), 1)
+	}
+
+	event := proxyservice.NewEvent(c.Args().Get(0), payload)
+	event.RoutingKey = c.String("routing-key")
+	if event.Source == proxyservice.SourceHgmo && event.RoutingKey == "" {
+		var meta struct {
+			Meta struct {
+				RoutingKey string `json:"routing_key"`
+			} `json:"_meta"`
+		}
+		if err := json.Unmarshal(payload, &meta); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Could not parse fixture: %v", err), 1)
+		}
+		event.RoutingKey = meta.Meta.RoutingKey
+	}
+
+	config, err := newConfigStore(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	// jenkins jobs are posted to an in-process fake to check their params,
+	// other targets are only recorded
+	fake := jenkinstest.NewServer("simulate", "simulate")
+	defer fake.Close()
+	jenkins := proxyservice.NewJenkins(fake.URL, "simulate", "simulate")
+	dryRun := &proxyservice.DryRunDeployer{Send: map[string]bool{proxyservice.DefaultTarget: true}}
+	h := newHandlers(c, config, dryRun.Wrap(newDeployer(config, jenkins)), proxyservice.NewMemoryEventStore(1), nil, nil)
+	if err := h.Admin.Replay(context.Background(), event); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Nothing would be deployed: %v", err), 1)
+	}
+
+	out, err := json.MarshalIndent(map[string]interface{}{
+		"deployments":    dryRun.Deployments,
+		"jenkins_builds": fake.Builds(),
+	}, "", "  ")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func trigger(c *cli.Context) error {
+	if c.NArg() != 3 {
+		return cli.NewExitError("trigger expects <dockerhub|hgmo|taskcluster> <repo> <tag|rev|task-id>", 1)
+	}
+	if err := validateCliContext(c); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	config, err := newConfigStore(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	jenkins, _, err := newJenkins(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	h := newHandlers(c, config, newDeployer(config, jenkins), proxyservice.NewMemoryEventStore(1), nil, nil)
+	args := c.Args()
+	if err := h.Admin.Trigger(context.Background(), args.Get(0), args.Get(1), args.Get(2)); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Could not trigger job: %v", err), 1)
+	}
+	fmt.Println("OK")
+	return nil
+}
@@ -1,14 +1,19 @@
 module go.mozilla.org/cloudops-deployment-proxy
 
-go 1.14
+go 1.21
 
 require (
-	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/pborman/uuid v1.2.0 // indirect
-	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/pborman/uuid v1.2.0
+	github.com/rabbitmq/amqp091-go v1.10.0
 	github.com/streadway/amqp v0.0.0-20200108173154-1c71cc93ed71
 	github.com/stretchr/testify v1.1.4-0.20160524234229-8d64eb7173c7
 	github.com/taskcluster/pulse-go v1.0.0
 	github.com/urfave/cli v1.17.1-0.20160608151511-fa949b48f384
 	go.mozilla.org/mozlog v0.0.0-20160610165107-cd74695caf44
 )
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/google/uuid v1.0.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+)
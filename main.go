@@ -2,15 +2,13 @@ package main
 
 import (
 	"fmt"
-	"net/http"
+	"net/url"
 	"os"
+	"time"
 
-	"go.mozilla.org/cloudops-deployment-proxy/proxyservice"
 	"go.mozilla.org/mozlog"
 
 	"github.com/urfave/cli"
-
-	"github.com/taskcluster/pulse-go/pulse"
 )
 
 func init() {
@@ -49,6 +47,27 @@ func main() {
 			Usage:  "Password for authing against jenkins",
 			EnvVar: "JENKINS_PASSWORD",
 		},
+		cli.StringFlag{
+			Name:   "jenkins-password-file",
+			Usage:  "File containing the jenkins password, re-read when it changes",
+			EnvVar: "JENKINS_PASSWORD_FILE",
+		},
+		cli.StringFlag{
+			Name:   "jenkins-api-token",
+			Usage:  "API token for authing against jenkins, used instead of the password",
+			EnvVar: "JENKINS_API_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "jenkins-api-token-file",
+			Usage:  "File containing the jenkins API token, re-read when it changes",
+			EnvVar: "JENKINS_API_TOKEN_FILE",
+		},
+		cli.DurationFlag{
+			Name:   "jenkins-timeout",
+			Usage:  "Timeout for triggering a jenkins job",
+			Value:  30 * time.Second,
+			EnvVar: "JENKINS_TIMEOUT",
+		},
 		cli.StringFlag{
 			Name:   "pulse-username",
 			Usage:  "Username for authing against pulse",
@@ -59,12 +78,23 @@ func main() {
 			Usage:  "Password for authing against pulse",
 			EnvVar: "PULSE_PASSWORD",
 		},
+		cli.StringFlag{
+			Name:   "pulse-password-file",
+			Usage:  "File containing the pulse password, re-read when it changes",
+			EnvVar: "PULSE_PASSWORD_FILE",
+		},
 		cli.StringFlag{
 			Name:   "pulse-host",
 			Usage:  "Pulse host to connect to",
 			Value:  "amqps://pulse.mozilla.org",
 			EnvVar: "PULSE_HOST",
 		},
+		cli.StringFlag{
+			Name:   "pulse-client",
+			Usage:  "Library consuming pulse, pulse-go or amqp for the amqp091-go AMQP 0-9-1 client",
+			Value:  "pulse-go",
+			EnvVar: "PULSE_CLIENT",
+		},
 		cli.StringSliceFlag{
 			Name:   "hgmo-repo",
 			Usage:  "hg.mozilla.org repo to listend to pushes from (can be used multiple times)",
@@ -77,74 +107,218 @@ func main() {
 			Value:  "hgmo",
 			EnvVar: "HGMO_PULSE_QUEUE",
 		},
+		cli.StringFlag{
+			Name:   "taskcluster-root-url",
+			Usage:  "Root URL of the taskcluster deployment whose Queue API verifies completed tasks",
+			Value:  "https://firefox-ci-tc.services.mozilla.com",
+			EnvVar: "TASKCLUSTER_ROOT_URL",
+		},
+		cli.StringSliceFlag{
+			Name:   "taskcluster-binding",
+			Usage:  "namespace/name=routing-key-pattern deploying tasks completed with a matching routing key or route, e.g., mozilla/myapp=route.index.project.myapp.docker-image.# (can be used multiple times)",
+			EnvVar: "TASKCLUSTER_BINDING",
+		},
+		cli.StringFlag{
+			Name:   "taskcluster-image-artifact",
+			Usage:  "Docker image artifact of tasks bound with --taskcluster-binding",
+			Value:  "public/image.tar.zst",
+			EnvVar: "TASKCLUSTER_IMAGE_ARTIFACT",
+		},
+		cli.StringFlag{
+			Name:   "taskcluster-pulse-queue",
+			Usage:  "Name of the pulse queue bound to the task-completed exchange",
+			Value:  "cloudops-deployment-proxy-taskcluster",
+			EnvVar: "TASKCLUSTER_PULSE_QUEUE",
+		},
+		cli.DurationFlag{
+			Name:   "taskcluster-timeout",
+			Usage:  "Timeout for Queue API requests verifying tasks",
+			Value:  10 * time.Second,
+			EnvVar: "TASKCLUSTER_TIMEOUT",
+		},
 		cli.BoolFlag{
 			Name:   "disable-docker-hub-callback",
-			Usage:  "Disable Docker Hub callback when it randomly breaks over Thanksgiving https://docs.docker.com/docker-hub/webhooks/#validate-a-webhook-callback",
+			Usage:  "Disable Docker Hub callback when it randomly breaks over Thanksgiving https://docs.docker.com/docker-hub/webhooks/#validate-a-webhook-callback, only namespaces with a --docker-hub-token-file are then accepted",
 			EnvVar: "DISABLE_DOCKER_HUB_CALLBACK",
 		},
+		cli.StringSliceFlag{
+			Name:   "docker-hub-token-file",
+			Usage:  "namespace=path of a file holding the token Docker Hub webhooks for namespace must send as /dockerhub/<token> or ?token=<token> (can be used multiple times)",
+			EnvVar: "DOCKER_HUB_TOKEN_FILE",
+		},
+		cli.DurationFlag{
+			Name:   "docker-hub-timeout",
+			Usage:  "Timeout for Docker Hub callbacks",
+			Value:  10 * time.Second,
+			EnvVar: "DOCKER_HUB_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "hgmo-base-url",
+			Usage:  "Base url of the hg server pulse messages are verified against, e.g., a staging server",
+			Value:  "https://hg.mozilla.org",
+			EnvVar: "HGMO_BASE_URL",
+		},
+		cli.DurationFlag{
+			Name:   "hgmo-timeout",
+			Usage:  "Timeout for hg.mozilla.org requests verifying pushes",
+			Value:  10 * time.Second,
+			EnvVar: "HGMO_TIMEOUT",
+		},
+		cli.StringSliceFlag{
+			Name:   "trusted-proxy",
+			Usage:  "CIDR of a proxy or load balancer whose X-Forwarded-For header is trusted (can be used multiple times)",
+			EnvVar: "TRUSTED_PROXY",
+		},
+		cli.StringSliceFlag{
+			Name:   "allowlist",
+			Usage:  "path=file of CIDRs allowed to call path, e.g., /dockerhub=/etc/dockerhub-ranges.txt, paths include everything below them (can be used multiple times)",
+			EnvVar: "ALLOWLIST",
+		},
+		cli.IntFlag{
+			Name:   "dockerhub-max-body-size",
+			Usage:  "Largest accepted /dockerhub request body in bytes",
+			Value:  1 << 20,
+			EnvVar: "DOCKERHUB_MAX_BODY_SIZE",
+		},
+		cli.IntFlag{
+			Name:   "admin-max-body-size",
+			Usage:  "Largest accepted /admin/ request body in bytes",
+			Value:  64 << 10,
+			EnvVar: "ADMIN_MAX_BODY_SIZE",
+		},
+		cli.Float64Flag{
+			Name:   "client-rate-limit",
+			Usage:  "Requests per second each client address may send to /dockerhub, 0 disables the limit",
+			EnvVar: "CLIENT_RATE_LIMIT",
+		},
+		cli.IntFlag{
+			Name:   "client-rate-burst",
+			Usage:  "Requests a client address may send at once before --client-rate-limit applies",
+			Value:  20,
+			EnvVar: "CLIENT_RATE_BURST",
+		},
+		cli.Float64Flag{
+			Name:   "repo-rate-limit",
+			Usage:  "Deploys per second allowed for each Docker Hub repository from /dockerhub webhooks, pulse messages are not limited, 0 disables the limit",
+			EnvVar: "REPO_RATE_LIMIT",
+		},
+		cli.IntFlag{
+			Name:   "repo-rate-burst",
+			Usage:  "Deploys a repository may trigger at once before --repo-rate-limit applies",
+			Value:  5,
+			EnvVar: "REPO_RATE_BURST",
+		},
+		cli.StringFlag{
+			Name:   "tls-cert",
+			Usage:  "Path of a PEM certificate chain to serve TLS with, reloaded when modified",
+			EnvVar: "TLS_CERT",
+		},
+		cli.StringFlag{
+			Name:   "tls-key",
+			Usage:  "Path of the PEM private key of --tls-cert",
+			EnvVar: "TLS_KEY",
+		},
+		cli.StringFlag{
+			Name:   "tls-client-ca",
+			Usage:  "Path of a PEM CA bundle verifying client certificates on the --mtls-path paths",
+			EnvVar: "TLS_CLIENT_CA",
+		},
+		cli.StringSliceFlag{
+			Name:   "mtls-path",
+			Usage:  "Path requiring a client certificate signed by --tls-client-ca, paths include everything below them (can be used multiple times, default /admin/)",
+			EnvVar: "MTLS_PATH",
+		},
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "Path of a json file with dockerhub_namespaces, dockerhub_token_files, hgmo_repos, hgmo_rules, taskcluster_bindings, pulse_subscriptions, routes and targets, replacing --valid-namespace, --docker-hub-token-file, --hgmo-repo and --taskcluster-binding. Reloaded on SIGHUP or when modified",
+			EnvVar: "CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "admin-addr",
+			Usage:  "Separate address to serve the /admin/ endpoints on instead of --addr, e.g., 127.0.0.1:8001",
+			EnvVar: "ADMIN_ADDR",
+		},
+		cli.StringFlag{
+			Name:   "admin-token",
+			Usage:  "Bearer token with the trigger role for the /admin/ endpoints, which are disabled if no admin authentication is set",
+			EnvVar: "ADMIN_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "admin-tokens-file",
+			Usage:  "Path of a file of admin bearer tokens, one \"<name> <read|trigger> <token>\" per line, re-read for every request",
+			EnvVar: "ADMIN_TOKENS_FILE",
+		},
+		cli.StringFlag{
+			Name:   "admin-jwks-file",
+			Usage:  "Path of a JWKS file with the keys of an OIDC provider whose RS256 or ES256 JWTs are accepted as admin bearer tokens",
+			EnvVar: "ADMIN_JWKS_FILE",
+		},
+		cli.StringFlag{
+			Name:   "admin-jwt-issuer",
+			Usage:  "Required iss of admin JWTs",
+			EnvVar: "ADMIN_JWT_ISSUER",
+		},
+		cli.StringFlag{
+			Name:   "admin-jwt-audience",
+			Usage:  "Required aud of admin JWTs",
+			EnvVar: "ADMIN_JWT_AUDIENCE",
+		},
+		cli.StringFlag{
+			Name:   "admin-jwt-roles-claim",
+			Usage:  "Claim of admin JWTs listing the caller's roles, read or trigger",
+			Value:  "roles",
+			EnvVar: "ADMIN_JWT_ROLES_CLAIM",
+		},
+		cli.StringFlag{
+			Name:   "audit-log",
+			Usage:  "Path of a json lines file recording every received event, events are only kept in memory if unset",
+			EnvVar: "AUDIT_LOG",
+		},
 	}
 
-	app.Action = func(c *cli.Context) error {
-		if err := validateCliContext(c); err != nil {
-			return cli.NewExitError(err.Error(), 1)
-		}
-
-		jenkins := proxyservice.NewJenkins(
-			c.String("jenkins-base-url"),
-			c.String("jenkins-user"),
-			c.String("jenkins-password"),
-		)
-
-		dockerhubHandler := proxyservice.NewDockerHubWebhookHandler(
-			c.Bool("disable-docker-hub-callback"),
-			jenkins,
-			c.StringSlice("valid-namespace")...,
-		)
-
-		mux := http.NewServeMux()
-		mux.Handle("/dockerhub", dockerhubHandler)
-		mux.HandleFunc("/__heartbeat__", func(w http.ResponseWriter, req *http.Request) {
-			w.Write([]byte("OK"))
-		})
-		mux.HandleFunc("/__lbheartbeat__", func(w http.ResponseWriter, req *http.Request) {
-			w.Write([]byte("OK"))
-		})
-
-		if c.String("pulse-host") != "" {
-			pulse := pulse.NewConnection(
-				c.String("pulse-username"),
-				c.String("pulse-password"),
-				c.String("pulse-host"),
-			)
-
-			hgmoPulseHandler := proxyservice.NewHgmoPulseHandler(
-				jenkins,
-				&pulse,
-				c.String("hgmo-pulse-queue"),
-				c.StringSlice("hgmo-repo")...,
-			)
-
-			if err := hgmoPulseHandler.Consume(); err != nil {
-				return cli.NewExitError(fmt.Sprintf("Could not listen to hgmo pulse: %v", err), 1)
-			}
-		}
-
-		server := &http.Server{
-			Addr:    c.String("addr"),
-			Handler: mux,
-		}
-		if err := server.ListenAndServe(); err != nil {
-			return cli.NewExitError(fmt.Sprintf("Server crashed: %v", err), 1)
-		}
-		return nil
+	app.Commands = []cli.Command{
+		{
+			Name:   "serve",
+			Usage:  "Listen for webhooks and pulse messages (default)",
+			Action: serve,
+		},
+		{
+			Name:   "validate-config",
+			Usage:  "Check the configuration and exit",
+			Action: validateConfig,
+		},
+		{
+			Name:      "simulate",
+			Usage:     "Run a Docker Hub webhook, hgmo or taskcluster pulse message through the handlers and print the jobs which would be triggered",
+			ArgsUsage: "<dockerhub|hgmo|taskcluster> <fixture.json>",
+			Action:    simulate,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "routing-key",
+					Usage: "Routing key of an hgmo message, defaults to _meta.routing_key of the fixture, or the route a taskcluster message was received with",
+				},
+			},
+		},
+		{
+			Name:      "trigger",
+			Usage:     "Validate and trigger a job",
+			ArgsUsage: "<dockerhub|hgmo|taskcluster> <repo> <tag|rev|task-id>",
+			Action:    trigger,
+		},
 	}
+	app.Action = serve
 	app.Run(os.Args)
 }
+
 func validateCliContext(c *cli.Context) error {
 	cErrors := make([]error, 0)
-	mustBeSet := []string{"jenkins-base-url", "jenkins-user", "jenkins-password"}
+	// options can also be set with an -file variant if one exists
+	mustBeSet := []string{"jenkins-base-url", "jenkins-user"}
+	if !isSetOrFile(c, "jenkins-api-token") {
+		mustBeSet = append(mustBeSet, "jenkins-password")
+	}
 	for _, s := range mustBeSet {
-		if c.String(s) == "" {
+		if !isSetOrFile(c, s) {
 			cErrors = append(cErrors, fmt.Errorf("%s must be set", s))
 		}
 	}
@@ -153,7 +327,7 @@ func validateCliContext(c *cli.Context) error {
 	pulseMissing := false
 	pulseOptions := []string{"pulse-username", "pulse-password", "pulse-host"}
 	for _, s := range pulseOptions {
-		if c.String(s) == "" {
+		if !isSetOrFile(c, s) {
 			pulseMissing = true
 		} else {
 			pulseSpecified = true
@@ -163,8 +337,29 @@ func validateCliContext(c *cli.Context) error {
 		cErrors = append(cErrors, fmt.Errorf("All or none of %s must be set", pulseOptions))
 	}
 
+	if (c.GlobalString("tls-cert") == "") != (c.GlobalString("tls-key") == "") {
+		cErrors = append(cErrors, fmt.Errorf("Both or none of tls-cert and tls-key must be set"))
+	}
+	if c.GlobalString("tls-client-ca") != "" && c.GlobalString("tls-cert") == "" {
+		cErrors = append(cErrors, fmt.Errorf("tls-client-ca requires tls-cert"))
+	}
+	if len(c.GlobalStringSlice("mtls-path")) > 0 && c.GlobalString("tls-client-ca") == "" {
+		cErrors = append(cErrors, fmt.Errorf("mtls-path requires tls-client-ca"))
+	}
+	if c.GlobalString("admin-jwks-file") != "" && (c.GlobalString("admin-jwt-issuer") == "" || c.GlobalString("admin-jwt-audience") == "") {
+		cErrors = append(cErrors, fmt.Errorf("admin-jwks-file requires admin-jwt-issuer and admin-jwt-audience"))
+	}
+	if u, err := url.Parse(c.GlobalString("hgmo-base-url")); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		cErrors = append(cErrors, fmt.Errorf("hgmo-base-url must be an http(s) url"))
+	}
+
 	if len(cErrors) > 0 {
 		return cli.NewMultiError(cErrors...)
 	}
 	return nil
 }
+
+// isSetOrFile returns true if flag name or its -file variant is set
+func isSetOrFile(c *cli.Context, name string) bool {
+	return c.GlobalString(name) != "" || c.GlobalString(name+"-file") != ""
+}
@@ -0,0 +1,356 @@
+package proxyservice
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Admin roles, RoleTrigger includes RoleRead
+const (
+	// RoleRead may query events, metrics and status
+	RoleRead = "read"
+	// RoleTrigger may also trigger and replay deploys
+	RoleTrigger = "trigger"
+)
+
+// Principal is an authenticated admin caller
+type Principal struct {
+	Name  string
+	Roles []string
+}
+
+// HasRole returns true if p was granted role, or trigger when role is read
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role || (r == RoleTrigger && role == RoleRead) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator identifies the caller of an admin request from its bearer token
+type Authenticator interface {
+	// Authenticate returns nil, nil if token is not one it knows about
+	Authenticate(token string) (*Principal, error)
+}
+
+// Authenticators tries each Authenticator in turn
+type Authenticators []Authenticator
+
+// Authenticate returns the first principal found, or the first error
+// if no authenticator accepted token
+func (a Authenticators) Authenticate(token string) (*Principal, error) {
+	var firstErr error
+	for _, auth := range a {
+		principal, err := auth.Authenticate(token)
+		if principal != nil {
+			return principal, nil
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = fmt.Errorf("Unknown token")
+	}
+	return nil, firstErr
+}
+
+// StaticToken is a single token granting Principal, e.g., --admin-token
+type StaticToken struct {
+	Token     string
+	Principal *Principal
+}
+
+func NewStaticToken(name, role, token string) *StaticToken {
+	return &StaticToken{Token: token, Principal: &Principal{Name: name, Roles: []string{role}}}
+}
+
+func (s *StaticToken) Authenticate(token string) (*Principal, error) {
+	if s.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+		return nil, nil
+	}
+	return s.Principal, nil
+}
+
+// TokenFile holds admin tokens, one "<name> <role> <token>" per line with #
+// comments. It is re-read for every request so tokens can be rotated.
+type TokenFile struct {
+	Path string
+}
+
+func (f *TokenFile) Authenticate(token string) (*Principal, error) {
+	tokens, err := readTokenFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	for t, principal := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return principal, nil
+		}
+	}
+	return nil, nil
+}
+
+// readTokenFile returns the principal of each token in path
+func readTokenFile(path string) (map[string]*Principal, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading token file: %v", err)
+	}
+	defer f.Close()
+
+	tokens := make(map[string]*Principal)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Invalid line %d in %s, expected <name> <role> <token>", lineNo, path)
+		}
+		if fields[1] != RoleRead && fields[1] != RoleTrigger {
+			return nil, fmt.Errorf("Invalid role %s on line %d in %s", fields[1], lineNo, path)
+		}
+		tokens[fields[2]] = &Principal{Name: fields[0], Roles: []string{fields[1]}}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading token file: %v", err)
+	}
+	return tokens, nil
+}
+
+// JWTAuthenticator accepts RS256 and ES256 JWTs, e.g., from an OIDC
+// provider, signed by a key in a JWKS file. The file is re-read for every
+// request so keys can be rotated.
+type JWTAuthenticator struct {
+	JWKSFile string
+	Issuer   string
+	Audience string
+	// RolesClaim names the claim listing the caller's roles, default "roles"
+	RolesClaim string
+
+	now func() time.Time
+}
+
+func NewJWTAuthenticator(jwksFile, issuer, audience string) *JWTAuthenticator {
+	return &JWTAuthenticator{
+		JWKSFile: jwksFile,
+		Issuer:   issuer,
+		Audience: audience,
+	}
+}
+
+// jwtClockSkew is allowed between the issuer and us for exp and nbf
+const jwtClockSkew = time.Minute
+
+func (j *JWTAuthenticator) Authenticate(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		// not a JWT
+		return nil, nil
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid JWT signature: %v", err)
+	}
+	keys, err := readJWKS(j.JWKSFile)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := keys[header.Kid]
+	if !ok {
+		return nil, fmt.Errorf("Unknown JWT key %s", header.Kid)
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	claims := make(map[string]interface{})
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := j.validateClaims(claims); err != nil {
+		return nil, err
+	}
+	principal := &Principal{Name: fmt.Sprint(claims["sub"])}
+	rolesClaim := j.RolesClaim
+	if rolesClaim == "" {
+		rolesClaim = "roles"
+	}
+	for _, role := range claimStrings(claims[rolesClaim]) {
+		if role == RoleRead || role == RoleTrigger {
+			principal.Roles = append(principal.Roles, role)
+		}
+	}
+	return principal, nil
+}
+
+func (j *JWTAuthenticator) validateClaims(claims map[string]interface{}) error {
+	now := time.Now()
+	if j.now != nil {
+		now = j.now()
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("JWT has no exp")
+	}
+	if now.Add(-jwtClockSkew).After(time.Unix(int64(exp), 0)) {
+		return fmt.Errorf("JWT expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("JWT not valid yet")
+	}
+	if claims["iss"] != j.Issuer {
+		return fmt.Errorf("Invalid JWT issuer %v", claims["iss"])
+	}
+	for _, aud := range claimStrings(claims["aud"]) {
+		if aud == j.Audience {
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid JWT audience %v", claims["aud"])
+}
+
+// claimStrings returns a claim holding a string, a space separated
+// string (like OAuth scopes) or a list of strings
+func claimStrings(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		var values []string
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("Invalid JWT: %v", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("Invalid JWT: %v", err)
+	}
+	return nil
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			break
+		}
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return fmt.Errorf("Invalid JWT signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" {
+			break
+		}
+		if len(signature) != 64 {
+			return fmt.Errorf("Invalid JWT signature")
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return fmt.Errorf("Invalid JWT signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("Unsupported JWT algorithm %s", alg)
+}
+
+// readJWKS returns the RSA and P-256 keys in a JWKS file by key id
+func readJWKS(path string) (map[string]crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading JWKS: %v", err)
+	}
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("Error parsing JWKS %s: %v", path, err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range jwks.Keys {
+		switch {
+		case jwk.Kty == "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+			if errN != nil || errE != nil {
+				return nil, fmt.Errorf("Invalid RSA key %s in %s", jwk.Kid, path)
+			}
+			keys[jwk.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case jwk.Kty == "EC" && jwk.Crv == "P-256":
+			x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if errX != nil || errY != nil {
+				return nil, fmt.Errorf("Invalid EC key %s in %s", jwk.Kid, path)
+			}
+			keys[jwk.Kid] = &ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		}
+	}
+	return keys, nil
+}
+
+type principalKey struct{}
+
+// RequestPrincipal returns the caller of an authenticated admin request, or nil
+func RequestPrincipal(req *http.Request) *Principal {
+	principal, _ := req.Context().Value(principalKey{}).(*Principal)
+	return principal
+}
+
+func withPrincipal(req *http.Request, principal *Principal) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), principalKey{}, principal))
+}
@@ -0,0 +1,165 @@
+package proxyservice
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// signTestJWT returns a JWT with claims signed by key, an *rsa.PrivateKey or *ecdsa.PrivateKey
+func signTestJWT(t *testing.T, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// r and s are padded to 32 bytes each
+		signature = make([]byte, 64)
+		rBytes, sBytes := r.Bytes(), s.Bytes()
+		copy(signature[32-len(rBytes):], rBytes)
+		copy(signature[64-len(sBytes):], sBytes)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func testJWKS(rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) []byte {
+	encode := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.Bytes()) }
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{"kid": "rsa", "kty": "RSA", "n": encode(rsaKey.N), "e": encode(big.NewInt(int64(rsaKey.E)))},
+			{"kid": "ec", "kty": "EC", "crv": "P-256", "x": encode(ecKey.X), "y": encode(ecKey.Y)},
+		},
+	})
+	return jwks
+}
+
+func TestTokenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokens := &TokenFile{Path: writeTestFile(t, dir, "tokens", []byte(`
+# dashboards
+grafana read r3ad
+ops trigger tr1gger
+`))}
+	principal, err := tokens.Authenticate("r3ad")
+	assert.NoError(t, err)
+	assert.Equal(t, &Principal{Name: "grafana", Roles: []string{RoleRead}}, principal)
+	assert.True(t, principal.HasRole(RoleRead))
+	assert.False(t, principal.HasRole(RoleTrigger))
+
+	principal, err = tokens.Authenticate("tr1gger")
+	assert.NoError(t, err)
+	assert.True(t, principal.HasRole(RoleRead))
+	assert.True(t, principal.HasRole(RoleTrigger))
+
+	principal, err = tokens.Authenticate("unknown")
+	assert.NoError(t, err)
+	assert.Nil(t, principal)
+
+	writeTestFile(t, dir, "tokens", []byte("ops approve tr1gger\n"))
+	_, err = tokens.Authenticate("tr1gger")
+	assert.EqualError(t, err, "Invalid role approve on line 1 in "+tokens.Path)
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1600000000, 0)
+	auth := NewJWTAuthenticator(writeTestFile(t, dir, "jwks.json", testJWKS(rsaKey, ecKey)), "https://auth.example.com/", "deployment-proxy")
+	auth.now = func() time.Time { return now }
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{
+			"sub":   "ops@example.com",
+			"iss":   "https://auth.example.com/",
+			"aud":   []string{"deployment-proxy", "other"},
+			"exp":   now.Add(time.Hour).Unix(),
+			"roles": []string{"trigger", "unknown"},
+		}
+		for k, v := range changes {
+			claims[k] = v
+		}
+		return claims
+	}
+
+	for _, key := range []struct {
+		kid string
+		key crypto.Signer
+	}{{"rsa", rsaKey}, {"ec", ecKey}} {
+		principal, err := auth.Authenticate(signTestJWT(t, key.kid, key.key, claims(nil)))
+		assert.NoError(t, err, key.kid)
+		assert.Equal(t, &Principal{Name: "ops@example.com", Roles: []string{RoleTrigger}}, principal, key.kid)
+	}
+
+	principal, err := auth.Authenticate(signTestJWT(t, "ec", ecKey, claims(map[string]interface{}{"roles": "read"})))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{RoleRead}, principal.Roles)
+
+	principal, err = auth.Authenticate("not-a-jwt")
+	assert.NoError(t, err)
+	assert.Nil(t, principal)
+
+	for expected, token := range map[string]string{
+		"Invalid JWT signature":                signTestJWT(t, "ec", otherKey, claims(nil)),
+		"Unknown JWT key missing":              signTestJWT(t, "missing", ecKey, claims(nil)),
+		"Unsupported JWT algorithm ES256":      signTestJWT(t, "rsa", ecKey, claims(nil)),
+		"JWT expired":                          signTestJWT(t, "ec", ecKey, claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})),
+		"JWT has no exp":                       signTestJWT(t, "ec", ecKey, claims(map[string]interface{}{"exp": nil})),
+		"JWT not valid yet":                    signTestJWT(t, "ec", ecKey, claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})),
+		"Invalid JWT issuer https://evil.com/": signTestJWT(t, "ec", ecKey, claims(map[string]interface{}{"iss": "https://evil.com/"})),
+		"Invalid JWT audience other":           signTestJWT(t, "ec", ecKey, claims(map[string]interface{}{"aud": "other"})),
+	} {
+		principal, err := auth.Authenticate(token)
+		assert.EqualError(t, err, expected)
+		assert.Nil(t, principal, expected)
+	}
+}
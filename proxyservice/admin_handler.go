@@ -0,0 +1,246 @@
+package proxyservice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AdminHandler serves authenticated endpoints for triggering jobs by hand
+// and for querying recorded events
+//
+//	POST /admin/trigger with form values source, repo and ref (trigger role)
+//	POST /admin/replay/<event-id> (trigger role)
+//	GET  /admin/events?repo=&outcome=&since=&until= (times in RFC 3339)
+//	GET  /admin/metrics (the deployment_proxy expvar map as json)
+//	GET  /admin/status (start time and current config)
+type AdminHandler struct {
+	Auth      Authenticator
+	Dockerhub *DockerHubWebhookHandler
+	Hgmo      *HgmoPulseHandler
+	Events    EventStore
+	Config    *ConfigStore
+	StartedAt time.Time
+
+	Taskcluster   *TaskclusterPulseHandler
+	Subscriptions *PulseSubscriptionHandler
+}
+
+func NewAdminHandler(auth Authenticator, dockerhub *DockerHubWebhookHandler, hgmo *HgmoPulseHandler, events EventStore) *AdminHandler {
+	return &AdminHandler{
+		Auth:      auth,
+		Dockerhub: dockerhub,
+		Hgmo:      hgmo,
+		Events:    events,
+		StartedAt: time.Now(),
+	}
+}
+
+// adminEndpoint is the method and role needed for an admin path
+type adminEndpoint struct {
+	method string
+	role   string
+}
+
+// adminEndpoints by path, paths ending in / include everything below them
+var adminEndpoints = map[string]adminEndpoint{
+	"/admin/trigger": {"POST", RoleTrigger},
+	"/admin/replay/": {"POST", RoleTrigger},
+	"/admin/events":  {"GET", RoleRead},
+	"/admin/metrics": {"GET", RoleRead},
+	"/admin/status":  {"GET", RoleRead},
+}
+
+// authenticate returns the caller of req, or nil if it has no valid token
+func (a *AdminHandler) authenticate(req *http.Request) *Principal {
+	auth := req.Header.Get("Authorization")
+	if a.Auth == nil || !strings.HasPrefix(auth, "Bearer ") {
+		return nil
+	}
+	principal, err := a.Auth.Authenticate(strings.TrimPrefix(auth, "Bearer "))
+	if err != nil {
+		log.Printf("Admin authentication failed from %s: %v", RequestClientIP(req), err)
+	}
+	return principal
+}
+
+func (a *AdminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	principal := a.authenticate(req)
+	if principal == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	paths := make([]string, 0, len(adminEndpoints))
+	for path := range adminEndpoints {
+		paths = append(paths, path)
+	}
+	endpoint, ok := adminEndpoints[matchPath(paths, req.URL.Path)]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != endpoint.method {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if !principal.HasRole(endpoint.role) {
+		log.Printf("Admin %s denied %s, missing role %s", principal.Name, req.URL.Path, endpoint.role)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	req = withPrincipal(req, principal)
+
+	switch {
+	case req.URL.Path == "/admin/trigger":
+		a.serveTrigger(w, req)
+	case strings.HasPrefix(req.URL.Path, "/admin/replay/"):
+		a.serveReplay(w, req, strings.TrimPrefix(req.URL.Path, "/admin/replay/"))
+	case req.URL.Path == "/admin/events":
+		a.serveEvents(w, req)
+	case req.URL.Path == "/admin/metrics":
+		// not expvar.Handler, its cmdline var would show secrets passed as flags
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(Metrics.String()))
+	case req.URL.Path == "/admin/status":
+		a.serveStatus(w, req)
+	}
+}
+
+// Trigger validates and triggers the job for source, repo and ref
+// ref is a tag for dockerhub, a changeset for hgmo and a task id for taskcluster
+func (a *AdminHandler) Trigger(ctx context.Context, source, repo, ref string) error {
+	switch source {
+	case SourceDockerhub:
+		return a.Dockerhub.TriggerTag(ctx, repo, ref)
+	case SourceHgmo:
+		return a.Hgmo.TriggerRevision(ctx, repo, ref)
+	case SourceTaskcluster:
+		return a.Taskcluster.TriggerTask(ctx, repo, ref)
+	}
+	return fmt.Errorf("Unknown source %s", source)
+}
+
+// Replay re-triggers the job for a recorded event
+func (a *AdminHandler) Replay(ctx context.Context, event *Event) error {
+	switch event.Source {
+	case SourceDockerhub:
+		return a.Dockerhub.Replay(ctx, event)
+	case SourceHgmo:
+		return a.Hgmo.Replay(ctx, event)
+	case SourceTaskcluster:
+		return a.Taskcluster.Replay(ctx, event)
+	case SourceAdmin:
+		return fmt.Errorf("Admin event %s can not be replayed", event.ID)
+	}
+	if a.Subscriptions != nil {
+		return a.Subscriptions.Replay(ctx, event)
+	}
+	return fmt.Errorf("Unknown source %s", event.Source)
+}
+
+func (a *AdminHandler) serveTrigger(w http.ResponseWriter, req *http.Request) {
+	source, repo, ref := req.FormValue("source"), req.FormValue("repo"), req.FormValue("ref")
+	if source == "" || repo == "" || ref == "" {
+		http.Error(w, "source, repo and ref must be set", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Admin trigger by %s from %s: %s %s %s", RequestPrincipal(req).Name, RequestClientIP(req), source, repo, ref)
+	err := a.Trigger(req.Context(), source, repo, ref)
+	a.recordAction(req, repo, map[string]string{"action": "trigger", "source": source, "repo": repo, "ref": ref}, err)
+	if err != nil {
+		log.Printf("Admin trigger error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+func (a *AdminHandler) serveReplay(w http.ResponseWriter, req *http.Request, id string) {
+	event, err := a.Events.Get(id)
+	if err == ErrEventNotFound {
+		http.NotFound(w, req)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading event %s: %v", id, err)
+		http.Error(w, "Internal Service Error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Admin replay by %s from %s: %s", RequestPrincipal(req).Name, RequestClientIP(req), id)
+	err = a.Replay(req.Context(), event)
+	a.recordAction(req, event.Repo, map[string]string{"action": "replay", "event_id": id}, err)
+	if err != nil {
+		log.Printf("Admin replay error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+// recordAction records an admin trigger or replay of repo described by
+// action and its result in the audit log
+func (a *AdminHandler) recordAction(req *http.Request, repo string, action map[string]string, err error) {
+	payload, _ := json.Marshal(action)
+	event := NewEvent(SourceAdmin, payload)
+	event.ClientIP = RequestClientIP(req)
+	event.Actor = RequestPrincipal(req).Name
+	event.Repo = repo
+	event.Outcome = OutcomeTriggered
+	if err != nil {
+		event.Outcome = OutcomeFailed
+		event.Reason = err.Error()
+	}
+	if recordErr := a.Events.Record(event); recordErr != nil {
+		log.Printf("Error recording event: %v", recordErr)
+	}
+}
+
+func (a *AdminHandler) serveEvents(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	filter := &EventFilter{
+		Repo:    query.Get("repo"),
+		Outcome: query.Get("outcome"),
+	}
+	for name, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if query.Get(name) == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, query.Get(name))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid %s: %v", name, err), http.StatusBadRequest)
+			return
+		}
+		*t = parsed
+	}
+
+	events, err := a.Events.Query(filter)
+	if err != nil {
+		log.Printf("Error querying events: %v", err)
+		http.Error(w, "Internal Service Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// AdminStatus is served by GET /admin/status
+type AdminStatus struct {
+	StartedAt time.Time `json:"started_at"`
+	Config    *Config   `json:"config,omitempty"`
+}
+
+func (a *AdminHandler) serveStatus(w http.ResponseWriter, req *http.Request) {
+	status := &AdminStatus{StartedAt: a.StartedAt}
+	if a.Config != nil {
+		status.Config = a.Config.Get()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
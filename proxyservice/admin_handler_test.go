@@ -0,0 +1,217 @@
+package proxyservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func sendAdminRequest(path, token string, form url.Values, h http.Handler) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", "http://test"+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestAdminHandler(t *testing.T) {
+	jenkins := NewFakeJenkins()
+	events := NewMemoryEventStore(10)
+	dockerhub := NewDockerHubWebhookHandler(false, NewJenkinsDeployer(jenkins), "mozilla")
+	dockerhub.Events = events
+	hgmo := NewHgmoPulseHandler(NewJenkinsDeployer(jenkins), nil, "proxy-queue", "ci/ci-admin")
+	handler := NewAdminHandler(NewStaticToken("admin", RoleTrigger, "s3cret"), dockerhub, hgmo, events)
+
+	trigger := url.Values{"source": {"dockerhub"}, "repo": {"mozilla/testrepo"}, "ref": {"v1.1.1"}}
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		resp := sendAdminRequest("/admin/trigger", "", trigger, handler)
+		assert.Equal(t, http.StatusUnauthorized, resp.Code)
+		resp = sendAdminRequest("/admin/trigger", "wrong", trigger, handler)
+		assert.Equal(t, http.StatusUnauthorized, resp.Code)
+		assert.Nil(t, jenkins.Jobs)
+	})
+
+	t.Run("Missing Values", func(t *testing.T) {
+		resp := sendAdminRequest("/admin/trigger", "s3cret", url.Values{"source": {"dockerhub"}}, handler)
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+	})
+
+	t.Run("Unknown Source", func(t *testing.T) {
+		resp := sendAdminRequest("/admin/trigger", "s3cret", url.Values{
+			"source": {"github"}, "repo": {"mozilla/testrepo"}, "ref": {"v1"},
+		}, handler)
+		assert.Equal(t, http.StatusInternalServerError, resp.Code)
+		assert.Contains(t, resp.Body.String(), "Unknown source github")
+	})
+
+	t.Run("Invalid Namespace", func(t *testing.T) {
+		jenkins.Jobs = nil
+		resp := sendAdminRequest("/admin/trigger", "s3cret", url.Values{
+			"source": {"dockerhub"}, "repo": {"evil/testrepo"}, "ref": {"v1"},
+		}, handler)
+		assert.Equal(t, http.StatusInternalServerError, resp.Code)
+		assert.Nil(t, jenkins.Jobs)
+
+		action := events.events[len(events.events)-1]
+		assert.Equal(t, SourceAdmin, action.Source)
+		assert.Equal(t, OutcomeFailed, action.Outcome)
+		assert.Equal(t, "evil/testrepo", action.Repo)
+	})
+
+	t.Run("Invalid Revision", func(t *testing.T) {
+		resp := sendAdminRequest("/admin/trigger", "s3cret", url.Values{
+			"source": {"hgmo"}, "repo": {"ci/ci-admin"}, "ref": {"tip"},
+		}, handler)
+		assert.Equal(t, http.StatusInternalServerError, resp.Code)
+		assert.Contains(t, resp.Body.String(), "Invalid revision tip")
+	})
+
+	t.Run("Trigger Dockerhub", func(t *testing.T) {
+		jenkins.Jobs = nil
+		resp := sendAdminRequest("/admin/trigger", "s3cret", trigger, handler)
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, []JenkinsJob{{
+			"/job/dockerhub/job/mozilla/job/testrepo",
+			url.Values{"Tag": {"v1.1.1"}},
+		}}, jenkins.Jobs)
+
+		action := events.events[len(events.events)-1]
+		assert.Equal(t, SourceAdmin, action.Source)
+		assert.Equal(t, "admin", action.Actor)
+		assert.Equal(t, OutcomeTriggered, action.Outcome)
+		assert.JSONEq(t, `{"action": "trigger", "source": "dockerhub", "repo": "mozilla/testrepo", "ref": "v1.1.1"}`, string(action.Payload))
+	})
+
+	t.Run("Replay Unknown Event", func(t *testing.T) {
+		resp := sendAdminRequest("/admin/replay/unknown", "s3cret", nil, handler)
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+	})
+
+	t.Run("Replay Dockerhub", func(t *testing.T) {
+		dataBytes, err := json.Marshal(baseDockerHubWebhookData())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := sendRequest("POST", "http://test/dockerhub", bytes.NewReader(dataBytes), dockerhub)
+		assert.Equal(t, http.StatusOK, resp.Code)
+		webhook := events.events[len(events.events)-1]
+		assert.Equal(t, SourceDockerhub, webhook.Source)
+
+		jenkins.Jobs = nil
+		resp = sendAdminRequest("/admin/replay/"+webhook.ID, "s3cret", nil, handler)
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, []JenkinsJob{{
+			"/job/dockerhub/job/mozilla/job/testrepo",
+			url.Values{"Tag": {"v1.1.1"}},
+		}}, jenkins.Jobs)
+
+		action := events.events[len(events.events)-1]
+		assert.Equal(t, SourceAdmin, action.Source)
+		assert.Equal(t, "mozilla/testrepo", action.Repo)
+		assert.JSONEq(t, `{"action": "replay", "event_id": "`+webhook.ID+`"}`, string(action.Payload))
+
+		// admin events are audited but not replayed
+		resp = sendAdminRequest("/admin/replay/"+action.ID, "s3cret", nil, handler)
+		assert.Equal(t, http.StatusInternalServerError, resp.Code)
+		assert.Contains(t, resp.Body.String(), "can not be replayed")
+	})
+
+	t.Run("Query Events", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "http://test/admin/events?repo=mozilla/testrepo&outcome=triggered", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer s3cret")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		// the admin trigger, the webhook and its replay
+		var found []*Event
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &found))
+		if assert.Len(t, found, 3) {
+			assert.Equal(t, []string{SourceAdmin, SourceDockerhub, SourceAdmin},
+				[]string{found[0].Source, found[1].Source, found[2].Source})
+		}
+
+		req, err = http.NewRequest("GET", "http://test/admin/events?since=yesterday", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer s3cret")
+		resp = httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+	})
+}
+
+func TestAdminHandlerRoles(t *testing.T) {
+	jenkins := NewFakeJenkins()
+	events := NewMemoryEventStore(10)
+	dockerhub := NewDockerHubWebhookHandler(false, NewJenkinsDeployer(jenkins), "mozilla")
+	hgmo := NewHgmoPulseHandler(NewJenkinsDeployer(jenkins), nil, "proxy-queue")
+	handler := NewAdminHandler(Authenticators{
+		NewStaticToken("dashboard", RoleRead, "r3ad"),
+		NewStaticToken("ops", RoleTrigger, "tr1gger"),
+	}, dockerhub, hgmo, events)
+	handler.Config = NewConfigStore(&Config{DockerhubNamespaces: []string{"mozilla"}})
+
+	get := func(path, token string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "http://test"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	trigger := url.Values{"source": {"dockerhub"}, "repo": {"mozilla/testrepo"}, "ref": {"v1.1.1"}}
+	resp := sendAdminRequest("/admin/trigger", "r3ad", trigger, handler)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = sendAdminRequest("/admin/replay/unknown", "r3ad", nil, handler)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Nil(t, jenkins.Jobs)
+
+	resp = sendAdminRequest("/admin/trigger", "tr1gger", trigger, handler)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Len(t, jenkins.Jobs, 1)
+
+	for _, token := range []string{"r3ad", "tr1gger"} {
+		assert.Equal(t, http.StatusOK, get("/admin/events", token).Code, token)
+		assert.Equal(t, http.StatusOK, get("/admin/metrics", token).Code, token)
+	}
+
+	// flags such as --admin-token are not exposed through the metrics
+	args := os.Args
+	defer func() { os.Args = args }()
+	os.Args = append(append([]string(nil), args...), "--admin-token", "tr1gger")
+	resp = get("/admin/metrics", "r3ad")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NotContains(t, resp.Body.String(), "tr1gger")
+	assert.True(t, json.Valid(resp.Body.Bytes()))
+	assert.Equal(t, http.StatusUnauthorized, get("/admin/events", "wrong").Code)
+	assert.Equal(t, http.StatusNotFound, get("/admin/unknown", "r3ad").Code)
+
+	var status AdminStatus
+	resp = get("/admin/status", "r3ad")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &status))
+	assert.Equal(t, []string{"mozilla"}, status.Config.DockerhubNamespaces)
+	assert.False(t, status.StartedAt.IsZero())
+}
@@ -0,0 +1,189 @@
+package proxyservice
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// AMQPSource is a MessageSource talking to pulse with the maintained
+// rabbitmq/amqp091-go client directly instead of pulse-go
+type AMQPSource struct {
+	// URL is the amqp(s) url of pulse, credentials are added to it
+	URL         string
+	Credentials *Credentials
+
+	mu   sync.Mutex
+	conn *amqp.Connection
+}
+
+func NewAMQPSource(pulseURL string, credentials *Credentials) *AMQPSource {
+	return &AMQPSource{URL: pulseURL, Credentials: credentials}
+}
+
+func (s *AMQPSource) dial() (*amqp.Connection, error) {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid pulse url: %v", err)
+	}
+	u.User = url.UserPassword(s.Credentials.Get())
+	conn, err := amqp.Dial(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to pulse: %v", err)
+	}
+	return conn, nil
+}
+
+// Subscribe consumes the pulse queue queue/<user>/<name>, connecting first
+// if needed. Like pulse-go the queue is kept when the connection closes.
+func (s *AMQPSource) Subscribe(name string, bindings []Binding, handle func(*Delivery)) (Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		conn, err := s.dial()
+		if err != nil {
+			return nil, err
+		}
+		s.conn = conn
+	}
+	user, _ := s.Credentials.Get()
+	queue := "queue/" + user + "/" + name
+
+	ch, err := s.conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open a channel: %v", err)
+	}
+	if err := ch.Qos(1, 0, false); err != nil {
+		return nil, fmt.Errorf("Failed to set prefetch: %v", err)
+	}
+	for _, binding := range bindings {
+		if err := ch.ExchangeDeclarePassive(binding.Exchange, "topic", false, false, false, false, nil); err != nil {
+			return nil, fmt.Errorf("Failed to passively declare exchange %s: %v", binding.Exchange, err)
+		}
+	}
+	if _, err := ch.QueueDeclare(queue, false, false, false, false, nil); err != nil {
+		return nil, fmt.Errorf("Failed to declare queue: %v", err)
+	}
+	for _, binding := range bindings {
+		if err := ch.QueueBind(queue, binding.RoutingKey, binding.Exchange, false, nil); err != nil {
+			return nil, fmt.Errorf("Failed to bind a queue: %v", err)
+		}
+	}
+	deliveries, err := ch.Consume(queue, "", false, false, false, false, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to register a consumer: %v", err)
+	}
+
+	sub := newAMQPSubscription(s.conn, queue, ch)
+	go func() {
+		for delivery := range deliveries {
+			handle(newAMQPDelivery(delivery))
+		}
+	}()
+	return sub, nil
+}
+
+// Reconnect replaces the connection with one using the current credentials
+func (s *AMQPSource) Reconnect() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conn, err := s.dial()
+	if err != nil {
+		return err
+	}
+	old := s.conn
+	s.conn = conn
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// newAMQPDelivery wraps an amqp delivery, whose headers are amqp tables
+func newAMQPDelivery(delivery amqp.Delivery) *Delivery {
+	return &Delivery{
+		Exchange:     delivery.Exchange,
+		RoutingKey:   delivery.RoutingKey,
+		Headers:      delivery.Headers,
+		Body:         delivery.Body,
+		Redelivered:  delivery.Redelivered,
+		Acknowledger: amqpAcknowledger{delivery},
+	}
+}
+
+type amqpAcknowledger struct {
+	delivery amqp.Delivery
+}
+
+func (a amqpAcknowledger) Ack() error {
+	return a.delivery.Ack(false)
+}
+
+func (a amqpAcknowledger) Nack(requeue bool) error {
+	return a.delivery.Nack(false, requeue)
+}
+
+// amqpSubscription is a queue consumed on an amqp connection
+type amqpSubscription struct {
+	conn  *amqp.Connection
+	queue string
+	// ch is the channel of the consumer
+	ch   *amqp.Channel
+	done chan error
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newAMQPSubscription(conn *amqp.Connection, queue string, ch *amqp.Channel) *amqpSubscription {
+	sub := &amqpSubscription{conn: conn, queue: queue, ch: ch, done: make(chan error, 1)}
+	// channels are closed with their connection
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		err := <-closed
+		sub.mu.Lock()
+		defer sub.mu.Unlock()
+		if sub.closed {
+			return
+		}
+		if err != nil {
+			sub.done <- err
+		} else {
+			sub.done <- fmt.Errorf("Connection closed")
+		}
+	}()
+	return sub
+}
+
+// Bind uses its own channel, as a failed bind closes the channel
+func (sub *amqpSubscription) Bind(binding Binding) error {
+	ch, err := sub.conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	return ch.QueueBind(sub.queue, binding.RoutingKey, binding.Exchange, false, nil)
+}
+
+func (sub *amqpSubscription) Unbind(binding Binding) error {
+	ch, err := sub.conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	return ch.QueueUnbind(sub.queue, binding.RoutingKey, binding.Exchange, nil)
+}
+
+func (sub *amqpSubscription) Done() <-chan error {
+	return sub.done
+}
+
+// Close closes the channel of the consumer
+func (sub *amqpSubscription) Close() error {
+	sub.mu.Lock()
+	sub.closed = true
+	sub.mu.Unlock()
+	return sub.ch.Close()
+}
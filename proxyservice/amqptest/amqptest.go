@@ -0,0 +1,874 @@
+// Package amqptest provides an in-process AMQP 0-9-1 broker implementing
+// the subset of RabbitMQ used by pulse consumers: PLAIN authentication,
+// passive exchange declarations, queues with topic bindings, consumers
+// with prefetch and acks. It lets pulse consumers be tested without a
+// network or a RabbitMQ server.
+package amqptest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	frameMethod    = 1
+	frameHeader    = 2
+	frameBody      = 3
+	frameHeartbeat = 8
+	frameEnd       = 0xCE
+
+	frameMax = 131072
+)
+
+var protocolHeader = []byte("AMQP\x00\x00\x09\x01")
+
+// Binding is a binding of a queue to an exchange
+type Binding struct {
+	Exchange   string
+	RoutingKey string
+}
+
+// QueueStats counts the messages and consumers of a queue
+type QueueStats struct {
+	// Ready messages wait for a consumer
+	Ready int
+	// Unacked messages were delivered and not acknowledged yet
+	Unacked int
+	// Acked and Nacked count acknowledgements, including
+	// nacks and rejects which requeued their message
+	Acked     int
+	Nacked    int
+	Consumers int
+}
+
+type message struct {
+	exchange    string
+	routingKey  string
+	body        []byte
+	headers     map[string]interface{}
+	redelivered bool
+}
+
+type queue struct {
+	name       string
+	owner      *conn
+	autoDelete bool
+	bindings   []Binding
+	ready      []*message
+	consumers  []*consumer
+	next       int
+	stats      QueueStats
+}
+
+type consumer struct {
+	tag   string
+	ch    *channel
+	queue *queue
+	noAck bool
+}
+
+type delivery struct {
+	msg   *message
+	queue *queue
+}
+
+type channel struct {
+	conn      *conn
+	id        uint16
+	prefetch  int
+	closing   bool
+	nextTag   uint64
+	unacked   map[uint64]*delivery
+	consumers []*consumer
+}
+
+type conn struct {
+	nc       net.Conn
+	wmu      sync.Mutex
+	channels map[uint16]*channel
+}
+
+// Broker is an AMQP broker listening on a local port.
+// Exchanges and users must be added before clients use them.
+type Broker struct {
+	// URL is the amqp url of the broker, without credentials
+	URL string
+
+	ln         net.Listener
+	mu         sync.Mutex
+	users      map[string]string
+	exchanges  map[string]bool
+	queues     map[string]*queue
+	conns      map[*conn]bool
+	nextID     int
+	handshakes int
+}
+
+// NewBroker starts a Broker, which must be closed by the caller
+func NewBroker() *Broker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("amqptest: failed to listen: %v", err))
+	}
+	b := &Broker{
+		URL:       "amqp://" + ln.Addr().String(),
+		ln:        ln,
+		users:     make(map[string]string),
+		exchanges: make(map[string]bool),
+		queues:    make(map[string]*queue),
+		conns:     make(map[*conn]bool),
+	}
+	go b.accept()
+	return b
+}
+
+// Close stops listening and closes all connections
+func (b *Broker) Close() {
+	b.ln.Close()
+	b.CloseConnections()
+}
+
+// AddUser allows user to connect with password, replacing a previous password
+func (b *Broker) AddUser(user, password string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.users[user] = password
+}
+
+// DeclareExchange adds the topic exchange name
+func (b *Broker) DeclareExchange(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.exchanges[name] = true
+}
+
+// Publish routes a message to the queues bound to exchange with a topic
+// matching routingKey and returns the number of queues it was routed to.
+// headers may hold strings, string slices, bools and ints.
+func (b *Broker) Publish(exchange, routingKey string, body []byte, headers map[string]interface{}) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.exchanges[exchange] {
+		return 0, fmt.Errorf("no exchange '%s'", exchange)
+	}
+	routed := 0
+	for _, q := range b.queues {
+		for _, binding := range q.bindings {
+			if binding.Exchange == exchange && topicMatch(binding.RoutingKey, routingKey) {
+				q.ready = append(q.ready, &message{
+					exchange:   exchange,
+					routingKey: routingKey,
+					body:       body,
+					headers:    headers,
+				})
+				routed++
+				break
+			}
+		}
+	}
+	b.dispatch()
+	return routed, nil
+}
+
+// Bindings returns the bindings of queue name in the order they were added
+func (b *Broker) Bindings(name string) []Binding {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[name]
+	if !ok {
+		return nil
+	}
+	return append([]Binding(nil), q.bindings...)
+}
+
+// Queue returns the stats of queue name and false if it doesn't exist
+func (b *Broker) Queue(name string) (QueueStats, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[name]
+	if !ok {
+		return QueueStats{}, false
+	}
+	stats := q.stats
+	stats.Ready = len(q.ready)
+	stats.Consumers = len(q.consumers)
+	return stats, true
+}
+
+// Connections returns the number of open connections
+func (b *Broker) Connections() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.conns)
+}
+
+// Handshakes returns the number of connections which were opened successfully
+func (b *Broker) Handshakes() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.handshakes
+}
+
+// CloseConnections drops all connections without closing them cleanly,
+// like a network failure. Unacknowledged messages are requeued.
+func (b *Broker) CloseConnections() {
+	b.mu.Lock()
+	conns := make([]*conn, 0, len(b.conns))
+	for c := range b.conns {
+		conns = append(conns, c)
+	}
+	b.mu.Unlock()
+	for _, c := range conns {
+		c.nc.Close()
+	}
+}
+
+func (b *Broker) accept() {
+	for {
+		nc, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		go b.serve(nc)
+	}
+}
+
+// topicMatch returns true if key matches the topic pattern,
+// where * matches a word and # zero or more words
+func topicMatch(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	if pattern[0] == "#" {
+		for i := 0; i <= len(words); i++ {
+			if matchWords(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(words) == 0 || (pattern[0] != "*" && pattern[0] != words[0]) {
+		return false
+	}
+	return matchWords(pattern[1:], words[1:])
+}
+
+// serve handles the connection nc until it is closed
+func (b *Broker) serve(nc net.Conn) {
+	defer nc.Close()
+	c := &conn{nc: nc, channels: make(map[uint16]*channel)}
+	r := bufio.NewReader(nc)
+
+	header := make([]byte, len(protocolHeader))
+	if _, err := io.ReadFull(r, header); err != nil {
+		return
+	}
+	if !bytes.Equal(header, protocolHeader) {
+		nc.Write(protocolHeader)
+		return
+	}
+	heartbeat, err := b.handshake(c, r)
+	if err != nil {
+		return
+	}
+
+	b.mu.Lock()
+	b.conns[c] = true
+	b.handshakes++
+	b.mu.Unlock()
+	defer b.dropConn(c)
+
+	done := make(chan struct{})
+	defer close(done)
+	if heartbeat > 0 {
+		go c.heartbeat(heartbeat/2, done)
+	}
+
+	for {
+		typ, channelID, payload, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		if typ != frameMethod {
+			// heartbeats need no answer and clients don't publish
+			continue
+		}
+		d := &decoder{b: payload}
+		class, method := d.short(), d.short()
+		if d.err != nil {
+			return
+		}
+		if class == 10 {
+			// connection.close, answered with close-ok
+			if method == 50 {
+				c.sendMethod(0, 10, 51, nil)
+			}
+			return
+		}
+		if !b.handleMethod(c, channelID, class, method, d) {
+			c.sendMethod(0, 10, 50, new(encoder).short(540).shortstr(
+				fmt.Sprintf("NOT_IMPLEMENTED - method %d.%d", class, method)).short(class).short(method))
+			return
+		}
+	}
+}
+
+// handshake authenticates and opens c, returning the negotiated heartbeat
+func (b *Broker) handshake(c *conn, r *bufio.Reader) (time.Duration, error) {
+	serverProperties := map[string]interface{}{"product": "amqptest"}
+	c.sendMethod(0, 10, 10, new(encoder).octet(0).octet(9).table(serverProperties).
+		longstr("PLAIN").longstr("en_US"))
+
+	d, err := expectMethod(r, 10, 11)
+	if err != nil {
+		return 0, err
+	}
+	d.table()
+	mechanism, response := d.shortstr(), d.longstr()
+	d.shortstr()
+	parts := strings.Split(response, "\x00")
+	if d.err != nil || mechanism != "PLAIN" || len(parts) != 3 {
+		return 0, fmt.Errorf("invalid start-ok")
+	}
+	b.mu.Lock()
+	password, ok := b.users[parts[1]]
+	b.mu.Unlock()
+	if !ok || password != parts[2] {
+		// like RabbitMQ, close the socket after failed authentication
+		return 0, fmt.Errorf("access refused for %s", parts[1])
+	}
+
+	c.sendMethod(0, 10, 30, new(encoder).short(0).long(frameMax).short(0))
+	if d, err = expectMethod(r, 10, 31); err != nil {
+		return 0, err
+	}
+	d.short()
+	d.long()
+	heartbeat := time.Duration(d.short()) * time.Second
+	if _, err := expectMethod(r, 10, 40); err != nil {
+		return 0, err
+	}
+	c.sendMethod(0, 10, 41, new(encoder).shortstr(""))
+	return heartbeat, nil
+}
+
+// handleMethod handles a channel method and returns false if it is not implemented
+func (b *Broker) handleMethod(c *conn, channelID uint16, class, method uint16, d *decoder) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	defer b.dispatch()
+
+	ch := c.channels[channelID]
+	if class == 20 && method == 10 {
+		c.channels[channelID] = &channel{conn: c, id: channelID, unacked: make(map[uint64]*delivery)}
+		c.sendMethod(channelID, 20, 11, new(encoder).longstr(""))
+		return true
+	}
+	if ch == nil {
+		return false
+	}
+	if ch.closing {
+		// the client didn't see the channel close yet, drop everything but close-ok
+		if class == 20 && (method == 40 || method == 41) {
+			delete(c.channels, channelID)
+			if method == 40 {
+				c.sendMethod(channelID, 20, 41, nil)
+			}
+		}
+		return true
+	}
+
+	switch {
+	case class == 20 && method == 40: // channel.close
+		b.closeChannel(ch)
+		delete(c.channels, channelID)
+		c.sendMethod(channelID, 20, 41, nil)
+	case class == 40 && method == 10: // exchange.declare
+		d.short()
+		name := d.shortstr()
+		d.shortstr()
+		bits := d.octet()
+		if !b.exchanges[name] {
+			if bits&1 != 0 {
+				b.channelError(ch, 404, fmt.Sprintf("NOT_FOUND - no exchange '%s' in vhost '/'", name), class, method)
+				return true
+			}
+			b.exchanges[name] = true
+		}
+		if bits&16 == 0 {
+			c.sendMethod(channelID, 40, 11, nil)
+		}
+	case class == 50 && method == 10: // queue.declare
+		d.short()
+		name := d.shortstr()
+		bits := d.octet()
+		q, ok := b.queues[name]
+		if !ok {
+			if bits&1 != 0 {
+				b.channelError(ch, 404, fmt.Sprintf("NOT_FOUND - no queue '%s' in vhost '/'", name), class, method)
+				return true
+			}
+			if name == "" {
+				b.nextID++
+				name = fmt.Sprintf("amq.gen-%d", b.nextID)
+			}
+			q = &queue{name: name, autoDelete: bits&8 != 0}
+			if bits&4 != 0 {
+				q.owner = c
+			}
+			b.queues[name] = q
+		}
+		if bits&16 == 0 {
+			c.sendMethod(channelID, 50, 11, new(encoder).shortstr(q.name).long(uint32(len(q.ready))).long(uint32(len(q.consumers))))
+		}
+	case class == 50 && (method == 20 || method == 50): // queue.bind and queue.unbind
+		d.short()
+		name, exchange, key := d.shortstr(), d.shortstr(), d.shortstr()
+		q, ok := b.queues[name]
+		if !ok {
+			b.channelError(ch, 404, fmt.Sprintf("NOT_FOUND - no queue '%s' in vhost '/'", name), class, method)
+			return true
+		}
+		if !b.exchanges[exchange] {
+			b.channelError(ch, 404, fmt.Sprintf("NOT_FOUND - no exchange '%s' in vhost '/'", exchange), class, method)
+			return true
+		}
+		binding := Binding{Exchange: exchange, RoutingKey: key}
+		bindings := q.bindings[:0]
+		for _, existing := range q.bindings {
+			if existing != binding {
+				bindings = append(bindings, existing)
+			}
+		}
+		q.bindings = bindings
+		if method == 20 {
+			q.bindings = append(q.bindings, binding)
+			if d.octet()&1 == 0 {
+				c.sendMethod(channelID, 50, 21, nil)
+			}
+		} else {
+			c.sendMethod(channelID, 50, 51, nil)
+		}
+	case class == 60 && method == 10: // basic.qos
+		d.long()
+		ch.prefetch = int(d.short())
+		c.sendMethod(channelID, 60, 11, nil)
+	case class == 60 && method == 20: // basic.consume
+		d.short()
+		name, tag := d.shortstr(), d.shortstr()
+		bits := d.octet()
+		q, ok := b.queues[name]
+		if !ok {
+			b.channelError(ch, 404, fmt.Sprintf("NOT_FOUND - no queue '%s' in vhost '/'", name), class, method)
+			return true
+		}
+		if tag == "" {
+			b.nextID++
+			tag = fmt.Sprintf("amq.ctag-%d", b.nextID)
+		}
+		cons := &consumer{tag: tag, ch: ch, queue: q, noAck: bits&2 != 0}
+		ch.consumers = append(ch.consumers, cons)
+		q.consumers = append(q.consumers, cons)
+		if bits&8 == 0 {
+			c.sendMethod(channelID, 60, 21, new(encoder).shortstr(tag))
+		}
+	case class == 60 && method == 30: // basic.cancel
+		tag := d.shortstr()
+		for _, cons := range ch.consumers {
+			if cons.tag == tag {
+				b.removeConsumer(cons)
+			}
+		}
+		if d.octet()&1 == 0 {
+			c.sendMethod(channelID, 60, 31, new(encoder).shortstr(tag))
+		}
+	case class == 60 && (method == 80 || method == 90 || method == 120): // basic.ack, reject and nack
+		tag := d.longlong()
+		bits := d.octet()
+		multiple, requeue := bits&1 != 0 && method != 90, bits&1 != 0
+		if method == 120 {
+			requeue = bits&2 != 0
+		}
+		tags := []uint64{tag}
+		if multiple {
+			tags = ch.tagsUpTo(tag)
+		}
+		for _, t := range tags {
+			if _, ok := ch.unacked[t]; !ok {
+				b.channelError(ch, 406, fmt.Sprintf("PRECONDITION_FAILED - unknown delivery tag %d", t), class, method)
+				return true
+			}
+		}
+		for _, t := range tags {
+			del := ch.unacked[t]
+			delete(ch.unacked, t)
+			del.queue.stats.Unacked--
+			if method == 80 {
+				del.queue.stats.Acked++
+			} else {
+				del.queue.stats.Nacked++
+				if requeue {
+					del.msg.redelivered = true
+					del.queue.ready = append([]*message{del.msg}, del.queue.ready...)
+				}
+			}
+		}
+	case class == 60 && method == 110: // basic.recover
+		b.requeue(ch)
+		c.sendMethod(channelID, 60, 111, nil)
+	default:
+		return false
+	}
+	return true
+}
+
+// tagsUpTo returns the unacked delivery tags up to tag, in order
+func (ch *channel) tagsUpTo(tag uint64) []uint64 {
+	tags := make([]uint64, 0)
+	for t := range ch.unacked {
+		if t <= tag {
+			tags = append(tags, t)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	return tags
+}
+
+// channelError closes ch with an error like RabbitMQ does, b.mu must be held
+func (b *Broker) channelError(ch *channel, code uint16, text string, class, method uint16) {
+	b.closeChannel(ch)
+	ch.closing = true
+	ch.conn.sendMethod(ch.id, 20, 40, new(encoder).short(code).shortstr(text).short(class).short(method))
+}
+
+// closeChannel cancels the consumers of ch and requeues its unacked
+// messages, b.mu must be held
+func (b *Broker) closeChannel(ch *channel) {
+	for _, cons := range append([]*consumer(nil), ch.consumers...) {
+		b.removeConsumer(cons)
+	}
+	b.requeue(ch)
+}
+
+// requeue puts the unacked messages of ch back in their queues, b.mu must be held
+func (b *Broker) requeue(ch *channel) {
+	tags := ch.tagsUpTo(ch.nextTag)
+	for i := len(tags) - 1; i >= 0; i-- {
+		del := ch.unacked[tags[i]]
+		delete(ch.unacked, tags[i])
+		del.queue.stats.Unacked--
+		del.msg.redelivered = true
+		del.queue.ready = append([]*message{del.msg}, del.queue.ready...)
+	}
+}
+
+// removeConsumer cancels cons and deletes its queue if it is
+// auto-delete and has no consumers left, b.mu must be held
+func (b *Broker) removeConsumer(cons *consumer) {
+	cons.ch.consumers = removeFrom(cons.ch.consumers, cons)
+	q := cons.queue
+	q.consumers = removeFrom(q.consumers, cons)
+	if q.autoDelete && len(q.consumers) == 0 {
+		delete(b.queues, q.name)
+	}
+}
+
+func removeFrom(consumers []*consumer, cons *consumer) []*consumer {
+	kept := make([]*consumer, 0, len(consumers))
+	for _, c := range consumers {
+		if c != cons {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// dropConn closes the channels of c and deletes its exclusive queues
+func (b *Broker) dropConn(c *conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range c.channels {
+		b.closeChannel(ch)
+	}
+	for name, q := range b.queues {
+		if q.owner == c {
+			delete(b.queues, name)
+		}
+	}
+	delete(b.conns, c)
+	b.dispatch()
+}
+
+// dispatch delivers ready messages to consumers with room
+// for them in their prefetch, b.mu must be held
+func (b *Broker) dispatch() {
+	for _, q := range b.queues {
+		for len(q.ready) > 0 {
+			cons := q.nextConsumer()
+			if cons == nil {
+				break
+			}
+			msg := q.ready[0]
+			q.ready = q.ready[1:]
+			cons.deliver(msg)
+		}
+	}
+}
+
+// nextConsumer returns the next consumer in turn which can take a message
+func (q *queue) nextConsumer() *consumer {
+	for i := range q.consumers {
+		cons := q.consumers[(q.next+i)%len(q.consumers)]
+		if cons.ch.prefetch == 0 || len(cons.ch.unacked) < cons.ch.prefetch {
+			q.next = (q.next + i + 1) % len(q.consumers)
+			return cons
+		}
+	}
+	return nil
+}
+
+func (cons *consumer) deliver(msg *message) {
+	ch := cons.ch
+	ch.nextTag++
+	if cons.noAck {
+		cons.queue.stats.Acked++
+	} else {
+		ch.unacked[ch.nextTag] = &delivery{msg: msg, queue: cons.queue}
+		cons.queue.stats.Unacked++
+	}
+
+	redelivered := byte(0)
+	if msg.redelivered {
+		redelivered = 1
+	}
+	ch.conn.sendMethod(ch.id, 60, 60, new(encoder).shortstr(cons.tag).longlong(ch.nextTag).
+		octet(redelivered).shortstr(msg.exchange).shortstr(msg.routingKey))
+
+	// content-type and headers properties
+	header := new(encoder).short(60).short(0).longlong(uint64(len(msg.body)))
+	if msg.headers != nil {
+		header.short(0x8000 | 0x2000).shortstr("application/json").table(msg.headers)
+	} else {
+		header.short(0x8000).shortstr("application/json")
+	}
+	ch.conn.send(frameHeader, ch.id, header.Bytes())
+	for body := msg.body; len(body) > 0; {
+		n := len(body)
+		if n > frameMax-8 {
+			n = frameMax - 8
+		}
+		ch.conn.send(frameBody, ch.id, body[:n])
+		body = body[n:]
+	}
+}
+
+func (c *conn) heartbeat(interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			c.send(frameHeartbeat, 0, nil)
+		}
+	}
+}
+
+// send writes a frame, errors are left to the reader of the connection
+func (c *conn) send(typ byte, channelID uint16, payload []byte) {
+	frame := make([]byte, 7, 8+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint16(frame[1:3], channelID)
+	binary.BigEndian.PutUint32(frame[3:7], uint32(len(payload)))
+	frame = append(append(frame, payload...), frameEnd)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.nc.Write(frame)
+}
+
+func (c *conn) sendMethod(channelID uint16, class, method uint16, args *encoder) {
+	payload := new(encoder).short(class).short(method)
+	if args != nil {
+		payload.Write(args.Bytes())
+	}
+	c.send(frameMethod, channelID, payload.Bytes())
+}
+
+func readFrame(r *bufio.Reader) (byte, uint16, []byte, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[3:7])
+	if size > frameMax {
+		return 0, 0, nil, fmt.Errorf("frame too large")
+	}
+	payload := make([]byte, size+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	if payload[size] != frameEnd {
+		return 0, 0, nil, fmt.Errorf("invalid frame end")
+	}
+	return header[0], binary.BigEndian.Uint16(header[1:3]), payload[:size], nil
+}
+
+// expectMethod reads a method frame and returns a decoder for its arguments
+func expectMethod(r *bufio.Reader, class, method uint16) (*decoder, error) {
+	for {
+		typ, _, payload, err := readFrame(r)
+		if err != nil {
+			return nil, err
+		}
+		if typ == frameHeartbeat {
+			continue
+		}
+		d := &decoder{b: payload}
+		if typ != frameMethod || d.short() != class || d.short() != method {
+			return nil, fmt.Errorf("expected method %d.%d", class, method)
+		}
+		return d, nil
+	}
+}
+
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) octet(v byte) *encoder {
+	e.WriteByte(v)
+	return e
+}
+
+func (e *encoder) short(v uint16) *encoder {
+	binary.Write(e, binary.BigEndian, v)
+	return e
+}
+
+func (e *encoder) long(v uint32) *encoder {
+	binary.Write(e, binary.BigEndian, v)
+	return e
+}
+
+func (e *encoder) longlong(v uint64) *encoder {
+	binary.Write(e, binary.BigEndian, v)
+	return e
+}
+
+func (e *encoder) shortstr(s string) *encoder {
+	e.WriteByte(byte(len(s)))
+	e.WriteString(s)
+	return e
+}
+
+func (e *encoder) longstr(s string) *encoder {
+	e.long(uint32(len(s)))
+	e.WriteString(s)
+	return e
+}
+
+// table encodes t with its keys sorted
+func (e *encoder) table(t map[string]interface{}) *encoder {
+	keys := make([]string, 0, len(t))
+	for key := range t {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fields := new(encoder)
+	for _, key := range keys {
+		fields.shortstr(key).value(t[key])
+	}
+	e.long(uint32(fields.Len()))
+	e.Write(fields.Bytes())
+	return e
+}
+
+func (e *encoder) value(v interface{}) *encoder {
+	switch v := v.(type) {
+	case string:
+		e.octet('S').longstr(v)
+	case bool:
+		if v {
+			e.octet('t').octet(1)
+		} else {
+			e.octet('t').octet(0)
+		}
+	case int:
+		e.octet('I').long(uint32(int32(v)))
+	case []string:
+		values := make([]interface{}, len(v))
+		for i, s := range v {
+			values[i] = s
+		}
+		e.value(values)
+	case []interface{}:
+		items := new(encoder)
+		for _, item := range v {
+			items.value(item)
+		}
+		e.octet('A').long(uint32(items.Len()))
+		e.Write(items.Bytes())
+	case map[string]interface{}:
+		e.octet('F').table(v)
+	default:
+		panic(fmt.Sprintf("amqptest: unsupported header value %T", v))
+	}
+	return e
+}
+
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil || len(d.b) < n {
+		d.err = io.ErrUnexpectedEOF
+		return make([]byte, n)
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) octet() byte {
+	return d.next(1)[0]
+}
+
+func (d *decoder) short() uint16 {
+	return binary.BigEndian.Uint16(d.next(2))
+}
+
+func (d *decoder) long() uint32 {
+	return binary.BigEndian.Uint32(d.next(4))
+}
+
+func (d *decoder) longlong() uint64 {
+	return binary.BigEndian.Uint64(d.next(8))
+}
+
+func (d *decoder) shortstr() string {
+	return string(d.next(int(d.octet())))
+}
+
+func (d *decoder) longstr() string {
+	return string(d.next(int(d.long())))
+}
+
+// table skips a field table, which clients only send as arguments
+func (d *decoder) table() {
+	d.longstr()
+}
@@ -0,0 +1,109 @@
+package amqptest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicMatch(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		match        bool
+	}{
+		{"ci/ci-admin", "ci/ci-admin", true},
+		{"ci/ci-admin", "ci/ci-configuration", false},
+		{"*.b", "a.b", true},
+		{"*.b", "a.c.b", false},
+		{"#.b", "a.c.b", true},
+		{"#", "", true},
+		{"a.#", "a", true},
+		{"route.#.deploy", "route.x.y.deploy", true},
+		{"route.*", "route", false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.match, topicMatch(test.pattern, test.key), test.pattern+" "+test.key)
+	}
+}
+
+func receive(t *testing.T, deliveries <-chan amqp.Delivery) amqp.Delivery {
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery")
+	}
+	return amqp.Delivery{}
+}
+
+func TestBroker(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+	b.AddUser("user", "pass")
+	b.DeclareExchange("exchange/test")
+
+	_, err := amqp.Dial(strings.Replace(b.URL, "amqp://", "amqp://user:wrong@", 1))
+	assert.Equal(t, amqp.ErrCredentials, err)
+
+	conn, err := amqp.Dial(strings.Replace(b.URL, "amqp://", "amqp://user:pass@", 1))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	assert.Equal(t, 1, b.Connections())
+
+	ch, _ := conn.Channel()
+	err = ch.ExchangeDeclarePassive("exchange/missing", "topic", false, false, false, false, nil)
+	assert.Contains(t, err.Error(), "NOT_FOUND - no exchange 'exchange/missing'")
+
+	ch, _ = conn.Channel()
+	assert.NoError(t, ch.ExchangeDeclarePassive("exchange/test", "topic", false, false, false, false, nil))
+	_, err = ch.QueueDeclare("queue/user/test", false, false, false, false, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, ch.QueueBind("queue/user/test", "a.#", "exchange/test", false, nil))
+	assert.NoError(t, ch.QueueBind("queue/user/test", "b", "exchange/test", false, nil))
+	assert.NoError(t, ch.QueueUnbind("queue/user/test", "b", "exchange/test", nil))
+	assert.Equal(t, []Binding{{"exchange/test", "a.#"}}, b.Bindings("queue/user/test"))
+
+	routed, err := b.Publish("exchange/test", "a.b", []byte(`{"n": 1}`), map[string]interface{}{"CC": []string{"route.x"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, routed)
+	routed, _ = b.Publish("exchange/test", "b", []byte(`{}`), nil)
+	assert.Equal(t, 0, routed)
+	_, err = b.Publish("exchange/missing", "a", nil, nil)
+	assert.Error(t, err)
+
+	assert.NoError(t, ch.Qos(1, 0, false))
+	deliveries, err := ch.Consume("queue/user/test", "", false, false, false, false, nil)
+	assert.NoError(t, err)
+	d := receive(t, deliveries)
+	assert.Equal(t, "exchange/test", d.Exchange)
+	assert.Equal(t, "a.b", d.RoutingKey)
+	assert.Equal(t, `{"n": 1}`, string(d.Body))
+	assert.Equal(t, []interface{}{"route.x"}, d.Headers["CC"])
+	assert.False(t, d.Redelivered)
+
+	// prefetch holds the second message until the first is acked
+	b.Publish("exchange/test", "a.c", []byte(`{"n": 2}`), nil)
+	stats, _ := b.Queue("queue/user/test")
+	assert.Equal(t, QueueStats{Ready: 1, Unacked: 1, Consumers: 1}, stats)
+	assert.NoError(t, d.Nack(false, true))
+	d = receive(t, deliveries)
+	assert.Equal(t, `{"n": 1}`, string(d.Body))
+	assert.True(t, d.Redelivered)
+	assert.NoError(t, d.Ack(false))
+	d = receive(t, deliveries)
+	assert.Equal(t, `{"n": 2}`, string(d.Body))
+
+	// unacked messages are requeued when the connection drops
+	b.CloseConnections()
+	for b.Connections() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats, _ = b.Queue("queue/user/test")
+	assert.Equal(t, QueueStats{Ready: 1, Acked: 1, Nacked: 1}, stats)
+	assert.Equal(t, 1, b.Handshakes())
+}
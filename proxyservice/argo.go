@@ -0,0 +1,66 @@
+package proxyservice
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// ArgoDeployer submits an Argo WorkflowTemplate through the argo server API
+// https://argoproj.github.io/argo-workflows/rest-api/
+type ArgoDeployer struct {
+	BaseURL          string
+	Namespace        string
+	WorkflowTemplate string
+
+	TokenFile string
+	Client    *http.Client
+}
+
+func NewArgoDeployer(target *Target) *ArgoDeployer {
+	return &ArgoDeployer{
+		BaseURL:          strings.TrimSuffix(target.URL, "/"),
+		Namespace:        target.Namespace,
+		WorkflowTemplate: target.WorkflowTemplate,
+		TokenFile:        target.TokenFile,
+		Client:           &http.Client{Timeout: target.TimeoutDuration()},
+	}
+}
+
+// Destination returns the submit url
+func (a *ArgoDeployer) Destination(route *Route, event *DeployEvent) string {
+	return fmt.Sprintf("%s/api/v1/workflows/%s/submit", a.BaseURL, url.PathEscape(a.Namespace))
+}
+
+// Deploy submits the workflow template with the job params of event as parameters
+func (a *ArgoDeployer) Deploy(ctx context.Context, route *Route, event *DeployEvent) error {
+	inputs := deploymentInputs(event.JobParams())
+	parameters := make([]string, 0, len(inputs))
+	for key, value := range inputs {
+		parameters = append(parameters, key+"="+value)
+	}
+	sort.Strings(parameters)
+
+	type submitOptions struct {
+		Parameters []string `json:"parameters"`
+	}
+	body := struct {
+		Namespace     string        `json:"namespace"`
+		ResourceKind  string        `json:"resourceKind"`
+		ResourceName  string        `json:"resourceName"`
+		SubmitOptions submitOptions `json:"submitOptions"`
+	}{
+		Namespace:     a.Namespace,
+		ResourceKind:  "WorkflowTemplate",
+		ResourceName:  a.WorkflowTemplate,
+		SubmitOptions: submitOptions{Parameters: parameters},
+	}
+	token, err := bearerToken(a.TokenFile)
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, a.Client, a.Destination(route, event), token, nil, body)
+}
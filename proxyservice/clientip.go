@@ -0,0 +1,256 @@
+package proxyservice
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type clientIPKey struct{}
+
+// ParseCIDRs parses CIDRs and bare IP addresses
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid IP address %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR %q", cidr)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP resolves the address of the caller of requests
+// which passed through trusted proxies such as load balancers
+type ClientIP struct {
+	TrustedProxies []*net.IPNet
+}
+
+func NewClientIP(trustedProxies ...string) (*ClientIP, error) {
+	nets, err := ParseCIDRs(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientIP{TrustedProxies: nets}, nil
+}
+
+// Resolve returns the first address in X-Forwarded-For, from the right,
+// which is not a trusted proxy. X-Forwarded-For is ignored unless the
+// request came from a trusted proxy.
+func (c *ClientIP) Resolve(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(c.TrustedProxies, ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !containsIP(c.TrustedProxies, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// Middleware makes the resolved client address available to next
+// with RequestClientIP
+func (c *ClientIP) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ip := c.Resolve(req)
+		if ip != nil {
+			req = req.WithContext(context.WithValue(req.Context(), clientIPKey{}, ip))
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// RequestClientIP returns the client address resolved by ClientIP.Middleware,
+// or the host of req.RemoteAddr
+func RequestClientIP(req *http.Request) string {
+	if ip, ok := req.Context().Value(clientIPKey{}).(net.IP); ok {
+		return ip.String()
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// CIDRFile holds the CIDRs listed in a file, one per line with # comments,
+// e.g., the published Docker Hub webhook ranges
+type CIDRFile struct {
+	Path string
+
+	mu      sync.RWMutex
+	content []byte
+	nets    []*net.IPNet
+}
+
+// NewCIDRFile reads the CIDRs in path
+func NewCIDRFile(path string) (*CIDRFile, error) {
+	f := &CIDRFile{Path: path}
+	if err := f.Refresh(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Contains returns true if ip is in one of the CIDRs
+func (f *CIDRFile) Contains(ip net.IP) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return containsIP(f.nets, ip)
+}
+
+// Refresh re-reads the file, keeping the previous CIDRs if it is invalid
+func (f *CIDRFile) Refresh() error {
+	content, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return fmt.Errorf("Error reading CIDR file: %v", err)
+	}
+	f.mu.RLock()
+	unchanged := f.content != nil && bytes.Equal(content, f.content)
+	f.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cidrs := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if line != "" {
+			cidrs = append(cidrs, line)
+		}
+	}
+	nets, err := ParseCIDRs(cidrs)
+	if err != nil {
+		return fmt.Errorf("Error parsing %s: %v", f.Path, err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.content != nil {
+		log.Printf("CIDR file %s changed", f.Path)
+	}
+	f.content = content
+	f.nets = nets
+	return nil
+}
+
+// Watch refreshes the file every interval
+func (f *CIDRFile) Watch(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := f.Refresh(); err != nil {
+				log.Printf("Keeping previous CIDRs: %v", err)
+			}
+		}
+	}()
+}
+
+// Allowlist rejects requests from clients outside the CIDRs of the path
+type Allowlist struct {
+	// Paths maps url paths to the CIDRs allowed to call them. A path also
+	// applies to everything below it, so /dockerhub covers /dockerhub/<token>.
+	Paths map[string]*CIDRFile
+}
+
+// matchPath returns the longest pattern matching path, or "". Patterns
+// ending in / match everything below them, like http.ServeMux patterns.
+func matchPath(patterns []string, path string) string {
+	var match string
+	for _, pattern := range patterns {
+		if len(pattern) <= len(match) {
+			continue
+		}
+		if pattern == path || (strings.HasSuffix(pattern, "/") && strings.HasPrefix(path, pattern)) {
+			match = pattern
+		}
+	}
+	return match
+}
+
+// matchPathTree is matchPath where every pattern matches everything below
+// it, as handlers such as /dockerhub are also mounted at /dockerhub/
+func matchPathTree(patterns []string, path string) string {
+	var match string
+	for _, pattern := range patterns {
+		if len(pattern) <= len(match) {
+			continue
+		}
+		if pattern == path || strings.HasPrefix(path, strings.TrimSuffix(pattern, "/")+"/") {
+			match = pattern
+		}
+	}
+	return match
+}
+
+// cidrs returns the allowlist for path, preferring the longest match
+func (a *Allowlist) cidrs(path string) *CIDRFile {
+	patterns := make([]string, 0, len(a.Paths))
+	for pattern := range a.Paths {
+		patterns = append(patterns, pattern)
+	}
+	return a.Paths[matchPathTree(patterns, path)]
+}
+
+// Middleware rejects clients outside the allowlist of the request path
+// with 403, it must be wrapped by ClientIP.Middleware
+func (a *Allowlist) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		cidrs := a.cidrs(req.URL.Path)
+		if cidrs == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		clientIP := RequestClientIP(req)
+		if ip := net.ParseIP(clientIP); ip == nil || !cidrs.Contains(ip) {
+			log.Printf("Rejected %s from %s, not in %s", req.URL.Path, clientIP, cidrs.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
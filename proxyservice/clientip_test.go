@@ -0,0 +1,95 @@
+package proxyservice
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIPResolve(t *testing.T) {
+	clientIP, err := NewClientIP("10.0.0.0/8", "192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		remoteAddr, forwardedFor, expected string
+	}{
+		{"203.0.113.9:1234", "", "203.0.113.9"},
+		// untrusted callers can't spoof their address
+		{"203.0.113.9:1234", "198.51.100.1", "203.0.113.9"},
+		{"10.1.2.3:1234", "198.51.100.1", "198.51.100.1"},
+		{"10.1.2.3:1234", "1.1.1.1, 198.51.100.1, 192.168.1.1", "198.51.100.1"},
+		{"10.1.2.3:1234", "10.4.4.4", "10.4.4.4"},
+		{"10.1.2.3:1234", "junk, 10.4.4.4", "10.4.4.4"},
+		{"10.1.2.3:1234", "", "10.1.2.3"},
+	} {
+		req := httptest.NewRequest("POST", "http://test/dockerhub", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		assert.Equal(t, test.expected, clientIP.Resolve(req).String(), test.forwardedFor)
+	}
+
+	_, err = NewClientIP("10.0.0.0/33")
+	assert.Error(t, err)
+}
+
+func TestAllowlist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "allowlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeTestFile(t, dir, "dockerhub.txt", []byte("# docker hub\n198.51.100.0/24\n\n2001:db8::1 # v6\n"))
+	cidrs, err := NewCIDRFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientIP, err := NewClientIP("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowlist := &Allowlist{Paths: map[string]*CIDRFile{"/dockerhub": cidrs, "/dockerhub/": cidrs}}
+	handler := clientIP.Middleware(allowlist.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(RequestClientIP(req)))
+	})))
+
+	send := func(path, remoteAddr, forwardedFor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "http://test"+path, nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := send("/dockerhub", "10.0.0.1:80", "198.51.100.7")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "198.51.100.7", resp.Body.String())
+	assert.Equal(t, http.StatusOK, send("/dockerhub/token", "[2001:db8::1]:80", "").Code)
+	assert.Equal(t, http.StatusForbidden, send("/dockerhub", "10.0.0.1:80", "203.0.113.9").Code)
+	assert.Equal(t, http.StatusForbidden, send("/dockerhub/token", "203.0.113.9:80", "198.51.100.7").Code)
+	assert.Equal(t, http.StatusOK, send("/__heartbeat__", "203.0.113.9:80", "").Code)
+
+	// invalid files keep the previous CIDRs
+	writeTestFile(t, dir, "dockerhub.txt", []byte("not a cidr\n"))
+	assert.Error(t, cidrs.Refresh())
+	assert.Equal(t, http.StatusOK, send("/dockerhub", "198.51.100.7:80", "").Code)
+
+	writeTestFile(t, dir, "dockerhub.txt", []byte("203.0.113.0/24\n"))
+	assert.NoError(t, cidrs.Refresh())
+	assert.Equal(t, http.StatusForbidden, send("/dockerhub", "198.51.100.7:80", "").Code)
+	assert.Equal(t, http.StatusOK, send("/dockerhub", "203.0.113.9:80", "").Code)
+
+	// a path covers everything below it without a second / entry
+	allowlist.Paths = map[string]*CIDRFile{"/dockerhub": cidrs}
+	assert.Equal(t, http.StatusForbidden, send("/dockerhub/x", "198.51.100.7:80", "").Code)
+	assert.Equal(t, http.StatusOK, send("/dockerhub/x", "203.0.113.9:80", "").Code)
+	assert.Equal(t, http.StatusOK, send("/dockerhubx", "198.51.100.7:80", "").Code)
+}
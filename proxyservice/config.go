@@ -0,0 +1,723 @@
+package proxyservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+// Config holds the allowlists and routing which can be reloaded without a restart
+type Config struct {
+	DockerhubNamespaces []string `json:"dockerhub_namespaces"`
+	// DockerhubTokenFiles maps namespaces to files holding the token
+	// webhooks for the namespace must send
+	DockerhubTokenFiles map[string]string `json:"dockerhub_token_files,omitempty"`
+	HgmoRepos           []string          `json:"hgmo_repos"`
+	// HgmoRules restrict which pushes to hgmo repositories are deployed
+	HgmoRules []*HgmoRule `json:"hgmo_rules,omitempty"`
+	// TaskclusterBindings select the completed tasks to deploy
+	TaskclusterBindings []*TaskclusterBinding `json:"taskcluster_bindings,omitempty"`
+	// PulseSubscriptions deploy messages from any pulse exchange
+	PulseSubscriptions []*PulseSubscription `json:"pulse_subscriptions,omitempty"`
+	Routes             []*Route             `json:"routes"`
+	// Targets are deployment backends routes can use instead of jenkins
+	Targets map[string]*Target `json:"targets,omitempty"`
+}
+
+// HgmoRule restricts the pushes deployed from repositories matching Repo.
+// Empty lists allow everything.
+type HgmoRule struct {
+	// Repo is a path.Match pattern, e.g., ci/*
+	Repo string `json:"repo"`
+	// Users are path.Match patterns of push users, e.g., *@mozilla.com
+	Users []string `json:"users,omitempty"`
+	// UserFiles list allowed push users one per line, e.g., the members
+	// of an LDAP group. They are re-read for each push.
+	UserFiles []string `json:"user_files,omitempty"`
+	// Branches are path.Match patterns of the branch of the head
+	Branches []string `json:"branches,omitempty"`
+	// Bookmarks are path.Match patterns of the bookmarks whose moves deploy
+	Bookmarks []string `json:"bookmarks,omitempty"`
+}
+
+// TaskclusterBinding deploys tasks completed with a matching routing key as Repo
+type TaskclusterBinding struct {
+	// RoutingKey is an AMQP topic pattern matched against the primary
+	// routing key and routes of task-completed messages,
+	// e.g., route.index.project.myapp.docker-image.#
+	RoutingKey string `json:"routing_key"`
+	// Repo names the tasks for routing, e.g., mozilla/myapp
+	Repo string `json:"repo"`
+	// ImageArtifact is the docker image artifact of the tasks,
+	// defaults to DefaultImageArtifact
+	ImageArtifact string `json:"image_artifact,omitempty"`
+}
+
+// DefaultImageArtifact is the docker image artifact of taskcluster
+// tasks whose binding does not set one
+const DefaultImageArtifact = "public/image.tar.zst"
+
+// ImageArtifactName returns b.ImageArtifact or DefaultImageArtifact
+func (b *TaskclusterBinding) ImageArtifactName() string {
+	if b.ImageArtifact == "" {
+		return DefaultImageArtifact
+	}
+	return b.ImageArtifact
+}
+
+// PulseSubscription deploys messages from Exchange matching RoutingKey.
+// Events from a subscription have its Name as their source.
+type PulseSubscription struct {
+	Name     string `json:"name"`
+	Exchange string `json:"exchange"`
+	// RoutingKey is an AMQP topic pattern, see TaskclusterBinding
+	RoutingKey string `json:"routing_key"`
+	// Queue is the pulse queue, subscriptions sharing a queue share a
+	// consumer. Defaults to Name.
+	Queue string `json:"queue,omitempty"`
+	// Fields maps names to JSON paths of message values, e.g.,
+	// {"repo": "payload.repo", "ref": "payload.tags.0"}. The repo, ref,
+	// revision and actor fields set those of the deploy event, all fields
+	// are passed as job parameters.
+	Fields map[string]string `json:"fields"`
+	// JobPath and Target are used for events without a matching route
+	JobPath string `json:"job_path,omitempty"`
+	Target  string `json:"target,omitempty"`
+}
+
+// QueueName returns s.Queue or s.Name
+func (s *PulseSubscription) QueueName() string {
+	if s.Queue == "" {
+		return s.Name
+	}
+	return s.Queue
+}
+
+// Route returns the route of events without a matching route in the config
+func (s *PulseSubscription) Route() *Route {
+	return &Route{Source: s.Name, Repo: "*", JobPath: s.JobPath, Target: s.Target}
+}
+
+var validSubscriptionName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// Route overrides how events from Source for repositories matching Repo are triggered
+type Route struct {
+	Source string `json:"source"`
+	// Repo is a path.Match pattern, e.g., mozilla/* or ci/ci-admin
+	Repo string `json:"repo"`
+	// JobPath is the full path to the jenkins job e.g., /job/pipelines/job/myjob/
+	JobPath string `json:"job_path,omitempty"`
+	// Target is the name of an entry in Config.Targets, defaults to jenkins
+	Target string `json:"target,omitempty"`
+	// Params replace the default jenkins job parameters. Values are
+	// text/template templates executed with the *DeployEvent,
+	// e.g., {"IMAGE": "{{.Image}}", "ENV": "prod"}
+	Params map[string]string `json:"params,omitempty"`
+	// OmitRawJSON drops the RawJSON job parameter
+	OmitRawJSON bool `json:"omit_raw_json,omitempty"`
+	// Bookmark is a path.Match pattern of hg bookmarks, e.g., production.
+	// hgmo routes with a bookmark deploy when a matching bookmark moves
+	// instead of on every push.
+	Bookmark string `json:"bookmark,omitempty"`
+	// Delay holds hgmo deploys, e.g., 5m, so that deploys of changesets
+	// obsoleted in the meantime can be cancelled
+	Delay string `json:"delay,omitempty"`
+}
+
+// DelayDuration returns the parsed Delay, or 0
+func (route *Route) DelayDuration() time.Duration {
+	if route == nil || route.Delay == "" {
+		return 0
+	}
+	delay, _ := time.ParseDuration(route.Delay) // checked by Validate
+	return delay
+}
+
+// paramTemplate parses a template in Route.Params
+func paramTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=error").Parse(text)
+}
+
+// JobParams returns the jenkins job parameters for event, route may be nil
+func (route *Route) JobParams(event *DeployEvent) (url.Values, error) {
+	if route == nil || len(route.Params) == 0 {
+		params := event.JobParams()
+		if route != nil && route.OmitRawJSON {
+			params.Del("RawJSON")
+		}
+		return params, nil
+	}
+
+	params := url.Values{}
+	for name, text := range route.Params {
+		tmpl, err := paramTemplate(name, text)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing param %s: %v", name, err)
+		}
+		var value strings.Builder
+		if err := tmpl.Execute(&value, event); err != nil {
+			return nil, fmt.Errorf("Error rendering param %s: %v", name, err)
+		}
+		params.Set(name, value.String())
+	}
+	if !route.OmitRawJSON {
+		params.Set("RawJSON", string(event.Raw))
+	}
+	return params, nil
+}
+
+// TargetName returns the name of the target route deploys to,
+// route may be nil
+func (route *Route) TargetName() string {
+	if route == nil || route.Target == "" {
+		return DefaultTarget
+	}
+	return route.Target
+}
+
+// Target types
+const (
+	TargetGitHub  = "github"
+	TargetArgo    = "argo"
+	TargetWebhook = "webhook"
+)
+
+// Target configures a deployment backend
+type Target struct {
+	// Type is one of github, argo or webhook
+	Type string `json:"type"`
+	// URL is the API base url for github and argo targets
+	// and the url deployments are posted to for webhook targets
+	URL string `json:"url,omitempty"`
+	// TokenFile holds the bearer token sent with each request
+	TokenFile string `json:"token_file,omitempty"`
+	// Timeout bounds each request to the target, e.g., 10s, default 30s
+	Timeout string `json:"timeout,omitempty"`
+
+	// Owner, Repo, Workflow and Ref select the GitHub Actions workflow to dispatch
+	Owner    string `json:"owner,omitempty"`
+	Repo     string `json:"repo,omitempty"`
+	Workflow string `json:"workflow,omitempty"`
+	Ref      string `json:"ref,omitempty"`
+	// Inputs maps workflow inputs to source, repo, ref or a job parameter
+	Inputs map[string]string `json:"inputs,omitempty"`
+	// AppID, InstallationID and PrivateKeyFile authenticate as a GitHub App
+	// installation instead of with TokenFile
+	AppID          int64  `json:"app_id,omitempty"`
+	InstallationID int64  `json:"installation_id,omitempty"`
+	PrivateKeyFile string `json:"private_key_file,omitempty"`
+
+	// SecretFile holds the key webhook requests are signed with
+	SecretFile string `json:"secret_file,omitempty"`
+	// Retries is how many times failed webhook requests are retried, default 3
+	Retries *int `json:"retries,omitempty"`
+	// MaxRetryAfter is the longest Retry-After webhook requests wait for,
+	// e.g., 30s, default 10s. Longer ones fail the deploy.
+	MaxRetryAfter string `json:"max_retry_after,omitempty"`
+
+	// Namespace and WorkflowTemplate select the Argo WorkflowTemplate to submit
+	Namespace        string `json:"namespace,omitempty"`
+	WorkflowTemplate string `json:"workflow_template,omitempty"`
+}
+
+// TimeoutDuration returns the parsed Timeout, or the default
+func (t *Target) TimeoutDuration() time.Duration {
+	if t.Timeout == "" {
+		return defaultTargetTimeout
+	}
+	timeout, _ := time.ParseDuration(t.Timeout) // checked by Validate
+	return timeout
+}
+
+// MaxRetryAfterDuration returns the parsed MaxRetryAfter, or the default
+func (t *Target) MaxRetryAfterDuration() time.Duration {
+	if t.MaxRetryAfter == "" {
+		return defaultWebhookMaxRetryAfter
+	}
+	max, _ := time.ParseDuration(t.MaxRetryAfter) // checked by Validate
+	return max
+}
+
+// Validate returns the problems with t
+func (t *Target) Validate() []string {
+	errs := make([]string, 0)
+	require := func(field, value string) {
+		if value == "" {
+			errs = append(errs, fmt.Sprintf("%s targets require %s", t.Type, field))
+		}
+	}
+	switch t.Type {
+	case TargetGitHub:
+		require("owner", t.Owner)
+		require("repo", t.Repo)
+		require("workflow", t.Workflow)
+		require("ref", t.Ref)
+		if t.AppID != 0 || t.InstallationID != 0 || t.PrivateKeyFile != "" {
+			if t.AppID == 0 || t.InstallationID == 0 || t.PrivateKeyFile == "" {
+				errs = append(errs, "github app authentication requires app_id, installation_id and private_key_file")
+			}
+			if t.TokenFile != "" {
+				errs = append(errs, "github targets use either token_file or app authentication")
+			}
+		}
+	case TargetArgo:
+		require("url", t.URL)
+		require("namespace", t.Namespace)
+		require("workflow_template", t.WorkflowTemplate)
+	case TargetWebhook:
+		require("url", t.URL)
+		require("secret_file", t.SecretFile)
+		if t.Retries != nil && *t.Retries < 0 {
+			errs = append(errs, "retries must not be negative")
+		}
+		if max, err := time.ParseDuration(t.MaxRetryAfter); t.MaxRetryAfter != "" && (err != nil || max < 0) {
+			errs = append(errs, fmt.Sprintf("invalid max_retry_after %q", t.MaxRetryAfter))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("unknown type %q", t.Type))
+	}
+	if t.URL != "" {
+		if u, err := url.Parse(t.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Sprintf("invalid url %q", t.URL))
+		}
+	}
+	if timeout, err := time.ParseDuration(t.Timeout); t.Timeout != "" && (err != nil || timeout <= 0) {
+		errs = append(errs, fmt.Sprintf("invalid timeout %q", t.Timeout))
+	}
+	return errs
+}
+
+// LoadConfig reads and validates the json config file at path
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading config: %v", err)
+	}
+	config := new(Config)
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("Error parsing config %s: %v", path, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid config %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// Validate returns an error describing every problem with c
+func (c *Config) Validate() error {
+	errs := make([]string, 0)
+	for _, nameSpace := range c.DockerhubNamespaces {
+		if err := ValidateNamespace(nameSpace); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	for _, nameSpace := range sortedKeys(c.DockerhubTokenFiles) {
+		if !c.IsValidNamespace(nameSpace) {
+			errs = append(errs, fmt.Sprintf("Token file for namespace %s which is not in dockerhub_namespaces", nameSpace))
+		}
+		if c.DockerhubTokenFiles[nameSpace] == "" {
+			errs = append(errs, fmt.Sprintf("Empty token file for namespace %s", nameSpace))
+		}
+	}
+	for _, repoPath := range c.HgmoRepos {
+		if err := ValidateHgRepoPath(repoPath); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	for i, rule := range c.HgmoRules {
+		if _, err := path.Match(rule.Repo, ""); err != nil || rule.Repo == "" {
+			errs = append(errs, fmt.Sprintf("Hgmo rule %d has invalid repo pattern %q", i, rule.Repo))
+		}
+		for _, patterns := range [][]string{rule.Users, rule.Branches, rule.Bookmarks} {
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					errs = append(errs, fmt.Sprintf("Hgmo rule %d has invalid pattern %q", i, pattern))
+				}
+			}
+		}
+		// bookmarks only restrict bookmark moves, which need a bookmark route
+		if len(rule.Bookmarks) > 0 && rule.Repo != "" && !c.hasBookmarkRoute(rule.Repo) {
+			errs = append(errs, fmt.Sprintf("Hgmo rule %d has bookmarks but no hgmo bookmark route matches %s", i, rule.Repo))
+		}
+	}
+	for i, binding := range c.TaskclusterBindings {
+		if binding == nil || binding.RoutingKey == "" || binding.Repo == "" {
+			errs = append(errs, fmt.Sprintf("Taskcluster binding %d must set routing_key and repo", i))
+			continue
+		}
+		// repos are org/name like Docker Hub repositories
+		if parts := strings.Split(binding.Repo, "/"); len(parts) != 2 || !dockerhubNameRegexp.MatchString(parts[0]) || !dockerhubNameRegexp.MatchString(parts[1]) {
+			errs = append(errs, fmt.Sprintf("Taskcluster binding %d has invalid repo %q, expected org/name", i, binding.Repo))
+		}
+	}
+	for i, sub := range c.PulseSubscriptions {
+		errs = append(errs, c.validateSubscription(i, sub)...)
+	}
+	for i, route := range c.Routes {
+		if !c.IsValidSource(route.Source) {
+			errs = append(errs, fmt.Sprintf("Route %d has unknown source %q", i, route.Source))
+		}
+		if _, err := path.Match(route.Repo, ""); err != nil || route.Repo == "" {
+			errs = append(errs, fmt.Sprintf("Route %d has invalid repo pattern %q", i, route.Repo))
+		}
+		if route.JobPath != "" && !strings.HasPrefix(route.JobPath, "/") {
+			errs = append(errs, fmt.Sprintf("Route %d job_path must start with /", i))
+		}
+		for name, text := range route.Params {
+			if _, err := paramTemplate(name, text); err != nil {
+				errs = append(errs, fmt.Sprintf("Route %d param %s: %v", i, name, err))
+			}
+		}
+		if _, ok := c.Targets[route.Target]; route.Target != "" && route.Target != DefaultTarget && !ok {
+			errs = append(errs, fmt.Sprintf("Route %d has unknown target %q", i, route.Target))
+		}
+		if (route.Bookmark != "" || route.Delay != "") && route.Source != SourceHgmo {
+			errs = append(errs, fmt.Sprintf("Route %d bookmark and delay are only supported for hgmo", i))
+		}
+		if _, err := path.Match(route.Bookmark, ""); err != nil {
+			errs = append(errs, fmt.Sprintf("Route %d has invalid bookmark pattern %q", i, route.Bookmark))
+		}
+		if delay, err := time.ParseDuration(route.Delay); route.Delay != "" && (err != nil || delay < 0) {
+			errs = append(errs, fmt.Sprintf("Route %d has invalid delay %q", i, route.Delay))
+		}
+	}
+	names := make([]string, 0, len(c.Targets))
+	for name := range c.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == DefaultTarget {
+			errs = append(errs, fmt.Sprintf("Target name %s is reserved", name))
+			continue
+		}
+		if c.Targets[name] == nil {
+			errs = append(errs, fmt.Sprintf("Target %s is empty", name))
+			continue
+		}
+		for _, err := range c.Targets[name].Validate() {
+			errs = append(errs, fmt.Sprintf("Target %s: %s", name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (c *Config) IsValidNamespace(nameSpace string) bool {
+	for _, n := range c.DockerhubNamespaces {
+		if n == nameSpace {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) IsValidHgRepo(repoPath string) bool {
+	for _, r := range c.HgmoRepos {
+		if r == repoPath {
+			return true
+		}
+	}
+	return false
+}
+
+// IsValidSource returns true for the built in sources and subscription names
+func (c *Config) IsValidSource(source string) bool {
+	switch source {
+	case SourceDockerhub, SourceHgmo, SourceTaskcluster:
+		return true
+	}
+	return c.PulseSubscription(source) != nil
+}
+
+func (c *Config) validateSubscription(i int, sub *PulseSubscription) []string {
+	if sub == nil {
+		return []string{fmt.Sprintf("Pulse subscription %d is null", i)}
+	}
+	errs := make([]string, 0)
+	switch {
+	case !validSubscriptionName.MatchString(sub.Name):
+		errs = append(errs, fmt.Sprintf("Pulse subscription %d has invalid name %q", i, sub.Name))
+	case sub.Name == SourceDockerhub || sub.Name == SourceHgmo || sub.Name == SourceTaskcluster || sub.Name == SourceAdmin:
+		errs = append(errs, fmt.Sprintf("Pulse subscription name %s is reserved", sub.Name))
+	case c.PulseSubscription(sub.Name) != sub:
+		errs = append(errs, fmt.Sprintf("Pulse subscription name %s is used more than once", sub.Name))
+	}
+	if !strings.HasPrefix(sub.Exchange, "exchange/") {
+		errs = append(errs, fmt.Sprintf("Pulse subscription %d exchange must start with exchange/", i))
+	}
+	if sub.RoutingKey == "" {
+		errs = append(errs, fmt.Sprintf("Pulse subscription %d must set routing_key", i))
+	}
+	for _, name := range sortedKeys(sub.Fields) {
+		if err := validateJSONPath(sub.Fields[name]); err != nil {
+			errs = append(errs, fmt.Sprintf("Pulse subscription %d field %s: %v", i, name, err))
+		}
+	}
+	if sub.JobPath != "" && !strings.HasPrefix(sub.JobPath, "/") {
+		errs = append(errs, fmt.Sprintf("Pulse subscription %d job_path must start with /", i))
+	}
+	if _, ok := c.Targets[sub.Target]; sub.Target != "" && sub.Target != DefaultTarget && !ok {
+		errs = append(errs, fmt.Sprintf("Pulse subscription %d has unknown target %q", i, sub.Target))
+	}
+	// without a repo field the repo is the name, which is no org/name
+	// to build /job/<source>/job/<org>/job/<name> jenkins paths from
+	if _, ok := sub.Fields["repo"]; !ok {
+		route := c.Route(sub.Name, sub.Name)
+		if route == nil {
+			route = sub.Route()
+		}
+		if route.TargetName() == DefaultTarget && route.JobPath == "" {
+			errs = append(errs, fmt.Sprintf("Pulse subscription %d must set job_path or a repo field", i))
+		}
+	}
+	return errs
+}
+
+// PulseSubscription returns the subscription called name, or nil
+func (c *Config) PulseSubscription(name string) *PulseSubscription {
+	for _, sub := range c.PulseSubscriptions {
+		if sub != nil && sub.Name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+// MatchPulseSubscription returns the first subscription consumed from queue
+// binding exchange with a pattern matching one of routingKeys, or nil
+func (c *Config) MatchPulseSubscription(queue, exchange string, routingKeys ...string) *PulseSubscription {
+	for _, sub := range c.PulseSubscriptions {
+		if sub == nil || sub.QueueName() != queue || sub.Exchange != exchange {
+			continue
+		}
+		for _, key := range routingKeys {
+			if MatchRoutingKey(sub.RoutingKey, key) {
+				return sub
+			}
+		}
+	}
+	return nil
+}
+
+// TaskclusterBinding returns the first binding matching one of routingKeys
+// and the key it matched, or nil
+func (c *Config) TaskclusterBinding(routingKeys ...string) (*TaskclusterBinding, string) {
+	for _, binding := range c.TaskclusterBindings {
+		for _, key := range routingKeys {
+			if MatchRoutingKey(binding.RoutingKey, key) {
+				return binding, key
+			}
+		}
+	}
+	return nil, ""
+}
+
+// BookmarkRoute returns the first hgmo route with a bookmark pattern
+// matching repoPath and bookmark, or nil
+func (c *Config) BookmarkRoute(repoPath, bookmark string) *Route {
+	for _, route := range c.Routes {
+		if route.Source != SourceHgmo || route.Bookmark == "" {
+			continue
+		}
+		repoMatched, _ := path.Match(route.Repo, repoPath)
+		bookmarkMatched, _ := path.Match(route.Bookmark, bookmark)
+		if repoMatched && bookmarkMatched {
+			return route
+		}
+	}
+	return nil
+}
+
+// HgmoRule returns the first hgmo rule matching repoPath, or nil
+func (c *Config) HgmoRule(repoPath string) *HgmoRule {
+	for _, rule := range c.HgmoRules {
+		if matched, _ := path.Match(rule.Repo, repoPath); matched {
+			return rule
+		}
+	}
+	return nil
+}
+
+// FollowsBookmarks returns true if a bookmark route matches repoPath
+func (c *Config) FollowsBookmarks(repoPath string) bool {
+	for _, route := range c.Routes {
+		if route.Source != SourceHgmo || route.Bookmark == "" {
+			continue
+		}
+		if matched, _ := path.Match(route.Repo, repoPath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// hasBookmarkRoute returns true if a bookmark route may match a
+// repository matched by the pattern repo
+func (c *Config) hasBookmarkRoute(repo string) bool {
+	for _, route := range c.Routes {
+		if route.Source != SourceHgmo || route.Bookmark == "" {
+			continue
+		}
+		routeMatched, _ := path.Match(route.Repo, repo)
+		ruleMatched, _ := path.Match(repo, route.Repo)
+		if routeMatched || ruleMatched {
+			return true
+		}
+	}
+	return false
+}
+
+// Route returns the first route matching source and repo, or nil.
+// Bookmark routes are only returned by BookmarkRoute.
+func (c *Config) Route(source, repo string) *Route {
+	for _, route := range c.Routes {
+		if route.Source != source || route.Bookmark != "" {
+			continue
+		}
+		if matched, _ := path.Match(route.Repo, repo); matched {
+			return route
+		}
+	}
+	return nil
+}
+
+// ConfigStore holds the active Config and replaces it atomically on reload
+type ConfigStore struct {
+	Path string
+
+	value     atomic.Value
+	mu        sync.Mutex
+	modTime   time.Time
+	listeners []func(old, new *Config)
+}
+
+// NewConfigStore returns a ConfigStore serving config
+func NewConfigStore(config *Config) *ConfigStore {
+	store := new(ConfigStore)
+	store.value.Store(config)
+	return store
+}
+
+// NewConfigStoreFromFile returns a ConfigStore which can reload the file at path
+func NewConfigStoreFromFile(path string) (*ConfigStore, error) {
+	config, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	store := NewConfigStore(config)
+	store.Path = path
+	if info, err := os.Stat(path); err == nil {
+		store.modTime = info.ModTime()
+	}
+	return store, nil
+}
+
+// Get returns the active config, which must not be modified
+func (s *ConfigStore) Get() *Config {
+	return s.value.Load().(*Config)
+}
+
+// OnChange registers fn to be called after the config is replaced
+func (s *ConfigStore) OnChange(fn func(old, new *Config)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, fn)
+}
+
+// Set validates and activates config
+func (s *ConfigStore) Set(config *Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	old := s.Get()
+	s.value.Store(config)
+	listeners := s.listeners
+	s.mu.Unlock()
+
+	// listeners may be slow, e.g., waiting for a message being processed
+	for _, fn := range listeners {
+		fn(old, config)
+	}
+	return nil
+}
+
+// Reload reads s.Path and activates it, the active config is
+// kept if the file can not be loaded
+func (s *ConfigStore) Reload() error {
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		return fmt.Errorf("Error reading config: %v", err)
+	}
+	// only retry a broken file once it changes again
+	s.mu.Lock()
+	s.modTime = info.ModTime()
+	s.mu.Unlock()
+
+	config, err := LoadConfig(s.Path)
+	if err != nil {
+		return err
+	}
+	if err := s.Set(config); err != nil {
+		return err
+	}
+	log.Printf("Reloaded config from %s", s.Path)
+	return nil
+}
+
+func (s *ConfigStore) changed() bool {
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !info.ModTime().Equal(s.modTime)
+}
+
+// Watch reloads the config on SIGHUP and whenever the modification time
+// of s.Path changes, checking every interval
+func (s *ConfigStore) Watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(interval)
+	go func() {
+		for {
+			select {
+			case <-hup:
+			case <-ticker.C:
+				if !s.changed() {
+					continue
+				}
+			}
+			if err := s.Reload(); err != nil {
+				log.Printf("Keeping previous config: %v", err)
+			}
+		}
+	}()
+}
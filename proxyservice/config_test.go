@@ -0,0 +1,236 @@
+package proxyservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, path, config string) {
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	config := &Config{
+		DockerhubNamespaces: []string{"mozilla", "a"},
+		HgmoRepos:           []string{"ci/ci-admin", "mozilla-central"},
+		HgmoRules: []*HgmoRule{
+			{Repo: "ci/*", Users: []string{"*@mozilla.com"}, Branches: []string{"default"}},
+			{Repo: "", Bookmarks: []string{"["}},
+			{Repo: "ci/ci-admin", Bookmarks: []string{"production"}},
+		},
+		TaskclusterBindings: []*TaskclusterBinding{
+			{RoutingKey: "route.index.project.myapp.#", Repo: "mozilla/myapp"},
+			{RoutingKey: "route.#"},
+			{RoutingKey: "route.#", Repo: "../admin"},
+		},
+		PulseSubscriptions: []*PulseSubscription{
+			{Name: "releases", Exchange: "exchange/releases/v1", RoutingKey: "#", Fields: map[string]string{"repo": "repo"}},
+			{Name: "hgmo", Exchange: "releases", Fields: map[string]string{"ref": "a..b"}, JobPath: "job", Target: "missing"},
+			{Name: "releases", Exchange: "exchange/releases/v2", RoutingKey: "#"},
+		},
+		Routes: []*Route{
+			{Source: "releases", Repo: "*"},
+			{Source: "dockerhub", Repo: "mozilla/*", JobPath: "/job/x"},
+			{Source: "taskcluster", Repo: "mozilla/myapp"},
+			{Source: "github", Repo: "[", JobPath: "job/x", Target: "missing"},
+			{Source: "hgmo", Repo: "ci/*", Target: "gha"},
+			{Source: "dockerhub", Repo: "mozilla/*", Bookmark: "[", Delay: "soon"},
+		},
+		Targets: map[string]*Target{
+			"gha":     {Type: TargetGitHub, Owner: "mozilla", Repo: "deploys", Workflow: "deploy.yml", Ref: "main"},
+			"argo":    {Type: TargetArgo, URL: "ftp://argo"},
+			"jenkins": {Type: TargetWebhook, URL: "https://example.com"},
+			"slow":    {Type: TargetWebhook, URL: "https://example.com", MaxRetryAfter: "later", Timeout: "0s"},
+		},
+	}
+	assert.EqualError(t, config.Validate(), "Invalid Docker Hub namespace: a; "+
+		"Invalid hg.mozilla.org repository path: mozilla-central; "+
+		`Hgmo rule 1 has invalid repo pattern ""; `+
+		`Hgmo rule 1 has invalid pattern "["; `+
+		"Hgmo rule 2 has bookmarks but no hgmo bookmark route matches ci/ci-admin; "+
+		"Taskcluster binding 1 must set routing_key and repo; "+
+		`Taskcluster binding 2 has invalid repo "../admin", expected org/name; `+
+		"Pulse subscription name hgmo is reserved; "+
+		"Pulse subscription 1 exchange must start with exchange/; "+
+		"Pulse subscription 1 must set routing_key; "+
+		`Pulse subscription 1 field ref: Invalid JSON path "a..b"; `+
+		"Pulse subscription 1 job_path must start with /; "+
+		`Pulse subscription 1 has unknown target "missing"; `+
+		"Pulse subscription name releases is used more than once; "+
+		"Pulse subscription 2 must set job_path or a repo field; "+
+		`Route 3 has unknown source "github"; `+
+		`Route 3 has invalid repo pattern "["; `+
+		"Route 3 job_path must start with /; "+
+		`Route 3 has unknown target "missing"; `+
+		"Route 5 bookmark and delay are only supported for hgmo; "+
+		`Route 5 has invalid bookmark pattern "["; `+
+		`Route 5 has invalid delay "soon"; `+
+		"Target argo: argo targets require namespace; "+
+		"Target argo: argo targets require workflow_template; "+
+		`Target argo: invalid url "ftp://argo"; `+
+		"Target name jenkins is reserved; "+
+		"Target slow: webhook targets require secret_file; "+
+		`Target slow: invalid max_retry_after "later"; `+
+		`Target slow: invalid timeout "0s"`)
+}
+
+func TestConfigRoute(t *testing.T) {
+	config := &Config{
+		Routes: []*Route{
+			{Source: "dockerhub", Repo: "mozilla/special", JobPath: "/job/special"},
+			{Source: "dockerhub", Repo: "mozilla/*", JobPath: "/job/mozilla"},
+			{Source: "hgmo", Repo: "ci/*", JobPath: "/job/ci"},
+		},
+	}
+	assert.Equal(t, "/job/special", config.Route("dockerhub", "mozilla/special").JobPath)
+	assert.Equal(t, "/job/mozilla", config.Route("dockerhub", "mozilla/other").JobPath)
+	assert.Equal(t, "/job/ci", config.Route("hgmo", "ci/ci-admin").JobPath)
+	assert.Nil(t, config.Route("hgmo", "mozilla/other"))
+}
+
+func TestConfigBookmarkRoute(t *testing.T) {
+	config := &Config{
+		Routes: []*Route{
+			{Source: "hgmo", Repo: "ci/*", Bookmark: "production", JobPath: "/job/prod"},
+			{Source: "hgmo", Repo: "ci/*", Bookmark: "staging-*", JobPath: "/job/staging"},
+			{Source: "hgmo", Repo: "ci/ci-admin", JobPath: "/job/ci-admin"},
+		},
+	}
+	assert.Equal(t, "/job/prod", config.BookmarkRoute("ci/ci-admin", "production").JobPath)
+	assert.Equal(t, "/job/staging", config.BookmarkRoute("ci/ci-admin", "staging-1").JobPath)
+	assert.Nil(t, config.BookmarkRoute("ci/ci-admin", "@"))
+	assert.Nil(t, config.BookmarkRoute("mozilla/other", "production"))
+	assert.Equal(t, "/job/ci-admin", config.Route("hgmo", "ci/ci-admin").JobPath)
+	assert.Nil(t, config.Route("hgmo", "ci/ci-configuration"))
+	assert.True(t, config.FollowsBookmarks("ci/ci-configuration"))
+
+	config.HgmoRules = []*HgmoRule{{Repo: "ci/ci-admin", Users: []string{"a"}}, {Repo: "ci/*"}}
+	assert.Equal(t, []string{"a"}, config.HgmoRule("ci/ci-admin").Users)
+	assert.Equal(t, "ci/*", config.HgmoRule("ci/other").Repo)
+	assert.Nil(t, config.HgmoRule("mozilla/other"))
+	assert.False(t, config.FollowsBookmarks("mozilla/other"))
+}
+
+func TestConfigStoreReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+
+	writeConfig(t, path, `{"dockerhub_namespaces": ["mozilla"], "hgmo_repos": ["ci/ci-admin"]}`)
+	store, err := NewConfigStoreFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var changes [][]string
+	store.OnChange(func(old, new *Config) {
+		changes = append(changes, []string{old.HgmoRepos[0], new.HgmoRepos[0]})
+	})
+
+	writeConfig(t, path, `{"dockerhub_namespaces": ["mozilla"], "hgmo_repos": ["mozilla-central"]}`)
+	assert.Error(t, store.Reload())
+	assert.Equal(t, []string{"ci/ci-admin"}, store.Get().HgmoRepos)
+
+	writeConfig(t, path, `{"dockerhub_namespaces": ["mozilla"], "hgmo_repos": ["ci/ci-configuration"]}`)
+	assert.NoError(t, store.Reload())
+	assert.Equal(t, []string{"ci/ci-configuration"}, store.Get().HgmoRepos)
+	assert.Equal(t, [][]string{{"ci/ci-admin", "ci/ci-configuration"}}, changes)
+}
+
+func TestConfigStoreSlowListener(t *testing.T) {
+	store := NewConfigStore(&Config{})
+	called, release := make(chan struct{}), make(chan struct{})
+	store.OnChange(func(old, new *Config) {
+		close(called)
+		<-release
+	})
+	go store.Set(&Config{HgmoRepos: []string{"ci/ci-admin"}})
+	<-called
+	defer close(release)
+
+	// the store is not locked while listeners run
+	done := make(chan struct{})
+	go func() {
+		store.OnChange(func(old, new *Config) {})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out registering a listener while another one runs")
+	}
+	assert.Equal(t, []string{"ci/ci-admin"}, store.Get().HgmoRepos)
+}
+
+func TestDockerHubHandlerRoute(t *testing.T) {
+	jenkins := NewFakeJenkins()
+	handler := NewDockerHubWebhookHandler(false, NewJenkinsDeployer(jenkins))
+	handler.Config = NewConfigStore(&Config{
+		DockerhubNamespaces: []string{"mozilla"},
+		Routes: []*Route{
+			{Source: "dockerhub", Repo: "mozilla/test*", JobPath: "/job/pipelines/job/testrepo"},
+		},
+	})
+
+	dataBytes, err := json.Marshal(baseDockerHubWebhookData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendRequest("POST", "http://test/dockerhub", bytes.NewReader(dataBytes), handler)
+	assert.Equal(t, []JenkinsJob{{
+		"/job/pipelines/job/testrepo",
+		url.Values{"Tag": {"v1.1.1"}},
+	}}, jenkins.Jobs)
+}
+
+func TestRouteJobParams(t *testing.T) {
+	event := testDeployEvent()
+	route := &Route{
+		Source: "dockerhub",
+		Repo:   "mozilla/*",
+		Params: map[string]string{
+			"IMAGE":   "{{.Image}}",
+			"ENV":     "prod",
+			"SERVICE": `{{index (split .Repository "/") 1}}`,
+		},
+	}
+	assert.EqualError(t, (&Config{Routes: []*Route{route}}).Validate(),
+		`Route 0 param SERVICE: template: SERVICE:1: function "split" not defined`)
+
+	route.Params["SERVICE"] = "{{.Repository}}"
+	params, err := route.JobParams(event)
+	assert.NoError(t, err)
+	assert.Equal(t, url.Values{
+		"IMAGE":   {"mozilla/testrepo:v1.1.1"},
+		"ENV":     {"prod"},
+		"SERVICE": {"mozilla/testrepo"},
+		"RawJSON": {"{}"},
+	}, params)
+
+	route.OmitRawJSON = true
+	params, err = route.JobParams(event)
+	assert.NoError(t, err)
+	assert.Equal(t, "", params.Get("RawJSON"))
+
+	route.Params = map[string]string{"MISSING": "{{.Missing}}"}
+	_, err = route.JobParams(event)
+	assert.Error(t, err)
+
+	route.Params = nil
+	params, err = route.JobParams(event)
+	assert.NoError(t, err)
+	assert.Equal(t, url.Values{"Tag": {"v1.1.1"}}, params)
+}
@@ -0,0 +1,79 @@
+package proxyservice
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DeployEvent is a validated push from any source which may be deployed.
+// Sources convert their messages into DeployEvents, and routing, auditing
+// and deployment targets only work with DeployEvents.
+type DeployEvent struct {
+	Source string `json:"source"`
+	// Repository is namespace/name for docker hub, the repo path for hgmo
+	// and the repo of the matching binding for taskcluster
+	Repository    string `json:"repository"`
+	RepositoryURL string `json:"repository_url,omitempty"`
+	// Ref is the docker tag or hg head pushed, or the taskcluster task id
+	Ref string `json:"ref"`
+	// Revision is the image digest or hg changeset, if known
+	Revision string `json:"revision,omitempty"`
+	// Bookmark is the hg bookmark which moved to Revision, if any
+	Bookmark string `json:"bookmark,omitempty"`
+	// Actor is the user who pushed Ref
+	Actor     string    `json:"actor,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	// Artifacts are artifact urls by name, e.g., of a taskcluster task
+	Artifacts map[string]string `json:"artifacts,omitempty"`
+	// ImageArtifact names the docker image in Artifacts
+	ImageArtifact string `json:"image_artifact,omitempty"`
+	// Fields are the values extracted from pulse subscription messages
+	Fields map[string]string `json:"fields,omitempty"`
+	// Raw is the source message, audit events already record it as their payload
+	Raw json.RawMessage `json:"-"`
+}
+
+// Image returns the docker image reference namespace/name:tag
+// of docker hub events, and "" for other sources
+func (e *DeployEvent) Image() string {
+	if e.Source != SourceDockerhub {
+		return ""
+	}
+	return e.Repository + ":" + e.Ref
+}
+
+// ArtifactURLs returns the urls of e.Artifacts sorted by artifact name
+func (e *DeployEvent) ArtifactURLs() []string {
+	urls := make([]string, 0, len(e.Artifacts))
+	for _, name := range sortedKeys(e.Artifacts) {
+		urls = append(urls, e.Artifacts[name])
+	}
+	return urls
+}
+
+// JobParams returns the default jenkins job parameters for e
+func (e *DeployEvent) JobParams() url.Values {
+	params := url.Values{}
+	switch e.Source {
+	case SourceDockerhub:
+		params.Set("Tag", e.Ref)
+	case SourceHgmo:
+		params.Set("HEAD_REPOSITORY", e.RepositoryURL)
+		params.Set("HEAD_REV", e.Ref)
+		if e.Bookmark != "" {
+			params.Set("HEAD_BOOKMARK", e.Bookmark)
+		}
+	case SourceTaskcluster:
+		params.Set("TASK_ID", e.Ref)
+		params.Set("ARTIFACT_URLS", strings.Join(e.ArtifactURLs(), " "))
+		params.Set("IMAGE_ARTIFACT", e.ImageArtifact)
+	default:
+		for name, value := range e.Fields {
+			params.Set(name, value)
+		}
+	}
+	params.Set("RawJSON", string(e.Raw))
+	return params
+}
@@ -0,0 +1,63 @@
+package proxyservice
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDockerHubDeployEvent(t *testing.T) {
+	data := baseDockerHubWebhookData()
+	event, err := data.DeployEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, SourceDockerhub, event.Source)
+	assert.Equal(t, "mozilla/testrepo", event.Repository)
+	assert.Equal(t, "v1.1.1", event.Ref)
+	assert.Equal(t, "trustedbuilder", event.Actor)
+	assert.Equal(t, url.Values{"Tag": {"v1.1.1"}, "RawJSON": {string(event.Raw)}}, event.JobParams())
+
+	data.PushData.Tag = "v1 1"
+	_, err = data.DeployEvent()
+	assert.EqualError(t, err, "Invalid data.PushData.Tag: v1 1")
+}
+
+func TestHgDeployEvent(t *testing.T) {
+	message := new(HgMessage)
+	if err := json.Unmarshal(loadFixture("fixtures/hgmo_changegroup.json"), message); err != nil {
+		t.Fatal(err)
+	}
+	event, err := message.DeployEvent("ci/ci-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, &DeployEvent{
+		Source:        SourceHgmo,
+		Repository:    "ci/ci-admin",
+		RepositoryURL: "https://hg.mozilla.org/ci/ci-admin",
+		Ref:           "9c9a898b351909b2e0fe8420ac9d649ded523af3",
+		Revision:      "9c9a898b351909b2e0fe8420ac9d649ded523af3",
+		Actor:         "mozilla@hocat.ca",
+		Timestamp:     time.Unix(1588273363, 0).UTC(),
+		Raw:           event.Raw,
+	}, event)
+
+	jenkins := NewFakeJenkins()
+	assert.NoError(t, Deploy(context.Background(), NewJenkinsDeployer(jenkins), &Config{}, event))
+	assert.Equal(t, []JenkinsJob{{
+		"/job/hgmo/job/ci/job/ci-admin", url.Values{
+			"HEAD_REPOSITORY": {"https://hg.mozilla.org/ci/ci-admin"},
+			"HEAD_REV":        {"9c9a898b351909b2e0fe8420ac9d649ded523af3"},
+		}}}, jenkins.Jobs)
+
+	_, err = message.DeployEvent("mozilla-central")
+	assert.EqualError(t, err, "Invalid hg.mozilla.org repository path: mozilla-central")
+
+	event.Bookmark = "production"
+	assert.Equal(t, "production", event.JobParams().Get("HEAD_BOOKMARK"))
+}
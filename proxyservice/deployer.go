@@ -0,0 +1,255 @@
+package proxyservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Deployer triggers deployments on a backend such as Jenkins
+type Deployer interface {
+	// Destination describes where Deploy sends event, e.g., a jenkins job path
+	Destination(route *Route, event *DeployEvent) string
+	// Deploy triggers a deployment of event, route may be nil
+	Deploy(ctx context.Context, route *Route, event *DeployEvent) error
+}
+
+// Deploy sends event to the target of its route in config
+func Deploy(ctx context.Context, d Deployer, config *Config, event *DeployEvent) error {
+	return d.Deploy(ctx, config.Route(event.Source, event.Repository), event)
+}
+
+// DefaultTarget is the name of the deployer configured with the --jenkins-* flags
+const DefaultTarget = "jenkins"
+
+// JenkinsDeployer triggers buildWithParameters on jenkins jobs
+type JenkinsDeployer struct {
+	Jenkins Jenkins
+}
+
+func NewJenkinsDeployer(jenkins Jenkins) *JenkinsDeployer {
+	return &JenkinsDeployer{Jenkins: jenkins}
+}
+
+// Destination returns route.JobPath, or /job/<source>/job/<org>/job/<name>
+func (j *JenkinsDeployer) Destination(route *Route, event *DeployEvent) string {
+	if route != nil && route.JobPath != "" {
+		return route.JobPath
+	}
+	parts := strings.SplitN(event.Repository, "/", 2)
+	return path.Join("/job", event.Source, "job", parts[0], "job", parts[len(parts)-1])
+}
+
+// Deploy triggers the job with the params of route, see Route.JobParams
+func (j *JenkinsDeployer) Deploy(ctx context.Context, route *Route, event *DeployEvent) error {
+	params, err := route.JobParams(event)
+	if err != nil {
+		return err
+	}
+	return j.Jenkins.TriggerJob(ctx, j.Destination(route, event), params)
+}
+
+// RouteDeployer sends each event to the target of its route
+type RouteDeployer struct {
+	Config *ConfigStore
+	// Default handles routes without a target
+	Default Deployer
+
+	mu        sync.Mutex
+	config    *Config
+	deployers map[string]Deployer
+}
+
+func NewRouteDeployer(config *ConfigStore, defaultDeployer Deployer) *RouteDeployer {
+	return &RouteDeployer{
+		Config:  config,
+		Default: defaultDeployer,
+	}
+}
+
+// deployer returns the deployer for the target of route. Deployers are
+// kept until the config is reloaded so they can cache e.g., tokens.
+func (r *RouteDeployer) deployer(route *Route) (Deployer, error) {
+	name := route.TargetName()
+	if name == DefaultTarget {
+		return r.Default, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	config := r.Config.Get()
+	if config != r.config {
+		r.config = config
+		r.deployers = make(map[string]Deployer)
+	}
+	if deployer, ok := r.deployers[name]; ok {
+		return deployer, nil
+	}
+	target, ok := config.Targets[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown target %s", name)
+	}
+	deployer, err := NewDeployer(target)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating target %s: %v", name, err)
+	}
+	r.deployers[name] = deployer
+	return deployer, nil
+}
+
+// Destination returns "" if the target of route does not exist
+func (r *RouteDeployer) Destination(route *Route, event *DeployEvent) string {
+	deployer, err := r.deployer(route)
+	if err != nil {
+		return ""
+	}
+	return deployer.Destination(route, event)
+}
+
+func (r *RouteDeployer) Deploy(ctx context.Context, route *Route, event *DeployEvent) error {
+	deployer, err := r.deployer(route)
+	if err != nil {
+		return err
+	}
+	return deployer.Deploy(ctx, route, event)
+}
+
+// NewDeployer returns the Deployer configured by target
+func NewDeployer(target *Target) (Deployer, error) {
+	switch target.Type {
+	case TargetGitHub:
+		return NewGitHubDeployer(target), nil
+	case TargetArgo:
+		return NewArgoDeployer(target), nil
+	case TargetWebhook:
+		return NewWebhookDeployer(target), nil
+	}
+	return nil, fmt.Errorf("Unknown target type %s", target.Type)
+}
+
+// defaultTargetTimeout bounds requests to targets without a timeout
+const defaultTargetTimeout = 30 * time.Second
+
+// deploymentInputs returns the first value of each param, without RawJSON
+// which is too large for workflow inputs
+func deploymentInputs(params url.Values) map[string]string {
+	inputs := make(map[string]string)
+	for key, values := range params {
+		if key == "RawJSON" || len(values) == 0 {
+			continue
+		}
+		inputs[key] = values[0]
+	}
+	return inputs
+}
+
+// bearerToken returns the token in tokenFile, or "" if tokenFile is not set
+func bearerToken(tokenFile string) (string, error) {
+	if tokenFile == "" {
+		return "", nil
+	}
+	return readSecret(tokenFile)
+}
+
+// eventValue returns the event field named source, repo, ref, revision
+// or actor, or else the job param called name, e.g., Tag or HEAD_REV
+func eventValue(event *DeployEvent, name string) string {
+	switch name {
+	case "source":
+		return event.Source
+	case "repo":
+		return event.Repository
+	case "ref":
+		return event.Ref
+	case "revision":
+		return event.Revision
+	case "actor":
+		return event.Actor
+	}
+	return event.JobParams().Get(name)
+}
+
+// postJSON posts body to url as json, with token as a bearer token if set.
+// Responses other than 2xx are returned as errors.
+func postJSON(ctx context.Context, client *http.Client, url, token string, header http.Header, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("Error marshaling request: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("Error building request: %v", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error posting to %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s returned %d: %s", url, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// DryRunDeployment is a deployment recorded by DryRunDeployer
+type DryRunDeployment struct {
+	Target      string       `json:"target"`
+	Destination string       `json:"destination"`
+	Event       *DeployEvent `json:"event"`
+}
+
+// DryRunDeployer records deployments instead of sending them
+type DryRunDeployer struct {
+	// Send lists targets which are deployed as well as recorded,
+	// e.g., jenkins when it is a fake server
+	Send map[string]bool
+
+	mu          sync.Mutex
+	Deployments []DryRunDeployment
+}
+
+// Wrap returns a Deployer recording what deployer would have done
+func (d *DryRunDeployer) Wrap(deployer Deployer) Deployer {
+	return &dryRunDeployer{Deployer: deployer, dryRun: d}
+}
+
+type dryRunDeployer struct {
+	Deployer
+	dryRun *DryRunDeployer
+}
+
+func (d *dryRunDeployer) Deploy(ctx context.Context, route *Route, event *DeployEvent) error {
+	destination := d.Destination(route, event)
+	if destination == "" {
+		return fmt.Errorf("Unknown target %s", route.TargetName())
+	}
+	d.dryRun.mu.Lock()
+	d.dryRun.Deployments = append(d.dryRun.Deployments, DryRunDeployment{
+		Target:      route.TargetName(),
+		Destination: destination,
+		Event:       event,
+	})
+	d.dryRun.mu.Unlock()
+	if d.dryRun.Send[route.TargetName()] {
+		return d.Deployer.Deploy(ctx, route, event)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package proxyservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTarget records the requests posted to it
+type fakeTarget struct {
+	server   *httptest.Server
+	status   int
+	paths    []string
+	auth     []string
+	headers  []http.Header
+	requests []map[string]interface{}
+}
+
+func newFakeTarget(status int) *fakeTarget {
+	f := &fakeTarget{status: status}
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body := make(map[string]interface{})
+		json.NewDecoder(req.Body).Decode(&body)
+		f.paths = append(f.paths, req.URL.Path)
+		f.auth = append(f.auth, req.Header.Get("Authorization"))
+		f.headers = append(f.headers, req.Header)
+		f.requests = append(f.requests, body)
+		w.WriteHeader(f.status)
+	}))
+	return f
+}
+
+func testDeployEvent() *DeployEvent {
+	return &DeployEvent{
+		Source:     SourceDockerhub,
+		Repository: "mozilla/testrepo",
+		Ref:        "v1.1.1",
+		Raw:        json.RawMessage("{}"),
+	}
+}
+
+func TestArgoDeployer(t *testing.T) {
+	fake := newFakeTarget(http.StatusOK)
+	defer fake.server.Close()
+
+	deployer := NewArgoDeployer(&Target{
+		Type:             TargetArgo,
+		URL:              fake.server.URL,
+		Namespace:        "deploys",
+		WorkflowTemplate: "testrepo",
+	})
+	assert.NoError(t, deployer.Deploy(context.Background(), nil, testDeployEvent()))
+	assert.Equal(t, []string{"/api/v1/workflows/deploys/submit"}, fake.paths)
+	assert.Equal(t, []string{""}, fake.auth)
+	assert.Equal(t, map[string]interface{}{
+		"namespace":    "deploys",
+		"resourceKind": "WorkflowTemplate",
+		"resourceName": "testrepo",
+		"submitOptions": map[string]interface{}{
+			"parameters": []interface{}{"Tag=v1.1.1"},
+		},
+	}, fake.requests[0])
+}
+
+func TestRouteDeployer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deployer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	webhook := newFakeTarget(http.StatusAccepted)
+	defer webhook.server.Close()
+
+	jenkins := NewFakeJenkins()
+	config := NewConfigStore(&Config{
+		DockerhubNamespaces: []string{"mozilla"},
+		Routes: []*Route{
+			{Source: "dockerhub", Repo: "mozilla/testrepo", Target: "forward"},
+		},
+		Targets: map[string]*Target{
+			"forward": {Type: TargetWebhook, URL: webhook.server.URL + "/deploy", SecretFile: writeTestFile(t, dir, "secret", []byte("hmackey"))},
+		},
+	})
+	events := NewMemoryEventStore(10)
+	handler := NewDockerHubWebhookHandler(false, NewRouteDeployer(config, NewJenkinsDeployer(jenkins)))
+	handler.Config = config
+	handler.Events = events
+
+	data := baseDockerHubWebhookData()
+	for _, name := range []string{"testrepo", "otherrepo"} {
+		setDockerHubRepoName(data, name)
+		dataBytes, err := json.Marshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := sendRequest("POST", "http://test/dockerhub", bytes.NewReader(dataBytes), handler)
+		assert.Equal(t, http.StatusOK, resp.Code)
+	}
+
+	assert.Equal(t, []string{"/deploy"}, webhook.paths)
+	assert.Equal(t, "mozilla/testrepo", webhook.requests[0]["repo"])
+	assert.Equal(t, "v1.1.1", webhook.requests[0]["tag"])
+	assert.Equal(t, []JenkinsJob{{
+		"/job/dockerhub/job/mozilla/job/otherrepo",
+		url.Values{"Tag": {"v1.1.1"}},
+	}}, jenkins.Jobs)
+
+	assert.Equal(t, "forward", events.events[0].Target)
+	assert.Equal(t, webhook.server.URL+"/deploy", events.events[0].Destination)
+	assert.Equal(t, DefaultTarget, events.events[1].Target)
+}
+
+func TestDryRunDeployer(t *testing.T) {
+	config := NewConfigStore(&Config{})
+	dryRun := new(DryRunDeployer)
+	deployer := dryRun.Wrap(NewRouteDeployer(config, NewJenkinsDeployer(nil)))
+
+	assert.NoError(t, deployer.Deploy(context.Background(), nil, testDeployEvent()))
+	assert.EqualError(t, deployer.Deploy(context.Background(), &Route{Target: "missing"}, testDeployEvent()),
+		"Unknown target missing")
+	assert.Equal(t, []DryRunDeployment{{
+		Target:      DefaultTarget,
+		Destination: "/job/dockerhub/job/mozilla/job/testrepo",
+		Event:       testDeployEvent(),
+	}}, dryRun.Deployments)
+
+	jenkins := NewFakeJenkins()
+	dryRun = &DryRunDeployer{Send: map[string]bool{DefaultTarget: true}}
+	deployer = dryRun.Wrap(NewRouteDeployer(config, NewJenkinsDeployer(jenkins)))
+	assert.NoError(t, deployer.Deploy(context.Background(), nil, testDeployEvent()))
+	assert.Len(t, dryRun.Deployments, 1)
+	assert.Len(t, jenkins.Jobs, 1)
+}
+
+func TestTargetTimeout(t *testing.T) {
+	argo, err := NewDeployer(&Target{Type: TargetArgo, URL: "https://argo", Timeout: "5s"})
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Second, argo.(*ArgoDeployer).Client.Timeout)
+
+	github, err := NewDeployer(&Target{Type: TargetGitHub, Timeout: "1m"})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, github.(*GitHubDeployer).Client.Timeout)
+
+	webhook, err := NewDeployer(&Target{Type: TargetWebhook, URL: "https://example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, defaultTargetTimeout, webhook.(*WebhookDeployer).Client.Timeout)
+}
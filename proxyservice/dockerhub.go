@@ -2,12 +2,14 @@ package proxyservice
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 )
 
 var DockerhubRegistry = "https://registry.hub.docker.com"
@@ -54,8 +56,38 @@ type DockerHubWebhookData struct {
 	} `json:"repository"`
 }
 
+// DeployEvent validates d and converts it into a DeployEvent
+func (d *DockerHubWebhookData) DeployEvent() (*DeployEvent, error) {
+	if !dockerhubNameRegexp.MatchString(d.Repository.Name) {
+		return nil, fmt.Errorf("Invalid data.Repository.Name: %s", d.Repository.Name)
+	}
+	if !dockerhubNameRegexp.MatchString(d.Repository.Namespace) {
+		return nil, fmt.Errorf("Invalid data.Repository.Namespace: %s", d.Repository.Namespace)
+	}
+	if !dockerhubTagRegexp.MatchString(d.PushData.Tag) {
+		return nil, fmt.Errorf("Invalid data.PushData.Tag: %s", d.PushData.Tag)
+	}
+	raw, err := json.Marshal(d)
+	if err != nil {
+		return nil, fmt.Errorf("Error marshaling data: %v", err)
+	}
+	timestamp := time.Now().UTC()
+	if d.PushData.PushedAt > 0 {
+		timestamp = time.Unix(int64(d.PushData.PushedAt), 0).UTC()
+	}
+	return &DeployEvent{
+		Source:        SourceDockerhub,
+		Repository:    d.Repository.Namespace + "/" + d.Repository.Name,
+		RepositoryURL: d.Repository.RepoURL,
+		Ref:           d.PushData.Tag,
+		Actor:         d.PushData.Pusher,
+		Timestamp:     timestamp,
+		Raw:           raw,
+	}, nil
+}
+
 // Callback calls data's callback_url
-func (d *DockerHubWebhookData) Callback(cb *CallBackData) error {
+func (d *DockerHubWebhookData) Callback(ctx context.Context, cb *CallBackData) error {
 	callbackPrefix := fmt.Sprintf("%s/u/%s/%s/hook/",
 		DockerhubRegistry, d.Repository.Namespace, d.Repository.Name)
 	if !strings.HasPrefix(d.CallbackURL, callbackPrefix) {
@@ -65,10 +97,16 @@ func (d *DockerHubWebhookData) Callback(cb *CallBackData) error {
 	if err != nil {
 		return err
 	}
-	resp, err := http.Post(d.CallbackURL, "application/json", bytes.NewReader(data))
+	req, err := http.NewRequestWithContext(ctx, "POST", d.CallbackURL, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("Error building callback request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("Error calling callback_url: %v", err)
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		return errors.New("callback_url did not return 200")
 	}
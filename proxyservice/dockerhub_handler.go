@@ -1,71 +1,211 @@
 package proxyservice
 
 import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 )
 
 type DockerHubWebhookHandler struct {
-	Jenkins                  Jenkins
-	ValidNameSpaces          map[string]bool
+	Deployer                 Deployer
+	Config                   *ConfigStore
 	DisableDockerHubCallback bool
+	// CallbackTimeout bounds the Docker Hub callback request
+	CallbackTimeout time.Duration
+	// RepoLimiter limits how often each repository can be deployed by
+	// webhooks when set, TriggerTag and Replay are not limited
+	RepoLimiter *RateLimiter
+
+	// Events records received requests when set
+	Events EventStore
 }
 
-func NewDockerHubWebhookHandler(disableDockerHubCallback bool, jenkins Jenkins, nameSpaces ...string) *DockerHubWebhookHandler {
-	validNameSpaces := make(map[string]bool)
-	for _, nameSpace := range nameSpaces {
-		validNameSpaces[nameSpace] = true
-	}
+func NewDockerHubWebhookHandler(disableDockerHubCallback bool, deployer Deployer, nameSpaces ...string) *DockerHubWebhookHandler {
 	return &DockerHubWebhookHandler{
-		Jenkins:                  jenkins,
-		ValidNameSpaces:          validNameSpaces,
+		Deployer:                 deployer,
+		Config:                   NewConfigStore(&Config{DockerhubNamespaces: nameSpaces}),
 		DisableDockerHubCallback: disableDockerHubCallback,
 	}
 }
 
-func (d *DockerHubWebhookHandler) isValidNamespace(nameSpace string) bool {
-	return d.ValidNameSpaces[nameSpace]
-}
-
 func (d *DockerHubWebhookHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if req.Method != "POST" {
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("Received dockerhub request from: %s", req.RemoteAddr)
+	clientIP := RequestClientIP(req)
+	log.Printf("Received dockerhub request from: %s", clientIP)
 
-	hookData, err := NewDockerHubWebhookDataFromRequest(req)
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Printf("Error reading request body: %v", err)
+		http.Error(w, "Internal Service Error", http.StatusInternalServerError)
+		return
+	}
+	event := NewEvent(SourceDockerhub, body)
+	event.ClientIP = clientIP
+	defer d.recordEvent(event)
+
+	hookData, err := NewDockerHubWebhookData(body)
 	if err != nil {
 		log.Printf("Error parsing request: %v", err)
+		event.Reject(fmt.Sprintf("Error unmarshaling json: %v", err))
 		http.Error(w, "Internal Service Error", http.StatusInternalServerError)
 		return
 	}
+	event.Repo = hookData.Repository.Namespace + "/" + hookData.Repository.Name
 
-	if !d.isValidNamespace(hookData.Repository.Namespace) {
+	config := d.Config.Get()
+	if !config.IsValidNamespace(hookData.Repository.Namespace) {
 		log.Printf("Invalid Namespace: %s", hookData.Repository.Namespace)
+		event.Reject(fmt.Sprintf("Invalid Namespace: %s", hookData.Repository.Namespace))
 		http.Error(w, "Invalid Namespace", http.StatusUnauthorized)
 		return
 	}
 
+	if err := checkDockerhubToken(config, req, hookData.Repository.Namespace, d.DisableDockerHubCallback); err != nil {
+		log.Printf("Token error for namespace %s: %v", hookData.Repository.Namespace, err)
+		event.Reject(fmt.Sprintf("Token error: %v", err))
+		http.Error(w, "Request could not be validated", http.StatusUnauthorized)
+		return
+	}
+
 	if !d.DisableDockerHubCallback {
-		if err := hookData.Callback(NewSuccessCallbackData()); err != nil {
+		if err := d.callback(req.Context(), hookData); err != nil {
 			log.Printf("Callback error: %v", err)
+			event.Reject(fmt.Sprintf("Callback error: %v", err))
 			http.Error(w, "Request could not be validated", http.StatusUnauthorized)
 			return
 		}
 	}
 
-	log.Printf("Triggering Jenkins Job for: %s %s with tag: %s",
+	if d.RepoLimiter != nil {
+		if ok, retryAfter := d.RepoLimiter.Allow(event.Repo); !ok {
+			log.Printf("Rate limited deploys of %s", event.Repo)
+			Metrics.Add(MetricRepoRateLimited, 1)
+			event.Reject("Rate limited")
+			tooManyRequests(w, retryAfter)
+			return
+		}
+	}
+
+	log.Printf("Deploying: %s %s with tag: %s",
 		hookData.Repository.Namespace,
 		hookData.Repository.Name,
 		hookData.PushData.Tag,
 	)
 
-	if err := TriggerDockerhubJob(d.Jenkins, hookData); err != nil {
-		log.Printf("Error triggering jenkins: %v", err)
+	deployEvent, err := hookData.DeployEvent()
+	if err == nil {
+		err = Deploy(req.Context(), event.Deployer(d.Deployer), config, deployEvent)
+	}
+	event.SetResult(err)
+	if err != nil {
+		log.Printf("Error deploying: %v", err)
 		http.Error(w, "Internal Service Error", http.StatusInternalServerError)
 		return
 	}
 	w.Write([]byte("OK"))
 }
+
+// checkDockerhubToken returns an error unless req carries the token configured
+// for nameSpace, either as /dockerhub/<token>, ?token=<token> or a bearer token.
+// Namespaces without a token file are only accepted if required is false,
+// i.e., when the Docker Hub callback validates their requests instead.
+func checkDockerhubToken(config *Config, req *http.Request, nameSpace string, required bool) error {
+	tokenFile, ok := config.DockerhubTokenFiles[nameSpace]
+	if !ok {
+		if required {
+			return errors.New("No token file for the namespace and the Docker Hub callback is disabled")
+		}
+		return nil
+	}
+	expected, err := readSecret(tokenFile)
+	if err != nil {
+		return err
+	}
+
+	token := req.URL.Query().Get("token")
+	if strings.HasPrefix(req.URL.Path, "/dockerhub/") {
+		token = strings.TrimPrefix(req.URL.Path, "/dockerhub/")
+	}
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token == "" {
+		return errors.New("Missing token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		return errors.New("Invalid token")
+	}
+	return nil
+}
+
+func (d *DockerHubWebhookHandler) callback(ctx context.Context, hookData *DockerHubWebhookData) error {
+	if d.CallbackTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.CallbackTimeout)
+		defer cancel()
+	}
+	return hookData.Callback(ctx, NewSuccessCallbackData())
+}
+
+func (d *DockerHubWebhookHandler) recordEvent(event *Event) {
+	if d.Events == nil {
+		return
+	}
+	if err := d.Events.Record(event); err != nil {
+		log.Printf("Error recording event: %v", err)
+	}
+}
+
+// trigger validates the namespace of hookData and deploys it
+// without calling back to Docker Hub
+func (d *DockerHubWebhookHandler) trigger(ctx context.Context, hookData *DockerHubWebhookData) error {
+	config := d.Config.Get()
+	if !config.IsValidNamespace(hookData.Repository.Namespace) {
+		return fmt.Errorf("Invalid Namespace: %s", hookData.Repository.Namespace)
+	}
+	log.Printf("Deploying: %s %s with tag: %s",
+		hookData.Repository.Namespace,
+		hookData.Repository.Name,
+		hookData.PushData.Tag,
+	)
+	deployEvent, err := hookData.DeployEvent()
+	if err != nil {
+		return err
+	}
+	return Deploy(ctx, d.Deployer, config, deployEvent)
+}
+
+// TriggerTag triggers the job for repo ("namespace/name") and tag
+// as if Docker Hub had sent a webhook for it
+func (d *DockerHubWebhookHandler) TriggerTag(ctx context.Context, repo, tag string) error {
+	parts := strings.Split(repo, "/")
+	if len(parts) != 2 {
+		return fmt.Errorf("Invalid repository %s, expected namespace/name", repo)
+	}
+	hookData := new(DockerHubWebhookData)
+	hookData.Repository.Namespace = parts[0]
+	hookData.Repository.Name = parts[1]
+	hookData.Repository.RepoName = repo
+	hookData.PushData.Tag = tag
+	return d.trigger(ctx, hookData)
+}
+
+// Replay triggers the job for a previously recorded dockerhub event
+func (d *DockerHubWebhookHandler) Replay(ctx context.Context, event *Event) error {
+	hookData := new(DockerHubWebhookData)
+	if err := json.Unmarshal(event.Payload, hookData); err != nil {
+		return fmt.Errorf("Error unmarshaling event %s: %v", event.ID, err)
+	}
+	return d.trigger(ctx, hookData)
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -37,7 +38,7 @@ func TestDockerHubHandler(t *testing.T) {
 	jenkins := NewFakeJenkins()
 	handler := NewDockerHubWebhookHandler(
 		false,
-		jenkins,
+		NewJenkinsDeployer(jenkins),
 		"mozilla",
 	)
 
@@ -140,6 +141,63 @@ func baseDockerHubWebhookData() *DockerHubWebhookData {
 	if err != nil {
 		panic(err)
 	}
+	setDockerHubRepoName(data, data.Repository.Name)
 
 	return data
 }
+
+// setDockerHubRepoName renames the repository of data, which calls back to
+// the fake Docker Hub
+func setDockerHubRepoName(data *DockerHubWebhookData, name string) {
+	data.Repository.Name = name
+	data.Repository.RepoName = data.Repository.Namespace + "/" + name
+	data.CallbackURL = fmt.Sprintf("%s/u/%s/hook/2020202020/", fakeDockerHub.URL, data.Repository.RepoName)
+}
+
+func TestDockerHubHandlerToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerhub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jenkins := NewFakeJenkins()
+	handler := NewDockerHubWebhookHandler(true, NewJenkinsDeployer(jenkins))
+	handler.Config = NewConfigStore(&Config{
+		DockerhubNamespaces: []string{"mozilla", "mozilla-services"},
+		DockerhubTokenFiles: map[string]string{"mozilla": writeTestFile(t, dir, "token", []byte("s3cret\n"))},
+	})
+
+	data := baseDockerHubWebhookData()
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for url, status := range map[string]int{
+		"http://test/dockerhub":              http.StatusUnauthorized,
+		"http://test/dockerhub/wrong":        http.StatusUnauthorized,
+		"http://test/dockerhub?token=s3cre":  http.StatusUnauthorized,
+		"http://test/dockerhub/s3cret":       http.StatusOK,
+		"http://test/dockerhub?token=s3cret": http.StatusOK,
+	} {
+		resp := sendRequest("POST", url, bytes.NewReader(dataBytes), handler)
+		assert.Equal(t, status, resp.Code, url)
+	}
+	assert.Len(t, jenkins.Jobs, 2)
+
+	// namespaces without a token file are rejected while the callback is disabled
+	events := NewMemoryEventStore(10)
+	handler.Events = events
+	data.Repository.Namespace = "mozilla-services"
+	dataBytes, err = json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := sendRequest("POST", "http://test/dockerhub", bytes.NewReader(dataBytes), handler)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.Len(t, jenkins.Jobs, 2)
+	if assert.Len(t, events.events, 1) {
+		assert.Equal(t, OutcomeRejected, events.events[0].Outcome)
+		assert.Contains(t, events.events[0].Reason, "No token file for the namespace")
+	}
+}
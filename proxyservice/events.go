@@ -0,0 +1,289 @@
+package proxyservice
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+const (
+	SourceDockerhub   = "dockerhub"
+	SourceHgmo        = "hgmo"
+	SourceTaskcluster = "taskcluster"
+	// SourceAdmin events are triggers and replays through the admin endpoints
+	SourceAdmin = "admin"
+)
+
+// Event outcomes
+const (
+	OutcomeTriggered = "triggered"
+	OutcomeRejected  = "rejected"
+	OutcomeFailed    = "failed"
+	OutcomeIgnored   = "ignored"
+	// OutcomeScheduled events are deployed after the delay of their route
+	OutcomeScheduled = "scheduled"
+)
+
+// ErrEventNotFound is returned by EventStore.Get for unknown event ids
+var ErrEventNotFound = errors.New("event not found")
+
+// Event is a webhook request or pulse message received by the proxy
+// along with what the proxy decided to do about it
+type Event struct {
+	ID         string          `json:"id"`
+	Source     string          `json:"source"`
+	RoutingKey string          `json:"routing_key,omitempty"`
+	ClientIP   string          `json:"client_ip,omitempty"`
+	ReceivedAt time.Time       `json:"received_at"`
+	Payload    json.RawMessage `json:"payload"`
+
+	Repo    string `json:"repo,omitempty"`
+	Outcome string `json:"outcome,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	// Deploy is the event the payload was converted into
+	Deploy      *DeployEvent `json:"deploy,omitempty"`
+	Target      string       `json:"target,omitempty"`
+	Destination string       `json:"destination,omitempty"`
+	Response    string       `json:"response,omitempty"`
+	// Actor is the admin principal of SourceAdmin events
+	Actor string `json:"actor,omitempty"`
+}
+
+// NewEvent returns a new *Event with a random ID
+// payloads which are not valid json are stored as a json string
+func NewEvent(source string, payload []byte) *Event {
+	if !json.Valid(payload) {
+		payload, _ = json.Marshal(string(payload))
+	}
+	return &Event{
+		ID:         uuid.New(),
+		Source:     source,
+		ReceivedAt: time.Now().UTC(),
+		Payload:    json.RawMessage(payload),
+	}
+}
+
+// Reject marks the event as rejected for reason
+func (e *Event) Reject(reason string) {
+	e.Outcome = OutcomeRejected
+	e.Reason = reason
+}
+
+// SetResult sets the outcome of the event from the result of triggering it.
+// Errors returned before a deployment was sent to its target are rejections.
+func (e *Event) SetResult(err error) {
+	switch {
+	case err != nil && e.Destination == "":
+		e.Reject(err.Error())
+	case err != nil:
+		e.Outcome = OutcomeFailed
+		e.Reason = err.Error()
+	case e.Destination == "":
+		e.Outcome = OutcomeIgnored
+	default:
+		e.Outcome = OutcomeTriggered
+	}
+}
+
+// Deployer returns d wrapped so that the deployed event and
+// the response of its target are recorded in e
+func (e *Event) Deployer(d Deployer) Deployer {
+	return &auditDeployer{Deployer: d, event: e}
+}
+
+type auditDeployer struct {
+	Deployer
+	event *Event
+}
+
+func (a *auditDeployer) Deploy(ctx context.Context, route *Route, event *DeployEvent) error {
+	a.event.Deploy = event
+	a.event.Target = route.TargetName()
+	a.event.Destination = a.Destination(route, event)
+	err := a.Deployer.Deploy(ctx, route, event)
+	if err != nil {
+		a.event.Response = err.Error()
+	} else {
+		a.event.Response = "OK"
+	}
+	return err
+}
+
+// EventFilter selects events in EventStore.Query
+// zero values match all events
+type EventFilter struct {
+	Repo    string
+	Outcome string
+	Since   time.Time
+	Until   time.Time
+}
+
+func (f *EventFilter) Match(e *Event) bool {
+	if f.Repo != "" && f.Repo != e.Repo {
+		return false
+	}
+	if f.Outcome != "" && f.Outcome != e.Outcome {
+		return false
+	}
+	if !f.Since.IsZero() && e.ReceivedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.ReceivedAt.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// EventStore records received events so they can be audited and replayed later
+type EventStore interface {
+	Record(event *Event) error
+	Get(id string) (*Event, error)
+	Query(filter *EventFilter) ([]*Event, error)
+}
+
+// MemoryEventStore keeps the most recent events in memory
+type MemoryEventStore struct {
+	mu     sync.Mutex
+	size   int
+	events []*Event
+}
+
+// NewMemoryEventStore returns a MemoryEventStore holding at most size events
+func NewMemoryEventStore(size int) *MemoryEventStore {
+	return &MemoryEventStore{
+		size: size,
+	}
+}
+
+func (s *MemoryEventStore) Record(event *Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	if len(s.events) > s.size {
+		s.events = s.events[len(s.events)-s.size:]
+	}
+	return nil
+}
+
+func (s *MemoryEventStore) Get(id string) (*Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, event := range s.events {
+		if event.ID == id {
+			return event, nil
+		}
+	}
+	return nil, ErrEventNotFound
+}
+
+func (s *MemoryEventStore) Query(filter *EventFilter) ([]*Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := make([]*Event, 0)
+	for _, event := range s.events {
+		if filter.Match(event) {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// FileEventStore appends events as json lines to a file
+type FileEventStore struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// NewFileEventStore opens or creates the audit log at path
+func NewFileEventStore(path string) (*FileEventStore, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening audit log: %v", err)
+	}
+	return &FileEventStore{
+		path: path,
+		file: file,
+	}, nil
+}
+
+func (s *FileEventStore) Record(event *Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("Error marshaling event: %v", err)
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(line); err != nil {
+		return fmt.Errorf("Error writing audit log: %v", err)
+	}
+	return nil
+}
+
+// each calls fn for every event in the log, oldest first, until fn returns false.
+// It holds the mutex so that it never reads a line Record is still writing.
+func (s *FileEventStore) each(fn func(*Event) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, err := os.Open(s.path)
+	if err != nil {
+		return fmt.Errorf("Error opening audit log: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		event := new(Event)
+		if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+			return fmt.Errorf("Error parsing audit log: %v", err)
+		}
+		if !fn(event) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *FileEventStore) Get(id string) (*Event, error) {
+	var found *Event
+	err := s.each(func(event *Event) bool {
+		if event.ID == id {
+			found = event
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, ErrEventNotFound
+	}
+	return found, nil
+}
+
+func (s *FileEventStore) Query(filter *EventFilter) ([]*Event, error) {
+	events := make([]*Event, 0)
+	err := s.each(func(event *Event) bool {
+		if filter.Match(event) {
+			events = append(events, event)
+		}
+		return true
+	})
+	return events, err
+}
+
+// Close closes the audit log
+func (s *FileEventStore) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,104 @@
+package proxyservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileEventStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewFileEventStore(filepath.Join(dir, "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	base := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	for i, repo := range []string{"mozilla/a", "mozilla/b", "mozilla/a"} {
+		event := NewEvent(SourceDockerhub, []byte(`{"tag":"v1"}`))
+		event.ReceivedAt = base.Add(time.Duration(i) * time.Hour)
+		event.Repo = repo
+		event.SetResult(nil)
+		if i == 2 {
+			event.Reject("Invalid Namespace")
+		}
+		assert.NoError(t, store.Record(event))
+	}
+	assert.NoError(t, store.Record(NewEvent(SourceHgmo, []byte("not json"))))
+
+	events, err := store.Query(&EventFilter{Repo: "mozilla/a"})
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+
+	events, err = store.Query(&EventFilter{Repo: "mozilla/a", Outcome: OutcomeRejected})
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, "Invalid Namespace", events[0].Reason)
+
+	events, err = store.Query(&EventFilter{Since: base.Add(time.Hour), Until: base.Add(2 * time.Hour)})
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, "mozilla/b", events[0].Repo)
+
+	event, err := store.Get(events[0].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, json.RawMessage(`{"tag":"v1"}`), event.Payload)
+
+	_, err = store.Get("unknown")
+	assert.Equal(t, ErrEventNotFound, err)
+}
+
+func TestDockerHubHandlerAudit(t *testing.T) {
+	jenkins := NewFakeJenkins()
+	events := NewMemoryEventStore(10)
+	handler := NewDockerHubWebhookHandler(false, NewJenkinsDeployer(jenkins), "mozilla")
+	handler.Events = events
+
+	data := baseDockerHubWebhookData()
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendRequest("POST", "http://test/dockerhub", bytes.NewReader(dataBytes), handler)
+
+	data.Repository.Namespace = "invalidddd"
+	dataBytes, err = json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendRequest("POST", "http://test/dockerhub", bytes.NewReader(dataBytes), handler)
+	sendRequest("POST", "http://test/dockerhub", strings.NewReader(`{"invalid"`), handler)
+
+	assert.Len(t, events.events, 3)
+
+	triggered := events.events[0]
+	assert.Equal(t, OutcomeTriggered, triggered.Outcome)
+	assert.Equal(t, "mozilla/testrepo", triggered.Repo)
+	assert.Equal(t, "/job/dockerhub/job/mozilla/job/testrepo", triggered.Destination)
+	assert.Equal(t, "v1.1.1", triggered.Deploy.Ref)
+	assert.Equal(t, "trustedbuilder", triggered.Deploy.Actor)
+	assert.Equal(t, "OK", triggered.Response)
+
+	rejected := events.events[1]
+	assert.Equal(t, OutcomeRejected, rejected.Outcome)
+	assert.Equal(t, "Invalid Namespace: invalidddd", rejected.Reason)
+	assert.Equal(t, "", rejected.Destination)
+
+	invalid := events.events[2]
+	assert.Equal(t, OutcomeRejected, invalid.Outcome)
+	assert.Equal(t, json.RawMessage(`"{\"invalid\""`), invalid.Payload)
+	assert.Nil(t, invalid.Deploy)
+}
@@ -0,0 +1,108 @@
+package proxyservice
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// GitHubAPI is the default GitHub API base url
+const GitHubAPI = "https://api.github.com"
+
+// gitHubAPIVersion is the REST API version requests are made against
+// https://docs.github.com/en/rest/about-the-rest-api/api-versions
+const gitHubAPIVersion = "2022-11-28"
+
+// gitHubHeader returns the headers the GitHub REST API expects
+func gitHubHeader() http.Header {
+	return http.Header{
+		"Accept":               {"application/vnd.github+json"},
+		"X-Github-Api-Version": {gitHubAPIVersion},
+	}
+}
+
+// GitHubDeployer dispatches a GitHub Actions workflow_dispatch event
+// https://docs.github.com/en/rest/actions/workflows#create-a-workflow-dispatch-event
+type GitHubDeployer struct {
+	BaseURL  string
+	Owner    string
+	Repo     string
+	Workflow string
+	Ref      string
+	// Inputs maps workflow inputs to event values, see eventValue.
+	// All params except RawJSON are sent when empty.
+	Inputs map[string]string
+
+	// App mints installation tokens when set, otherwise TokenFile is used
+	App       *GitHubAppTokenSource
+	TokenFile string
+	Client    *http.Client
+}
+
+func NewGitHubDeployer(target *Target) *GitHubDeployer {
+	baseURL := target.URL
+	if baseURL == "" {
+		baseURL = GitHubAPI
+	}
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	client := &http.Client{Timeout: target.TimeoutDuration()}
+	g := &GitHubDeployer{
+		BaseURL:   baseURL,
+		Owner:     target.Owner,
+		Repo:      target.Repo,
+		Workflow:  target.Workflow,
+		Ref:       target.Ref,
+		Inputs:    target.Inputs,
+		TokenFile: target.TokenFile,
+		Client:    client,
+	}
+	if target.AppID != 0 {
+		g.App = &GitHubAppTokenSource{
+			BaseURL:        baseURL,
+			AppID:          target.AppID,
+			InstallationID: target.InstallationID,
+			PrivateKeyFile: target.PrivateKeyFile,
+			Client:         client,
+		}
+	}
+	return g
+}
+
+// Destination returns the workflow dispatch url
+func (g *GitHubDeployer) Destination(route *Route, event *DeployEvent) string {
+	return fmt.Sprintf("%s/repos/%s/%s/actions/workflows/%s/dispatches",
+		g.BaseURL, url.PathEscape(g.Owner), url.PathEscape(g.Repo), url.PathEscape(g.Workflow))
+}
+
+func (g *GitHubDeployer) token(ctx context.Context) (string, error) {
+	if g.App != nil {
+		return g.App.Token(ctx)
+	}
+	return bearerToken(g.TokenFile)
+}
+
+// Deploy dispatches the workflow with inputs taken from event
+func (g *GitHubDeployer) Deploy(ctx context.Context, route *Route, event *DeployEvent) error {
+	inputs := deploymentInputs(event.JobParams())
+	if len(g.Inputs) > 0 {
+		inputs = make(map[string]string)
+		for input, value := range g.Inputs {
+			inputs[input] = eventValue(event, value)
+		}
+	}
+	body := struct {
+		Ref    string            `json:"ref"`
+		Inputs map[string]string `json:"inputs"`
+	}{
+		Ref:    g.Ref,
+		Inputs: inputs,
+	}
+
+	token, err := g.token(ctx)
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, g.Client, g.Destination(route, event), token, gitHubHeader(), body)
+}
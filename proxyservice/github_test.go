@@ -0,0 +1,203 @@
+package proxyservice
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeGitHub serves installation tokens for app 1234 and records workflow dispatches
+type fakeGitHub struct {
+	server     *httptest.Server
+	key        *rsa.PrivateKey
+	expiresIn  time.Duration
+	minted     int
+	auth       []string
+	dispatches []map[string]interface{}
+}
+
+func newFakeGitHub(key *rsa.PrivateKey) *fakeGitHub {
+	f := &fakeGitHub{key: key, expiresIn: time.Hour}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/app/installations/42/access_tokens", func(w http.ResponseWriter, req *http.Request) {
+		if err := checkGitHubHeaders(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := f.verifyJWT(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		f.minted++
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token": "ghs_%d", "expires_at": "%s"}`,
+			f.minted, time.Now().Add(f.expiresIn).UTC().Format(time.RFC3339))
+	})
+	mux.HandleFunc("/repos/mozilla/deploys/actions/workflows/deploy.yml/dispatches", func(w http.ResponseWriter, req *http.Request) {
+		if err := checkGitHubHeaders(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body := make(map[string]interface{})
+		json.NewDecoder(req.Body).Decode(&body)
+		f.auth = append(f.auth, req.Header.Get("Authorization"))
+		f.dispatches = append(f.dispatches, body)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	f.server = httptest.NewServer(mux)
+	return f
+}
+
+// checkGitHubHeaders returns an error if req lacks the media type and
+// API version headers of the GitHub REST API
+func checkGitHubHeaders(req *http.Request) error {
+	if accept := req.Header.Get("Accept"); accept != "application/vnd.github+json" {
+		return fmt.Errorf("unexpected Accept %q", accept)
+	}
+	if version := req.Header.Get("X-GitHub-Api-Version"); version != "2022-11-28" {
+		return fmt.Errorf("unexpected X-GitHub-Api-Version %q", version)
+	}
+	return nil
+}
+
+func (f *fakeGitHub) verifyJWT(jwt string) error {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed jwt")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&f.key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		return err
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+	var payload struct {
+		Iss int64 `json:"iss"`
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(claims, &payload); err != nil {
+		return err
+	}
+	if payload.Iss != 1234 || time.Unix(payload.Exp, 0).Before(time.Now()) {
+		return fmt.Errorf("invalid claims %s", claims)
+	}
+	return nil
+}
+
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGitHubDeployer(t *testing.T) {
+	fake := newFakeTarget(http.StatusNoContent)
+	defer fake.server.Close()
+
+	dir, err := ioutil.TempDir("", "github")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	deployer := NewGitHubDeployer(&Target{
+		Type:      TargetGitHub,
+		URL:       fake.server.URL,
+		TokenFile: writeTestFile(t, dir, "token", []byte("ghtoken\n")),
+		Owner:     "mozilla",
+		Repo:      "deploys",
+		Workflow:  "deploy.yml",
+		Ref:       "main",
+	})
+	assert.NoError(t, deployer.Deploy(context.Background(), nil, testDeployEvent()))
+	assert.Equal(t, []string{"/repos/mozilla/deploys/actions/workflows/deploy.yml/dispatches"}, fake.paths)
+	assert.Equal(t, []string{"Bearer ghtoken"}, fake.auth)
+	assert.NoError(t, checkGitHubHeaders(&http.Request{Header: fake.headers[0]}))
+	assert.Equal(t, map[string]interface{}{
+		"ref":    "main",
+		"inputs": map[string]interface{}{"Tag": "v1.1.1"},
+	}, fake.requests[0])
+
+	fake.status = http.StatusUnprocessableEntity
+	assert.Error(t, deployer.Deploy(context.Background(), nil, testDeployEvent()))
+}
+
+func TestGitHubAppDeployer(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := newFakeGitHub(key)
+	defer fake.server.Close()
+
+	dir, err := ioutil.TempDir("", "github")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	deployer := NewGitHubDeployer(&Target{
+		Type:           TargetGitHub,
+		URL:            fake.server.URL,
+		Owner:          "mozilla",
+		Repo:           "deploys",
+		Workflow:       "deploy.yml",
+		Ref:            "main",
+		Inputs:         map[string]string{"image": "repo", "tag": "ref"},
+		AppID:          1234,
+		InstallationID: 42,
+		PrivateKeyFile: writeTestFile(t, dir, "app.pem", keyPEM),
+	})
+
+	// tokens are reused until they are about to expire
+	assert.NoError(t, deployer.Deploy(context.Background(), nil, testDeployEvent()))
+	assert.NoError(t, deployer.Deploy(context.Background(), nil, testDeployEvent()))
+	fake.expiresIn = time.Minute
+	deployer.App.expires = time.Now()
+	assert.NoError(t, deployer.Deploy(context.Background(), nil, testDeployEvent()))
+	assert.NoError(t, deployer.Deploy(context.Background(), nil, testDeployEvent()))
+
+	assert.Equal(t, 3, fake.minted)
+	assert.Equal(t, []string{"Bearer ghs_1", "Bearer ghs_1", "Bearer ghs_2", "Bearer ghs_3"}, fake.auth)
+	assert.Equal(t, map[string]interface{}{
+		"ref":    "main",
+		"inputs": map[string]interface{}{"image": "mozilla/testrepo", "tag": "v1.1.1"},
+	}, fake.dispatches[0])
+
+	// the app must sign with the right key
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(otherKey)})
+	writeTestFile(t, dir, "app.pem", otherPEM)
+	deployer.App.expires = time.Now()
+	assert.EqualError(t, deployer.Deploy(context.Background(), nil, testDeployEvent()),
+		fmt.Sprintf("GitHub returned 401 for %s/app/installations/42/access_tokens, expected 201", fake.server.URL))
+}
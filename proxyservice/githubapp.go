@@ -0,0 +1,123 @@
+package proxyservice
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// githubTokenMargin is how long before expiry installation tokens are refreshed
+const githubTokenMargin = 5 * time.Minute
+
+// GitHubAppTokenSource mints GitHub App installation tokens and caches
+// them until shortly before they expire
+// https://docs.github.com/en/apps/creating-github-apps/authenticating-with-a-github-app/authenticating-as-a-github-app-installation
+type GitHubAppTokenSource struct {
+	BaseURL        string
+	AppID          int64
+	InstallationID int64
+	// PrivateKeyFile is re-read for every new token so it can be rotated
+	PrivateKeyFile string
+	Client         *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// Token returns a cached installation token or mints a new one
+func (s *GitHubAppTokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Now().Add(githubTokenMargin).Before(s.expires) {
+		return s.token, nil
+	}
+
+	jwt, err := s.appJWT(time.Now())
+	if err != nil {
+		return "", err
+	}
+	url := fmt.Sprintf("%s/app/installations/%d/access_tokens", s.BaseURL, s.InstallationID)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	if err != nil {
+		return "", fmt.Errorf("Error building installation token request: %v", err)
+	}
+	req.Header = gitHubHeader()
+	req.Header.Set("Authorization", "Bearer "+jwt)
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Error requesting installation token: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("GitHub returned %d for %s, expected 201", resp.StatusCode, url)
+	}
+	var token struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("Error decoding installation token: %v", err)
+	}
+	s.token = token.Token
+	s.expires = token.ExpiresAt
+	return s.token, nil
+}
+
+// appJWT returns a JWT authenticating as the app, signed with its private key
+func (s *GitHubAppTokenSource) appJWT(now time.Time) (string, error) {
+	key, err := readRSAPrivateKey(s.PrivateKeyFile)
+	if err != nil {
+		return "", err
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		// backdated to allow for clock drift
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": s.AppID,
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("Error signing app JWT: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// readRSAPrivateKey reads a PEM encoded PKCS1 or PKCS8 RSA private key
+func readRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading private key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data in private key %s", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing private key %s: %v", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Private key %s is not an RSA key", path)
+	}
+	return rsaKey, nil
+}
@@ -2,6 +2,7 @@ package proxyservice
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"io/ioutil"
 	"log"
@@ -22,7 +23,7 @@ func NewFakeJenkins() *FakeJenkins {
 	return &FakeJenkins{}
 }
 
-func (j *FakeJenkins) TriggerJob(path string, params url.Values) error {
+func (j *FakeJenkins) TriggerJob(ctx context.Context, path string, params url.Values) error {
 	params.Del("RawJSON")
 	j.Jobs = append(j.Jobs, JenkinsJob{path, params})
 	return nil
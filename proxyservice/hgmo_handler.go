@@ -1,15 +1,15 @@
 package proxyservice
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"regexp"
 	"strings"
-
-	"github.com/streadway/amqp"
-	"github.com/taskcluster/pulse-go/pulse"
+	"time"
 )
 
 // https://mozilla-version-control-tools.readthedocs.io/en/latest/hgmo/notifications.html#pulse-notifications
@@ -19,16 +19,50 @@ type HgMessage struct {
 }
 
 type ChangegroupMessage struct {
-	RepoUrl       string   `json:"repo_url"`
-	Heads         []string `json:"heads"`
-	PushlogPushes []struct {
-		PushId          int    `json:"pushid"`
-		User            string `json:"user"`
-		Time            int    `json:"time"`
-		PushJsonUrl     string `json:"push_json_url"`
-		PushFullJsonUrl string `json:"push_full_json_url"`
-	} `json:"pushlog_pushes"`
-	Source string `json:"Source"`
+	RepoUrl       string            `json:"repo_url"`
+	Heads         []string          `json:"heads"`
+	PushlogPushes []ChangegroupPush `json:"pushlog_pushes"`
+	Source        string            `json:"Source"`
+}
+
+type ChangegroupPush struct {
+	PushId          int    `json:"pushid"`
+	User            string `json:"user"`
+	Time            int    `json:"time"`
+	PushJsonUrl     string `json:"push_json_url"`
+	PushFullJsonUrl string `json:"push_full_json_url"`
+}
+
+// PushkeyMessage is sent when a pushkey namespace such as bookmarks changes
+type PushkeyMessage struct {
+	RepoUrl   string `json:"repo_url"`
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+	Old       string `json:"old"`
+	New       string `json:"new"`
+	// Ret is 0 if the change failed
+	Ret int `json:"ret"`
+}
+
+// ObsoleteMessage is sent when obsolescence markers are pushed
+type ObsoleteMessage struct {
+	RepoUrl string           `json:"repo_url"`
+	Markers []ObsoleteMarker `json:"markers"`
+}
+
+type ObsoleteMarker struct {
+	Precursor  ObsoleteChangeset   `json:"precursor"`
+	Successors []ObsoleteChangeset `json:"successors"`
+	User       string              `json:"user"`
+	Time       float64             `json:"time"`
+}
+
+type ObsoleteChangeset struct {
+	Node string `json:"node"`
+	Desc string `json:"desc"`
+	// Push is nil for changesets which are not in the repository
+	Push    *ChangegroupPush `json:"push"`
+	Visible *bool            `json:"visible"`
 }
 
 func (msg *HgMessage) UnmarshalJSON(b []byte) error {
@@ -44,144 +78,511 @@ func (msg *HgMessage) UnmarshalJSON(b []byte) error {
 		return err
 	}
 	msg.Type = raw.Payload.Type
-	if msg.Type == "changegroup.1" {
+	switch msg.Type {
+	case "changegroup.1":
 		var data ChangegroupMessage
 		if err := json.Unmarshal(raw.Payload.Data, &data); err != nil {
 			return err
 		}
 		msg.Data = data
-		return nil
+	case "pushkey.1":
+		var data PushkeyMessage
+		if err := json.Unmarshal(raw.Payload.Data, &data); err != nil {
+			return err
+		}
+		msg.Data = data
+	case "obsolete.1":
+		var data ObsoleteMessage
+		if err := json.Unmarshal(raw.Payload.Data, &data); err != nil {
+			return err
+		}
+		msg.Data = data
+	default:
+		return fmt.Errorf("Unknown hg message type %s", msg.Type)
+	}
+	return nil
+}
+
+var hgNodeRegexp = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// DefaultHgBaseURL is the hg server pulse messages are verified against
+const DefaultHgBaseURL = "https://hg.mozilla.org"
+
+// hgRepoURL returns the url of repoPath on the hg server at baseURL
+func hgRepoURL(baseURL, repoPath string) string {
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(baseURL, "/"), repoPath)
+}
+
+// DeployEvent converts a changegroup message for a push to repoPath into a DeployEvent
+func (msg *HgMessage) DeployEvent(repoPath string) (*DeployEvent, error) {
+	data, ok := msg.Data.(ChangegroupMessage)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported hg message type %s", msg.Type)
+	}
+	if err := ValidateHgRepoPath(repoPath); err != nil {
+		return nil, err
+	}
+	if len(data.Heads) != 1 {
+		return nil, fmt.Errorf("Message has %d heads, only 1 supported", len(data.Heads))
+	}
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("Error marshaling data: %v", err)
+	}
+	event := &DeployEvent{
+		Source:        SourceHgmo,
+		Repository:    repoPath,
+		RepositoryURL: data.RepoUrl,
+		Ref:           data.Heads[0],
+		Revision:      data.Heads[0],
+		Timestamp:     time.Now().UTC(),
+		Raw:           raw,
+	}
+	if len(data.PushlogPushes) > 0 {
+		event.Actor = data.PushlogPushes[0].User
+		event.Timestamp = time.Unix(int64(data.PushlogPushes[0].Time), 0).UTC()
+	}
+	return event, nil
+}
+
+// fetchPushJson requests a json-pushes url and parses its response
+func fetchPushJson(ctx context.Context, pushJsonUrl string) (*PushJson, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", pushJsonUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error building push_json_url request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error calling push_json_url %s: %v", pushJsonUrl, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("push_json_url %s did not return 200", pushJsonUrl)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading push_json_url response body: %v", err)
+	}
+	pushJson := new(PushJson)
+	if err := json.Unmarshal(body, pushJson); err != nil {
+		return nil, fmt.Errorf("Error parsing push_json_url response body: %v %s", err, body)
 	}
-	return fmt.Errorf("Unknown hg message type %s", msg.Type)
+	return pushJson, nil
 }
 
 type PushJson struct {
-	Lastpushid int `json:"lastpushid"`
-	Pushes     map[int]struct {
-		Changesets []string `json:"changesets"`
-		Date       int      `json:"date"`
-		User       string   `json:"user"`
-	} `json:"pushes"`
+	Lastpushid int          `json:"lastpushid"`
+	Pushes     map[int]Push `json:"pushes"`
+}
+
+// Push is a push in a json-pushes response
+type Push struct {
+	Changesets []PushChangeset `json:"changesets"`
+	Date       int             `json:"date"`
+	User       string          `json:"user"`
+}
+
+// PushChangeset is a changeset of a push. json-pushes only
+// lists changeset nodes unless full=1 is requested.
+type PushChangeset struct {
+	Node   string   `json:"node"`
+	Branch string   `json:"branch,omitempty"`
+	Author string   `json:"author,omitempty"`
+	Desc   string   `json:"desc,omitempty"`
+	Tags   []string `json:"tags,omitempty"`
+}
+
+func (c *PushChangeset) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		*c = PushChangeset{}
+		return json.Unmarshal(b, &c.Node)
+	}
+	type plain PushChangeset
+	return json.Unmarshal(b, (*plain)(c))
+}
+
+// Changeset returns the changeset node of p, or nil
+func (p *Push) Changeset(node string) *PushChangeset {
+	for i := range p.Changesets {
+		if p.Changesets[i].Node == node {
+			return &p.Changesets[i]
+		}
+	}
+	return nil
 }
 
-func (msg *ChangegroupMessage) VerifyMessage(repoPath string) error {
-	repoUrl := fmt.Sprintf("https://hg.mozilla.org/%s", repoPath)
+// VerifyMessage checks msg against the pushlog of repoPath on the hg
+// server at baseURL and returns the push of its head
+func (msg *ChangegroupMessage) VerifyMessage(ctx context.Context, baseURL, repoPath string) (*Push, error) {
+	repoUrl := hgRepoURL(baseURL, repoPath)
 	if msg.RepoUrl != repoUrl {
-		return fmt.Errorf("Message %v has repoUrl %s which doesn't match routing key %s", msg, msg.RepoUrl, repoPath)
+		return nil, fmt.Errorf("Message %v has repoUrl %s which doesn't match routing key %s", msg, msg.RepoUrl, repoPath)
 	}
 	if len(msg.Heads) != 1 {
-		return fmt.Errorf("Message %v has %d heads, only 1 supported", msg, len(msg.Heads))
+		return nil, fmt.Errorf("Message %v has %d heads, only 1 supported", msg, len(msg.Heads))
 	}
 	if len(msg.PushlogPushes) != 1 {
-		return fmt.Errorf("Message %v has %d pushlog pushes, only 1 supported", msg, len(msg.PushlogPushes))
+		return nil, fmt.Errorf("Message %v has %d pushlog pushes, only 1 supported", msg, len(msg.PushlogPushes))
 	}
 
 	prefix := fmt.Sprintf("%s/json-pushes?version=2&", repoUrl)
 	pushJsonUrl := msg.PushlogPushes[0].PushJsonUrl
 	if !strings.HasPrefix(pushJsonUrl, prefix) {
-		return fmt.Errorf("push_json_url does not start with %s", prefix)
+		return nil, fmt.Errorf("push_json_url does not start with %s", prefix)
 	}
 
-	pushJsonUrl = fmt.Sprintf("%s&tipsonly=1", pushJsonUrl)
-	resp, err := http.Get(pushJsonUrl)
+	// full=1 adds the branch of the head
+	pushJson, err := fetchPushJson(ctx, fmt.Sprintf("%s&full=1&tipsonly=1", pushJsonUrl))
 	if err != nil {
-		return fmt.Errorf("Error calling push_json_url %s: %v", pushJsonUrl, err)
+		return nil, err
 	}
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("push_json_url %s did not return 200", pushJsonUrl)
+
+	msgPush := msg.PushlogPushes[0]
+	apiPush, ok := pushJson.Pushes[msgPush.PushId]
+	if !ok {
+		return nil, fmt.Errorf("Did not find push %d in push_json_url response: %v", msgPush.PushId, pushJson)
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("Error reading push_json_url response body: %v", err)
+	if msgPush.User != apiPush.User || msgPush.Time != apiPush.Date || len(apiPush.Changesets) != 1 || msg.Heads[0] != apiPush.Changesets[0].Node {
+		return nil, fmt.Errorf("push_json_url reponse does not match pulse message: %v %v", msg, pushJson)
 	}
-	pushJson := PushJson{}
-	if err := json.Unmarshal(body, &pushJson); err != nil {
-		return fmt.Errorf("Error parsing push_json_url response body: %v %s", err, body)
+	return &apiPush, nil
+}
+
+const hgPushExchange = "exchange/hgpushes/v2"
+
+type HgmoPulseHandler struct {
+	pulseConsumer
+
+	Deployer Deployer
+	Config   *ConfigStore
+
+	// Events records received messages when set
+	Events EventStore
+
+	// HgBaseURL is the hg server messages are verified against
+	HgBaseURL string
+	// HgmoTimeout bounds requests to hg.mozilla.org
+	HgmoTimeout time.Duration
+
+	// pending are deploys held for the delay of their route
+	pending pendingDeploys
+}
+
+func NewHgmoPulseHandler(deployer Deployer, source MessageSource, queueName string, hgRepos ...string) *HgmoPulseHandler {
+	log.Print(hgRepos)
+	handler := &HgmoPulseHandler{
+		pulseConsumer: pulseConsumer{
+			Source:    source,
+			QueueName: queueName,
+		},
+		Deployer:  deployer,
+		Config:    NewConfigStore(&Config{HgmoRepos: hgRepos}),
+		HgBaseURL: DefaultHgBaseURL,
 	}
+	handler.pulseConsumer.bindings = handler.bindings
+	handler.pulseConsumer.handle = handler.handleDelivery
+	return handler
+}
 
-	msgPush := msg.PushlogPushes[0]
-	apiPush, ok := pushJson.Pushes[msgPush.PushId]
-	if !ok {
-		return fmt.Errorf("Did not find push %d in push_json_url response: %v", msgPush.PushId, pushJson)
+// handleDelivery decodes delivery and handles it
+func (handler *HgmoPulseHandler) handleDelivery(delivery *Delivery) {
+	var message interface{}
+	if m := new(HgMessage); decodeMessage(delivery, m) {
+		message = m
+	}
+	handler.handleMessage(message, delivery)
+}
+
+func (handler *HgmoPulseHandler) handleMessage(message interface{}, delivery *Delivery) {
+	event := NewEvent(SourceHgmo, delivery.Body)
+	event.RoutingKey = delivery.RoutingKey
+	event.Repo = delivery.RoutingKey
+	if t, ok := message.(*HgMessage); ok {
+		err := handler.receiveMessage(context.Background(), event, t, delivery.RoutingKey)
+		// scheduled deploys and obsolete markers set their own outcome
+		if event.Outcome == "" {
+			event.SetResult(err)
+		}
+		if err != nil {
+			log.Printf("%s", err)
+		}
+	} else {
+		event.SetResult(nil)
 	}
+	handler.recordEvent(event)
+	delivery.Ack() // acknowledge message *after* processing
+}
 
-	if msgPush.User != apiPush.User || msgPush.Time != apiPush.Date || len(apiPush.Changesets) != 1 || msg.Heads[0] != apiPush.Changesets[0] {
-		return fmt.Errorf("push_json_url reponse does not match pulse message: %v %v", msg, pushJson)
+func (handler *HgmoPulseHandler) recordEvent(event *Event) {
+	if handler.Events == nil {
+		return
 	}
-	return nil
+	if err := handler.Events.Record(event); err != nil {
+		log.Printf("Error recording event: %v", err)
+	}
+}
+
+// receiveMessage processes a message from pulse into event. Unlike
+// processMessage it holds deploys for the delay of their route and
+// cancels pending deploys of changesets obsoleted by message.
+func (handler *HgmoPulseHandler) receiveMessage(ctx context.Context, event *Event, message *HgMessage, repoPath string) error {
+	if data, ok := message.Data.(ObsoleteMessage); ok {
+		reason, err := handler.processObsolete(data, repoPath)
+		if err == nil {
+			event.Outcome = OutcomeIgnored
+			event.Reason = reason
+		}
+		return err
+	}
+
+	route, deploy, err := handler.verifyDeploy(ctx, message, repoPath)
+	if err != nil || deploy == nil {
+		return err
+	}
+	if delay := route.DelayDuration(); delay > 0 {
+		handler.schedule(event, route, deploy, delay)
+		return nil
+	}
+	return handler.deploy(ctx, event.Deployer(handler.Deployer), route, deploy)
 }
 
-type hgPushBinding struct {
-	Repository string
+// processMessage verifies message and triggers its job
+// repoPath is the routing key the message was received with
+func (handler *HgmoPulseHandler) processMessage(ctx context.Context, deployer Deployer, message *HgMessage, repoPath string) error {
+	route, event, err := handler.verifyDeploy(ctx, message, repoPath)
+	if err != nil || event == nil {
+		return err
+	}
+	return handler.deploy(ctx, deployer, route, event)
 }
 
-func (binding hgPushBinding) RoutingKey() string {
-	return binding.Repository
+func (handler *HgmoPulseHandler) deploy(ctx context.Context, deployer Deployer, route *Route, event *DeployEvent) error {
+	if err := deployer.Deploy(ctx, route, event); err != nil {
+		return fmt.Errorf("Error triggering hg.mozilla.org job: %s", err)
+	}
+	return nil
 }
 
-func (binding hgPushBinding) ExchangeName() string {
-	return "exchange/hgpushes/v2"
+// verifyDeploy verifies message and returns the event it deploys with its
+// route, or a nil event if message does not deploy anything
+func (handler *HgmoPulseHandler) verifyDeploy(ctx context.Context, message *HgMessage, repoPath string) (*Route, *DeployEvent, error) {
+	config := handler.Config.Get()
+	switch data := message.Data.(type) {
+	case ChangegroupMessage:
+		if !config.IsValidHgRepo(repoPath) {
+			return nil, nil, fmt.Errorf("Unwatched repository %s", repoPath)
+		}
+		route := config.Route(SourceHgmo, repoPath)
+		if route == nil && config.FollowsBookmarks(repoPath) {
+			// only bookmark moves are deployed
+			return nil, nil, nil
+		}
+		if err := handler.verifyMessage(ctx, data, repoPath); err != nil {
+			return nil, nil, err
+		}
+		event, err := message.DeployEvent(repoPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error triggering hg.mozilla.org job: %s", err)
+		}
+		return route, event, nil
+	case PushkeyMessage:
+		if !config.IsValidHgRepo(repoPath) {
+			return nil, nil, fmt.Errorf("Unwatched repository %s", repoPath)
+		}
+		if data.Namespace != "bookmarks" || data.Ret == 0 || data.New == "" {
+			return nil, nil, nil
+		}
+		route := config.BookmarkRoute(repoPath, data.Key)
+		if route == nil {
+			return nil, nil, nil
+		}
+		event, err := handler.verifyBookmark(ctx, message, data, repoPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		return route, event, nil
+	}
+	return nil, nil, nil
 }
 
-func (binding hgPushBinding) NewPayloadObject() interface{} {
-	return new(HgMessage)
+// withHgmoTimeout bounds ctx by handler.HgmoTimeout
+func (handler *HgmoPulseHandler) withHgmoTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if handler.HgmoTimeout > 0 {
+		return context.WithTimeout(ctx, handler.HgmoTimeout)
+	}
+	return context.WithCancel(ctx)
 }
 
-type HgmoPulseHandler struct {
-	Jenkins      Jenkins
-	Pulse        *pulse.Connection
-	QueueName    string
-	ValidHgRepos map[string]bool
+// verifyMessage verifies data and checks its push against the hgmo rule of repoPath
+func (handler *HgmoPulseHandler) verifyMessage(ctx context.Context, data ChangegroupMessage, repoPath string) error {
+	ctx, cancel := handler.withHgmoTimeout(ctx)
+	defer cancel()
+	push, err := data.VerifyMessage(ctx, handler.HgBaseURL, repoPath)
+	if err != nil {
+		return err
+	}
+	rule := handler.Config.Get().HgmoRule(repoPath)
+	return rule.Check(repoPath, push.User, push.Changesets[0].Branch, "")
 }
 
-func NewHgmoPulseHandler(jenkins Jenkins, pulse *pulse.Connection, queueName string, hgRepos ...string) *HgmoPulseHandler {
-	validHgRepos := make(map[string]bool)
-	for _, hgRepo := range hgRepos {
-		validHgRepos[hgRepo] = true
+// verifyBookmark checks that the bookmark of data moved to a changeset
+// pushed to repoPath and returns the DeployEvent of the move
+func (handler *HgmoPulseHandler) verifyBookmark(ctx context.Context, message *HgMessage, data PushkeyMessage, repoPath string) (*DeployEvent, error) {
+	if err := ValidateHgRepoPath(repoPath); err != nil {
+		return nil, err
 	}
-	log.Print(hgRepos)
-	return &HgmoPulseHandler{
-		Jenkins:      jenkins,
-		Pulse:        pulse,
-		QueueName:    queueName,
-		ValidHgRepos: validHgRepos,
+	repoUrl := hgRepoURL(handler.HgBaseURL, repoPath)
+	if data.RepoUrl != repoUrl {
+		return nil, fmt.Errorf("Message has repoUrl %s which doesn't match routing key %s", data.RepoUrl, repoPath)
+	}
+	if !hgNodeRegexp.MatchString(data.New) {
+		return nil, fmt.Errorf("Invalid node %s for bookmark %s", data.New, data.Key)
 	}
+
+	fetchCtx, cancel := handler.withHgmoTimeout(ctx)
+	defer cancel()
+	pushJson, err := fetchPushJson(fetchCtx, fmt.Sprintf("%s/json-pushes?version=2&full=1&changeset=%s", repoUrl, data.New))
+	if err != nil {
+		return nil, err
+	}
+	var push Push
+	var changeset *PushChangeset
+	for _, p := range pushJson.Pushes {
+		if c := p.Changeset(data.New); c != nil {
+			push, changeset = p, c
+			break
+		}
+	}
+	if changeset == nil {
+		return nil, fmt.Errorf("Bookmark %s moved to %s which was not pushed to %s", data.Key, data.New, repoPath)
+	}
+	rule := handler.Config.Get().HgmoRule(repoPath)
+	if err := rule.Check(repoPath, push.User, changeset.Branch, data.Key); err != nil {
+		return nil, err
+	}
+
+	raw, err := json.Marshal(message)
+	if err != nil {
+		return nil, fmt.Errorf("Error marshaling data: %v", err)
+	}
+	return &DeployEvent{
+		Source:        SourceHgmo,
+		Repository:    repoPath,
+		RepositoryURL: repoUrl,
+		Ref:           data.New,
+		Revision:      data.New,
+		Bookmark:      data.Key,
+		Timestamp:     time.Now().UTC(),
+		Raw:           raw,
+	}, nil
 }
 
-func (handler *HgmoPulseHandler) handleMessage(message interface{}, delivery amqp.Delivery) {
-	switch t := message.(type) {
-	case *HgMessage:
-		switch data := t.Data.(type) {
-		case ChangegroupMessage:
-			repoPath := delivery.RoutingKey
-			if !handler.ValidHgRepos[repoPath] {
-				log.Printf("Unwatched repository %s", repoPath)
-				break
-			}
-			if err := data.VerifyMessage(repoPath); err != nil {
-				log.Printf("%s", err)
-				break
-			}
-			if err := TriggerHgJob(handler.Jenkins, repoPath, data.RepoUrl, data.Heads[0], t); err != nil {
-				log.Printf("Error triggering hg.mozilla.org job: %s", err)
-			}
+// TriggerRevision triggers the job for repoPath as if hg.mozilla.org had
+// sent a changegroup message with rev as its head.
+// rev must be the tip of a push to repoPath.
+func (handler *HgmoPulseHandler) TriggerRevision(ctx context.Context, repoPath, rev string) error {
+	if !hgNodeRegexp.MatchString(rev) {
+		return fmt.Errorf("Invalid revision %s, expected a full changeset hash", rev)
+	}
+	repoUrl := hgRepoURL(handler.HgBaseURL, repoPath)
+	fetchCtx, cancel := handler.withHgmoTimeout(ctx)
+	defer cancel()
+	pushJson, err := fetchPushJson(fetchCtx, fmt.Sprintf("%s/json-pushes?version=2&changeset=%s&tipsonly=1", repoUrl, rev))
+	if err != nil {
+		return err
+	}
+
+	data := ChangegroupMessage{
+		RepoUrl: repoUrl,
+		Heads:   []string{rev},
+		Source:  "admin",
+	}
+	for pushId, push := range pushJson.Pushes {
+		if len(push.Changesets) != 1 || push.Changesets[0].Node != rev {
+			continue
 		}
+		data.PushlogPushes = append(data.PushlogPushes, ChangegroupPush{
+			PushId:          pushId,
+			User:            push.User,
+			Time:            push.Date,
+			PushJsonUrl:     fmt.Sprintf("%s/json-pushes?version=2&startID=%d&endID=%d", repoUrl, pushId-1, pushId),
+			PushFullJsonUrl: fmt.Sprintf("%s/json-pushes?version=2&full=1&startID=%d&endID=%d", repoUrl, pushId-1, pushId),
+		})
+	}
+	if len(data.PushlogPushes) == 0 {
+		return fmt.Errorf("Revision %s is not the head of a push to %s", rev, repoPath)
+	}
+
+	return handler.processMessage(ctx, handler.Deployer, &HgMessage{Type: "changegroup.1", Data: data}, repoPath)
+}
+
+// Replay triggers the job for a previously recorded hgmo event
+func (handler *HgmoPulseHandler) Replay(ctx context.Context, event *Event) error {
+	message := new(HgMessage)
+	if err := json.Unmarshal(event.Payload, message); err != nil {
+		return fmt.Errorf("Error unmarshaling event %s: %v", event.ID, err)
 	}
-	delivery.Ack(false) // acknowledge message *after* processing
+	return handler.processMessage(ctx, handler.Deployer, message, event.RoutingKey)
 }
 
 func (handler *HgmoPulseHandler) Consume() error {
-	bindings := make([]pulse.Binding, 0)
-	for validHgRepo := range handler.ValidHgRepos {
-		bindings = append(bindings, hgPushBinding{Repository: validHgRepo})
-	}
-	_, err := handler.Pulse.Consume(
-		handler.QueueName,
-		handler.handleMessage,
-		1,     // prefetch 1 message at a time
-		false, // don't autoacknowledge messages
-		bindings...,
-	)
-	return err
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if err := handler.consume(); err != nil {
+		return err
+	}
+	// pulse-go only knows how to deliver messages from exchanges it was
+	// given a binding for, so rebinding needs at least one initial binding
+	if len(handler.Config.Get().HgmoRepos) > 0 && handler.QueueName != "" {
+		handler.Config.OnChange(handler.updateBindings)
+	} else {
+		log.Printf("hgmo queue bindings will not be updated on config reload")
+	}
+	return nil
+}
+
+// bindings returns a binding for each watched repository
+func (handler *HgmoPulseHandler) bindings() []Binding {
+	bindings := make([]Binding, 0)
+	for _, validHgRepo := range handler.Config.Get().HgmoRepos {
+		bindings = append(bindings, Binding{Exchange: hgPushExchange, RoutingKey: validHgRepo})
+	}
+	return bindings
+}
+
+// updateBindings binds and unbinds the queue of the live subscription
+// for repositories added or removed from the config
+func (handler *HgmoPulseHandler) updateBindings(old, new *Config) {
+	added, removed := make([]string, 0), make([]string, 0)
+	for _, repo := range new.HgmoRepos {
+		if !old.IsValidHgRepo(repo) {
+			added = append(added, repo)
+		}
+	}
+	for _, repo := range old.HgmoRepos {
+		if !new.IsValidHgRepo(repo) {
+			removed = append(removed, repo)
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	queue := handler.QueueName
+	for _, repo := range added {
+		log.Printf("Binding %s to %s with routing key %s", queue, hgPushExchange, repo)
+		if err := handler.subscription.Bind(Binding{Exchange: hgPushExchange, RoutingKey: repo}); err != nil {
+			log.Printf("Error binding %s: %v", repo, err)
+		}
+	}
+	for _, repo := range removed {
+		log.Printf("Unbinding %s from %s with routing key %s", queue, hgPushExchange, repo)
+		if err := handler.subscription.Unbind(Binding{Exchange: hgPushExchange, RoutingKey: repo}); err != nil {
+			log.Printf("Error unbinding %s: %v", repo, err)
+		}
+	}
 }
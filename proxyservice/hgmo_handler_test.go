@@ -1,13 +1,17 @@
 package proxyservice
 
 import (
-	"github.com/streadway/amqp"
-
+	"bytes"
+	"context"
 	"encoding/json"
+	"net/http"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"go.mozilla.org/cloudops-deployment-proxy/proxyservice/hgmotest"
 )
 
 type HgmoFixture struct {
@@ -20,21 +24,57 @@ type HgmoFixture struct {
 	Errors []string
 }
 
+// loadHgFixture loads a pulse message fixture sent by the hg server at baseURL
+func loadHgFixture(path, baseURL string) []byte {
+	return bytes.ReplaceAll(loadFixture(path), []byte("https://hg.mozilla.org"), []byte(baseURL))
+}
+
+// newFakeHgmo returns a fake hg.mozilla.org with the pushes of the fixtures
+func newFakeHgmo() *hgmotest.Server {
+	hg := hgmotest.NewServer()
+	hg.AddPush("ci/ci-admin", hgmotest.Push{ID: 158, User: "mozilla@hocat.ca", Date: 1588273363, Changesets: []hgmotest.Changeset{
+		{Node: "9c9a898b351909b2e0fe8420ac9d649ded523af3", Branch: "default"},
+	}})
+	hg.AddPush("users/mozilla_hocat.ca/hg-extra", hgmotest.Push{ID: 2, User: "mozilla@hocat.ca", Date: 1587713752, Changesets: []hgmotest.Changeset{
+		{Node: "1262b7fc3aecbe4e192f29e9e619eef8ba6e3f35"},
+	}})
+	hg.AddPush("mozilla-central", hgmotest.Push{ID: 37346, User: "mozilla@hocat.ca", Date: 1587752487, Changesets: []hgmotest.Changeset{
+		{Node: "9442967f483a7c61b520c3f559a8db9fb29aa573"},
+	}})
+	return hg
+}
+
 func TestHgmoHandler(t *testing.T) {
 	var logs LogCapture
 	defer logs.Reset()
 	logs.Start()
 
+	hg := newFakeHgmo()
+	defer hg.Close()
+
 	jenkins := NewFakeJenkins()
+	events := NewMemoryEventStore(20)
 	handler := NewHgmoPulseHandler(
-		jenkins,
+		NewJenkinsDeployer(jenkins),
 		nil,
 		"proxy-queue",
 		// HG Repos
 		"ci/ci-admin",
+		"ci/ci-configuration",
 		"mozilla-central",
 		"users/mozilla_hocat.ca/hg-extra",
 	)
+	handler.HgBaseURL = hg.URL
+	handler.Events = events
+	handler.Config = NewConfigStore(&Config{
+		HgmoRepos: handler.Config.Get().HgmoRepos,
+		HgmoRules: []*HgmoRule{
+			{Repo: "ci/ci-configuration", Users: []string{"*@mozilla.com"}},
+		},
+	})
+	hg.AddPush("ci/ci-configuration", hgmotest.Push{ID: 12, User: "mozilla@hocat.ca", Changesets: []hgmotest.Changeset{
+		{Node: "ce7ae9a988cd41bf9ab5852ba8923cc43e62ea34"},
+	}})
 
 	fixtures := []HgmoFixture{
 		{
@@ -42,29 +82,29 @@ func TestHgmoHandler(t *testing.T) {
 			RoutingKey: "ci/ci-admin",
 			Jobs: []JenkinsJob{{
 				"/job/hgmo/job/ci/job/ci-admin", url.Values{
-					"HEAD_REPOSITORY": {"https://hg.mozilla.org/ci/ci-admin"},
+					"HEAD_REPOSITORY": {hg.RepoURL("ci/ci-admin")},
 					"HEAD_REV":        {"9c9a898b351909b2e0fe8420ac9d649ded523af3"},
 				}}},
-			Message: loadFixture("fixtures/hgmo_changegroup.json"),
+			Message: loadHgFixture("fixtures/hgmo_changegroup.json", hg.URL),
 		},
 		{
 			TestName:   "Nested Repository",
 			RoutingKey: "users/mozilla_hocat.ca/hg-extra",
-			Message:    loadFixture("fixtures/hgmo_hg-extra_changegroup.json"),
+			Message:    loadHgFixture("fixtures/hgmo_hg-extra_changegroup.json", hg.URL),
 			Jobs:       nil,
 			Errors:     []string{"Invalid hg.mozilla.org repository path"},
 		},
 		{
 			TestName:   "Top-level Repository",
 			RoutingKey: "mozilla-central",
-			Message:    loadFixture("fixtures/hgmo_central_changegroup.json"),
+			Message:    loadHgFixture("fixtures/hgmo_central_changegroup.json", hg.URL),
 			Jobs:       nil,
 			Errors:     []string{"Invalid hg.mozilla.org repository path"},
 		},
 		{
 			TestName:   "Multiple Heads",
 			RoutingKey: "ci/ci-admin",
-			Message:    loadFixture("fixtures/hgmo_changegroup.json"),
+			Message:    loadHgFixture("fixtures/hgmo_changegroup.json", hg.URL),
 			ModFunc: func(message *HgMessage) {
 				data := message.Data.(ChangegroupMessage)
 				data.Heads = append(data.Heads, "ce7ae9a988cd41bf9ab5852ba8923cc43e62ea34")
@@ -76,7 +116,7 @@ func TestHgmoHandler(t *testing.T) {
 		{
 			TestName:   "Multiple Pushes",
 			RoutingKey: "ci/ci-admin",
-			Message:    loadFixture("fixtures/hgmo_changegroup.json"),
+			Message:    loadHgFixture("fixtures/hgmo_changegroup.json", hg.URL),
 			ModFunc: func(message *HgMessage) {
 				data := message.Data.(ChangegroupMessage)
 				data.PushlogPushes = append(data.PushlogPushes, data.PushlogPushes[0])
@@ -88,10 +128,48 @@ func TestHgmoHandler(t *testing.T) {
 		{
 			TestName:   "Unknown repo",
 			RoutingKey: "ci/taskgraph",
-			Message:    loadFixture("fixtures/hgmo_changegroup.json"),
+			Message:    loadHgFixture("fixtures/hgmo_changegroup.json", hg.URL),
 			Jobs:       nil,
 			Errors:     []string{"Unwatched repository"},
 		},
+		{
+			TestName:   "Other Server",
+			RoutingKey: "ci/ci-admin",
+			Message:    loadFixture("fixtures/hgmo_changegroup.json"),
+			Jobs:       nil,
+			Errors:     []string{"has repoUrl https://hg.mozilla.org/ci/ci-admin which doesn't match routing key ci/ci-admin"},
+		},
+		{
+			TestName:   "Forged Head",
+			RoutingKey: "ci/ci-admin",
+			Message:    loadHgFixture("fixtures/hgmo_changegroup.json", hg.URL),
+			ModFunc: func(message *HgMessage) {
+				data := message.Data.(ChangegroupMessage)
+				data.Heads = []string{"ce7ae9a988cd41bf9ab5852ba8923cc43e62ea34"}
+				message.Data = data
+			},
+			Jobs:   nil,
+			Errors: []string{"push_json_url reponse does not match pulse message"},
+		},
+		{
+			TestName:   "Unknown Push",
+			RoutingKey: "ci/ci-admin",
+			Message:    loadHgFixture("fixtures/hgmo_changegroup.json", hg.URL),
+			ModFunc: func(message *HgMessage) {
+				data := message.Data.(ChangegroupMessage)
+				data.PushlogPushes[0].PushId = 157
+				message.Data = data
+			},
+			Jobs:   nil,
+			Errors: []string{"Did not find push 157 in push_json_url response"},
+		},
+		{
+			TestName:   "Push User Not Allowed",
+			RoutingKey: "ci/ci-configuration",
+			Message:    hg.ChangegroupMessage("ci/ci-configuration", 12),
+			Jobs:       nil,
+			Errors:     []string{"Push user mozilla@hocat.ca is not allowed to deploy ci/ci-configuration"},
+		},
 	}
 
 	for _, fixture := range fixtures {
@@ -106,7 +184,7 @@ func TestHgmoHandler(t *testing.T) {
 			if fixture.ModFunc != nil {
 				fixture.ModFunc(&m)
 			}
-			handler.handleMessage(&m, amqp.Delivery{
+			handler.handleMessage(&m, &Delivery{
 				RoutingKey: fixture.RoutingKey,
 			})
 			assert.Equal(t, fixture.Jobs, jenkins.Jobs, fixture.TestName)
@@ -115,4 +193,243 @@ func TestHgmoHandler(t *testing.T) {
 			}
 		})
 	}
+
+	rejected := events.events[len(events.events)-1]
+	assert.Equal(t, OutcomeRejected, rejected.Outcome)
+	assert.Equal(t, "Push user mozilla@hocat.ca is not allowed to deploy ci/ci-configuration", rejected.Reason)
+
+	hg.SetStatus(http.StatusServiceUnavailable)
+	var m HgMessage
+	if err := json.Unmarshal(loadHgFixture("fixtures/hgmo_changegroup.json", hg.URL), &m); err != nil {
+		t.Fatal(err)
+	}
+	jenkins.Jobs = nil
+	handler.handleMessage(&m, &Delivery{RoutingKey: "ci/ci-admin"})
+	assert.Nil(t, jenkins.Jobs)
+	assert.Contains(t, logs.Messages.String(), "did not return 200")
+}
+
+func TestHgmoTriggerRevision(t *testing.T) {
+	hg := newFakeHgmo()
+	defer hg.Close()
+
+	jenkins := NewFakeJenkins()
+	handler := NewHgmoPulseHandler(NewJenkinsDeployer(jenkins), nil, "proxy-queue", "ci/ci-admin")
+	handler.HgBaseURL = hg.URL + "/"
+
+	ctx := context.Background()
+	assert.NoError(t, handler.TriggerRevision(ctx, "ci/ci-admin", "9c9a898b351909b2e0fe8420ac9d649ded523af3"))
+	assert.Equal(t, []JenkinsJob{{"/job/hgmo/job/ci/job/ci-admin", url.Values{
+		"HEAD_REPOSITORY": {hg.RepoURL("ci/ci-admin")},
+		"HEAD_REV":        {"9c9a898b351909b2e0fe8420ac9d649ded523af3"},
+	}}}, jenkins.Jobs)
+
+	assert.EqualError(t, handler.TriggerRevision(ctx, "ci/ci-admin", "ce7ae9a988cd41bf9ab5852ba8923cc43e62ea34"),
+		"Revision ce7ae9a988cd41bf9ab5852ba8923cc43e62ea34 is not the head of a push to ci/ci-admin")
+	assert.EqualError(t, handler.TriggerRevision(ctx, "ci/ci-admin", "tip"),
+		"Invalid revision tip, expected a full changeset hash")
+}
+
+func TestHgMessageTypes(t *testing.T) {
+	var pushkey HgMessage
+	assert.NoError(t, json.Unmarshal(loadFixture("fixtures/hgmo_pushkey.json"), &pushkey))
+	assert.Equal(t, PushkeyMessage{
+		RepoUrl:   "https://hg.mozilla.org/ci/ci-admin",
+		Namespace: "bookmarks",
+		Key:       "production",
+		Old:       "ce7ae9a988cd41bf9ab5852ba8923cc43e62ea34",
+		New:       "9c9a898b351909b2e0fe8420ac9d649ded523af3",
+		Ret:       1,
+	}, pushkey.Data)
+
+	var obsolete HgMessage
+	assert.NoError(t, json.Unmarshal(loadFixture("fixtures/hgmo_obsolete.json"), &obsolete))
+	markers := obsolete.Data.(ObsoleteMessage).Markers
+	assert.Len(t, markers, 1)
+	assert.Equal(t, "9c9a898b351909b2e0fe8420ac9d649ded523af3", markers[0].Precursor.Node)
+	assert.Equal(t, 158, markers[0].Precursor.Push.PushId)
+	assert.Nil(t, markers[0].Successors[0].Push)
+
+	var unknown HgMessage
+	assert.EqualError(t, json.Unmarshal([]byte(`{"payload": {"type": "heartbeat.1", "data": {}}}`), &unknown), "Unknown hg message type heartbeat.1")
+}
+
+func TestPushJson(t *testing.T) {
+	var pushJson PushJson
+	assert.NoError(t, json.Unmarshal([]byte(`{"lastpushid": 158, "pushes": {
+		"157": {"changesets": ["ce7ae9a988cd41bf9ab5852ba8923cc43e62ea34"], "date": 1588273000, "user": "a@example.com"},
+		"158": {"changesets": [{"node": "9c9a898b351909b2e0fe8420ac9d649ded523af3", "branch": "default", "author": "A <a@example.com>", "desc": "Bug 1", "tags": ["tip"]}], "date": 1588273363, "user": "mozilla@hocat.ca"}
+	}}`), &pushJson))
+	assert.Equal(t, PushChangeset{Node: "ce7ae9a988cd41bf9ab5852ba8923cc43e62ea34"}, pushJson.Pushes[157].Changesets[0])
+	push := pushJson.Pushes[158]
+	assert.Equal(t, "default", push.Changeset("9c9a898b351909b2e0fe8420ac9d649ded523af3").Branch)
+	assert.Nil(t, push.Changeset("ce7ae9a988cd41bf9ab5852ba8923cc43e62ea34"))
+}
+
+func TestHgmoBookmarkRoutes(t *testing.T) {
+	var logs LogCapture
+	defer logs.Reset()
+	logs.Start()
+
+	hg := newFakeHgmo()
+	defer hg.Close()
+	hg.AddPush("ci/ci-admin", hgmotest.Push{User: "mozilla@hocat.ca", Changesets: []hgmotest.Changeset{
+		{Node: "4b7a3a1d5f0a8e2c6c9d0e1f2a3b4c5d6e7f8091", Branch: "experiment"},
+	}})
+
+	jenkins := NewFakeJenkins()
+	events := NewMemoryEventStore(10)
+	handler := NewHgmoPulseHandler(NewJenkinsDeployer(jenkins), nil, "proxy-queue")
+	handler.HgBaseURL = hg.URL
+	handler.Config = NewConfigStore(&Config{
+		HgmoRepos: []string{"ci/ci-admin"},
+		HgmoRules: []*HgmoRule{
+			{Repo: "ci/*", Branches: []string{"default"}},
+		},
+		Routes: []*Route{
+			{Source: "hgmo", Repo: "ci/*", Bookmark: "prod*", JobPath: "/job/ci-prod"},
+		},
+	})
+	handler.Events = events
+
+	for _, fixture := range []struct {
+		TestName string
+		ModFunc  func(*PushkeyMessage)
+		Jobs     []JenkinsJob
+		Error    string
+	}{
+		{
+			TestName: "Valid Move",
+			ModFunc:  func(m *PushkeyMessage) {},
+			Jobs: []JenkinsJob{{"/job/ci-prod", url.Values{
+				"HEAD_REPOSITORY": {hg.RepoURL("ci/ci-admin")},
+				"HEAD_REV":        {"9c9a898b351909b2e0fe8420ac9d649ded523af3"},
+				"HEAD_BOOKMARK":   {"production"},
+			}}},
+		},
+		{
+			TestName: "Other Namespace",
+			ModFunc:  func(m *PushkeyMessage) { m.Namespace = "phases" },
+		},
+		{
+			TestName: "Failed Move",
+			ModFunc:  func(m *PushkeyMessage) { m.Ret = 0 },
+		},
+		{
+			TestName: "Deleted Bookmark",
+			ModFunc:  func(m *PushkeyMessage) { m.New = "" },
+		},
+		{
+			TestName: "Unrouted Bookmark",
+			ModFunc:  func(m *PushkeyMessage) { m.Key = "staging" },
+		},
+		{
+			TestName: "Wrong Repository",
+			ModFunc:  func(m *PushkeyMessage) { m.RepoUrl = hg.RepoURL("ci/ci-configuration") },
+			Error:    "Message has repoUrl " + hg.RepoURL("ci/ci-configuration") + " which doesn't match routing key ci/ci-admin",
+		},
+		{
+			TestName: "Invalid Node",
+			ModFunc:  func(m *PushkeyMessage) { m.New = "tip" },
+			Error:    "Invalid node tip for bookmark production",
+		},
+		{
+			TestName: "Not Pushed",
+			ModFunc:  func(m *PushkeyMessage) { m.New = "ce7ae9a988cd41bf9ab5852ba8923cc43e62ea34" },
+			Error:    "Bookmark production moved to ce7ae9a988cd41bf9ab5852ba8923cc43e62ea34 which was not pushed to ci/ci-admin",
+		},
+		{
+			TestName: "Branch Not Allowed",
+			ModFunc:  func(m *PushkeyMessage) { m.New = "4b7a3a1d5f0a8e2c6c9d0e1f2a3b4c5d6e7f8091" },
+			Error:    "Branch experiment is not allowed to deploy ci/ci-admin",
+		},
+	} {
+		jenkins.Jobs = nil
+		logs.Messages.Truncate(0)
+		t.Run(fixture.TestName, func(t *testing.T) {
+			var m HgMessage
+			if err := json.Unmarshal(loadHgFixture("fixtures/hgmo_pushkey.json", hg.URL), &m); err != nil {
+				t.Fatal(err)
+			}
+			data := m.Data.(PushkeyMessage)
+			fixture.ModFunc(&data)
+			m.Data = data
+			handler.handleMessage(&m, &Delivery{RoutingKey: "ci/ci-admin"})
+			assert.Equal(t, fixture.Jobs, jenkins.Jobs)
+			if fixture.Error != "" {
+				assert.Contains(t, logs.Messages.String(), fixture.Error)
+			}
+		})
+	}
+	assert.Equal(t, "production", events.events[0].Deploy.Bookmark)
+
+	// pushes to repositories following bookmarks are ignored without calling hg.mozilla.org
+	requests := len(hg.Requests())
+	jenkins.Jobs = nil
+	var m HgMessage
+	if err := json.Unmarshal(loadHgFixture("fixtures/hgmo_changegroup.json", hg.URL), &m); err != nil {
+		t.Fatal(err)
+	}
+	handler.handleMessage(&m, &Delivery{RoutingKey: "ci/ci-admin"})
+	assert.Nil(t, jenkins.Jobs)
+	assert.Equal(t, OutcomeIgnored, events.events[len(events.events)-1].Outcome)
+	assert.Len(t, hg.Requests(), requests)
+}
+
+func TestHgmoObsolete(t *testing.T) {
+	var logs LogCapture
+	defer logs.Reset()
+	logs.Start()
+
+	jenkins := NewFakeJenkins()
+	events := NewMemoryEventStore(10)
+	handler := NewHgmoPulseHandler(NewJenkinsDeployer(jenkins), nil, "proxy-queue", "ci/ci-admin")
+	handler.Events = events
+	route := &Route{Source: "hgmo", Repo: "ci/*", Delay: "1h"}
+
+	obsoleted, kept := "9c9a898b351909b2e0fe8420ac9d649ded523af3", "ce7ae9a988cd41bf9ab5852ba8923cc43e62ea34"
+	deployed := NewEvent(SourceHgmo, []byte(`{}`))
+	deployed.Repo = "ci/ci-admin"
+	deployed.Outcome = OutcomeTriggered
+	deployed.Deploy = &DeployEvent{Source: SourceHgmo, Repository: "ci/ci-admin", Revision: obsoleted}
+	events.Record(deployed)
+
+	scheduled := make([]*Event, 0)
+	for _, rev := range []string{obsoleted, kept} {
+		event := NewEvent(SourceHgmo, []byte(`{}`))
+		event.RoutingKey = "ci/ci-admin"
+		handler.schedule(event, route, &DeployEvent{
+			Source:        SourceHgmo,
+			Repository:    "ci/ci-admin",
+			RepositoryURL: "https://hg.mozilla.org/ci/ci-admin",
+			Ref:           rev,
+			Revision:      rev,
+		}, time.Hour)
+		assert.Equal(t, OutcomeScheduled, event.Outcome)
+		assert.Equal(t, "/job/hgmo/job/ci/job/ci-admin", event.Destination)
+		scheduled = append(scheduled, event)
+	}
+
+	var m HgMessage
+	if err := json.Unmarshal(loadFixture("fixtures/hgmo_obsolete.json"), &m); err != nil {
+		t.Fatal(err)
+	}
+	handler.handleMessage(&m, &Delivery{RoutingKey: "ci/ci-admin"})
+	event := events.events[len(events.events)-1]
+	assert.Equal(t, OutcomeIgnored, event.Outcome)
+	assert.Equal(t, "cancelled deploy of "+obsoleted+" scheduled by event "+scheduled[0].ID+"; "+
+		"flagged deploy of "+obsoleted+" by event "+deployed.ID, event.Reason)
+	assert.Contains(t, logs.Messages.String(), "Warning: changeset "+obsoleted+" deployed to ci/ci-admin by event "+deployed.ID+" is obsolete")
+
+	// the deploy of the other changeset is still pending
+	assert.Len(t, handler.pending.deploys, 1)
+	pending := handler.pending.deploys[0]
+	assert.Equal(t, scheduled[1].ID, pending.EventID)
+	assert.True(t, handler.pending.remove(pending))
+	handler.sendPending(pending)
+	assert.Equal(t, []JenkinsJob{{"/job/hgmo/job/ci/job/ci-admin", url.Values{
+		"HEAD_REPOSITORY": {"https://hg.mozilla.org/ci/ci-admin"},
+		"HEAD_REV":        {kept},
+	}}}, jenkins.Jobs)
+	assert.Equal(t, OutcomeTriggered, events.events[len(events.events)-1].Outcome)
 }
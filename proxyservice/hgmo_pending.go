@@ -0,0 +1,150 @@
+package proxyservice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pendingDeploy is a deploy held for the delay of its route
+type pendingDeploy struct {
+	// EventID is the id of the event which scheduled the deploy
+	EventID    string
+	RoutingKey string
+	Payload    json.RawMessage
+	Route      *Route
+	Deploy     *DeployEvent
+
+	timer *time.Timer
+}
+
+// pendingDeploys are the deploys waiting for their delay to pass.
+// The zero value is ready to use.
+type pendingDeploys struct {
+	mu      sync.Mutex
+	deploys []*pendingDeploy
+}
+
+// add calls send with d after delay unless d is cancelled first
+func (p *pendingDeploys) add(d *pendingDeploy, delay time.Duration, send func(*pendingDeploy)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deploys = append(p.deploys, d)
+	d.timer = time.AfterFunc(delay, func() {
+		if p.remove(d) {
+			send(d)
+		}
+	})
+}
+
+// remove returns false if d was already cancelled or sent
+func (p *pendingDeploys) remove(d *pendingDeploy) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, pending := range p.deploys {
+		if pending == d {
+			p.deploys = append(p.deploys[:i], p.deploys[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// cancel stops and returns the pending deploys of revision to repoPath
+func (p *pendingDeploys) cancel(repoPath, revision string) []*pendingDeploy {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cancelled := make([]*pendingDeploy, 0)
+	kept := p.deploys[:0]
+	for _, d := range p.deploys {
+		if d.Deploy.Repository == repoPath && d.Deploy.Revision == revision {
+			d.timer.Stop()
+			cancelled = append(cancelled, d)
+		} else {
+			kept = append(kept, d)
+		}
+	}
+	p.deploys = kept
+	return cancelled
+}
+
+// schedule holds deploy for delay and records event as scheduled
+func (handler *HgmoPulseHandler) schedule(event *Event, route *Route, deploy *DeployEvent, delay time.Duration) {
+	log.Printf("Deploying %s of %s in %s", deploy.Revision, deploy.Repository, delay)
+	event.Deploy = deploy
+	event.Target = route.TargetName()
+	event.Destination = handler.Deployer.Destination(route, deploy)
+	event.Outcome = OutcomeScheduled
+	event.Reason = fmt.Sprintf("Deploy delayed by %s", delay)
+	handler.pending.add(&pendingDeploy{
+		EventID:    event.ID,
+		RoutingKey: event.RoutingKey,
+		Payload:    event.Payload,
+		Route:      route,
+		Deploy:     deploy,
+	}, delay, handler.sendPending)
+}
+
+// sendPending deploys d, recording a new event for the deploy
+func (handler *HgmoPulseHandler) sendPending(d *pendingDeploy) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	log.Printf("Sending deploy of %s to %s scheduled by event %s", d.Deploy.Revision, d.Deploy.Repository, d.EventID)
+	event := NewEvent(SourceHgmo, d.Payload)
+	event.RoutingKey = d.RoutingKey
+	event.Repo = d.Deploy.Repository
+	err := handler.deploy(context.Background(), event.Deployer(handler.Deployer), d.Route, d.Deploy)
+	event.SetResult(err)
+	if err != nil {
+		log.Printf("%s", err)
+	}
+	handler.recordEvent(event)
+}
+
+// processObsolete cancels pending deploys of the changesets obsoleted by
+// message and flags recorded deploys of them. It returns what was done.
+func (handler *HgmoPulseHandler) processObsolete(message ObsoleteMessage, repoPath string) (string, error) {
+	if !handler.Config.Get().IsValidHgRepo(repoPath) {
+		return "", fmt.Errorf("Unwatched repository %s", repoPath)
+	}
+	if message.RepoUrl != hgRepoURL(handler.HgBaseURL, repoPath) {
+		return "", fmt.Errorf("Message has repoUrl %s which doesn't match routing key %s", message.RepoUrl, repoPath)
+	}
+
+	actions := make([]string, 0)
+	for _, marker := range message.Markers {
+		node := marker.Precursor.Node
+		for _, d := range handler.pending.cancel(repoPath, node) {
+			log.Printf("Cancelled deploy of obsolete changeset %s to %s scheduled by event %s", node, repoPath, d.EventID)
+			actions = append(actions, fmt.Sprintf("cancelled deploy of %s scheduled by event %s", node, d.EventID))
+		}
+		for _, id := range handler.deployedEvents(repoPath, node) {
+			log.Printf("Warning: changeset %s deployed to %s by event %s is obsolete", node, repoPath, id)
+			actions = append(actions, fmt.Sprintf("flagged deploy of %s by event %s", node, id))
+		}
+	}
+	return strings.Join(actions, "; "), nil
+}
+
+// deployedEvents returns the ids of the recorded events which deployed revision to repoPath
+func (handler *HgmoPulseHandler) deployedEvents(repoPath, revision string) []string {
+	ids := make([]string, 0)
+	if handler.Events == nil {
+		return ids
+	}
+	events, err := handler.Events.Query(&EventFilter{Repo: repoPath, Outcome: OutcomeTriggered})
+	if err != nil {
+		log.Printf("Error querying events: %v", err)
+		return ids
+	}
+	for _, event := range events {
+		if event.Source == SourceHgmo && event.Deploy != nil && event.Deploy.Revision == revision {
+			ids = append(ids, event.ID)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,88 @@
+package proxyservice
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// Check returns an error explaining why a push by user whose head is on
+// branch may not deploy repoPath. bookmark is the bookmark moved to the
+// head, if any. A nil rule allows every push.
+func (rule *HgmoRule) Check(repoPath, user, branch, bookmark string) error {
+	if rule == nil {
+		return nil
+	}
+	allowed, err := rule.allowsUser(user)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("Push user %s is not allowed to deploy %s", user, repoPath)
+	}
+	if len(rule.Branches) > 0 && !matchAny(rule.Branches, branch) {
+		return fmt.Errorf("Branch %s is not allowed to deploy %s", branch, repoPath)
+	}
+	if bookmark != "" && len(rule.Bookmarks) > 0 && !matchAny(rule.Bookmarks, bookmark) {
+		return fmt.Errorf("Bookmark %s is not allowed to deploy %s", bookmark, repoPath)
+	}
+	return nil
+}
+
+// allowsUser returns true if user matches rule.Users or is listed in
+// rule.UserFiles. Users are compared case insensitively.
+func (rule *HgmoRule) allowsUser(user string) (bool, error) {
+	if len(rule.Users) == 0 && len(rule.UserFiles) == 0 {
+		return true, nil
+	}
+	user = strings.ToLower(user)
+	for _, pattern := range rule.Users {
+		if matched, _ := path.Match(strings.ToLower(pattern), user); matched {
+			return true, nil
+		}
+	}
+	for _, file := range rule.UserFiles {
+		users, err := readUserFile(file)
+		if err != nil {
+			return false, err
+		}
+		if users[user] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// readUserFile returns the lower cased users listed in path,
+// one per line with # comments
+func readUserFile(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading user file: %v", err)
+	}
+	defer f.Close()
+
+	users := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if line != "" {
+			users[strings.ToLower(line)] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading user file: %v", err)
+	}
+	return users, nil
+}
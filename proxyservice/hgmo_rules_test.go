@@ -0,0 +1,56 @@
+package proxyservice
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHgmoRuleCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hgmo-rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	groupFile := filepath.Join(dir, "releng")
+	writeConfig(t, groupFile, "# members of the releng LDAP group\nreleaser@example.com\n  Admin@Example.com  # lead\n")
+
+	rule := &HgmoRule{
+		Repo:      "ci/*",
+		Users:     []string{"*@mozilla.com"},
+		UserFiles: []string{groupFile},
+		Branches:  []string{"default", "release-*"},
+		Bookmarks: []string{"production"},
+	}
+	for _, fixture := range []struct {
+		User     string
+		Branch   string
+		Bookmark string
+		Error    string
+	}{
+		{User: "someone@mozilla.com", Branch: "default"},
+		{User: "Someone@Mozilla.com", Branch: "release-1.0"},
+		{User: "admin@example.com", Branch: "default", Bookmark: "production"},
+		{User: "releaser@example.com", Branch: "default"},
+		{User: "mallory@example.com", Branch: "default", Error: "Push user mallory@example.com is not allowed to deploy ci/ci-admin"},
+		{User: "someone@mozilla.com", Branch: "experiment", Error: "Branch experiment is not allowed to deploy ci/ci-admin"},
+		{User: "someone@mozilla.com", Branch: "default", Bookmark: "staging", Error: "Bookmark staging is not allowed to deploy ci/ci-admin"},
+	} {
+		err := rule.Check("ci/ci-admin", fixture.User, fixture.Branch, fixture.Bookmark)
+		if fixture.Error == "" {
+			assert.NoError(t, err, fixture.User)
+		} else {
+			assert.EqualError(t, err, fixture.Error)
+		}
+	}
+
+	var none *HgmoRule
+	assert.NoError(t, none.Check("ci/ci-admin", "anyone", "any", ""))
+	assert.NoError(t, (&HgmoRule{Repo: "*"}).Check("ci/ci-admin", "anyone", "any", "any"))
+
+	rule.UserFiles = []string{filepath.Join(dir, "missing")}
+	assert.Contains(t, rule.Check("ci/ci-admin", "releaser@example.com", "default", "").Error(), "Error reading user file")
+}
@@ -0,0 +1,236 @@
+// Package hgmotest provides a fake hg.mozilla.org serving json-pushes, so
+// that code verifying hgmo pulse messages can be tested without a network.
+package hgmotest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Changeset is a changeset of a push
+type Changeset struct {
+	Node   string
+	Branch string
+	Author string
+	Desc   string
+	Tags   []string
+}
+
+// Push is a push to a repository, its head is the last changeset
+type Push struct {
+	ID         int
+	User       string
+	Date       int
+	Changesets []Changeset
+}
+
+// Server serves version 2 of json-pushes for the pushes added to it
+// at <URL>/<repo path>/json-pushes, supporting the startID, endID,
+// changeset, full and tipsonly parameters.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	pushes   map[string][]Push
+	requests []string
+	status   int
+}
+
+// NewServer starts a Server, which must be closed by the caller
+func NewServer() *Server {
+	s := &Server{pushes: make(map[string][]Push)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveJsonPushes))
+	return s
+}
+
+// RepoURL returns the url of repoPath on s
+func (s *Server) RepoURL(repoPath string) string {
+	return s.URL + "/" + repoPath
+}
+
+// AddPush adds push to repoPath and returns it. A zero push.ID is set to
+// the id following the last push, and a zero push.Date to the current time.
+func (s *Server) AddPush(repoPath string, push Push) Push {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pushes := s.pushes[repoPath]
+	if push.ID == 0 {
+		push.ID = 1
+		if len(pushes) > 0 {
+			push.ID = pushes[len(pushes)-1].ID + 1
+		}
+	}
+	if push.Date == 0 {
+		push.Date = int(time.Now().Unix())
+	}
+	s.pushes[repoPath] = append(pushes, push)
+	return push
+}
+
+// SetStatus makes s answer every request with status, 0 restores normal responses
+func (s *Server) SetStatus(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+// Requests returns the request URIs s received
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// ChangegroupMessage returns the pulse message hgmo sends on the
+// hgpushes exchange for push pushID to repoPath
+func (s *Server) ChangegroupMessage(repoPath string, pushID int) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, push := range s.pushes[repoPath] {
+		if push.ID != pushID {
+			continue
+		}
+		repoURL := s.RepoURL(repoPath)
+		head := ""
+		if len(push.Changesets) > 0 {
+			head = push.Changesets[len(push.Changesets)-1].Node
+		}
+		return message(repoPath, "changegroup.1", map[string]interface{}{
+			"repo_url": repoURL,
+			"heads":    []string{head},
+			"source":   "serve",
+			"pushlog_pushes": []map[string]interface{}{{
+				"pushid":             push.ID,
+				"user":               push.User,
+				"time":               push.Date,
+				"push_json_url":      fmt.Sprintf("%s/json-pushes?version=2&startID=%d&endID=%d", repoURL, push.ID-1, push.ID),
+				"push_full_json_url": fmt.Sprintf("%s/json-pushes?version=2&full=1&startID=%d&endID=%d", repoURL, push.ID-1, push.ID),
+			}},
+		})
+	}
+	panic(fmt.Sprintf("hgmotest: no push %d to %s", pushID, repoPath))
+}
+
+// PushkeyMessage returns the pulse message hgmo sends when bookmark
+// is moved from old to new in repoPath
+func (s *Server) PushkeyMessage(repoPath, bookmark, old, new string) []byte {
+	return message(repoPath, "pushkey.1", map[string]interface{}{
+		"repo_url":  s.RepoURL(repoPath),
+		"namespace": "bookmarks",
+		"key":       bookmark,
+		"old":       old,
+		"new":       new,
+		"ret":       1,
+	})
+}
+
+func message(repoPath, messageType string, data interface{}) []byte {
+	body, err := json.Marshal(map[string]interface{}{
+		"_meta": map[string]string{
+			"exchange":    "exchange/hgpushes/v2",
+			"routing_key": repoPath,
+			"serializer":  "json",
+		},
+		"payload": map[string]interface{}{
+			"type": messageType,
+			"data": data,
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return body
+}
+
+func (s *Server) serveJsonPushes(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, req.URL.RequestURI())
+	if s.status != 0 {
+		http.Error(w, http.StatusText(s.status), s.status)
+		return
+	}
+
+	repoPath := strings.TrimPrefix(strings.TrimSuffix(req.URL.Path, "/json-pushes"), "/")
+	pushes, ok := s.pushes[repoPath]
+	if !ok || !strings.HasSuffix(req.URL.Path, "/json-pushes") {
+		http.NotFound(w, req)
+		return
+	}
+	query := req.URL.Query()
+	if query.Get("version") != "2" {
+		http.Error(w, "only version 2 is supported", http.StatusBadRequest)
+		return
+	}
+	startID, endID := -1, -1
+	for name, id := range map[string]*int{"startID": &startID, "endID": &endID} {
+		if value := query.Get(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				http.Error(w, "invalid "+name, http.StatusBadRequest)
+				return
+			}
+			*id = n
+		}
+	}
+	changeset := query.Get("changeset")
+	full, tipsonly := query.Get("full") == "1", query.Get("tipsonly") == "1"
+
+	resp := struct {
+		LastPushID int                    `json:"lastpushid"`
+		Pushes     map[string]interface{} `json:"pushes"`
+	}{Pushes: make(map[string]interface{})}
+	for _, push := range pushes {
+		resp.LastPushID = push.ID
+		if (startID >= 0 && push.ID <= startID) || (endID >= 0 && push.ID > endID) || (changeset != "" && !push.has(changeset)) {
+			continue
+		}
+		changesets := push.Changesets
+		if tipsonly && len(changesets) > 0 {
+			changesets = changesets[len(changesets)-1:]
+		}
+		entries := make([]interface{}, 0, len(changesets))
+		for _, c := range changesets {
+			if !full {
+				entries = append(entries, c.Node)
+				continue
+			}
+			branch, tags := c.Branch, c.Tags
+			if branch == "" {
+				branch = "default"
+			}
+			if tags == nil {
+				tags = []string{}
+			}
+			entries = append(entries, map[string]interface{}{
+				"node":   c.Node,
+				"branch": branch,
+				"author": c.Author,
+				"desc":   c.Desc,
+				"tags":   tags,
+			})
+		}
+		resp.Pushes[strconv.Itoa(push.ID)] = map[string]interface{}{
+			"changesets": entries,
+			"date":       push.Date,
+			"user":       push.User,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (p Push) has(node string) bool {
+	for _, c := range p.Changesets {
+		if c.Node == node {
+			return true
+		}
+	}
+	return false
+}
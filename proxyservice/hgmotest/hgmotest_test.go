@@ -0,0 +1,72 @@
+package hgmotest
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getJson(t *testing.T, url string, v interface{}) int {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	first := s.AddPush("ci/ci-admin", Push{User: "a@example.com", Date: 10, Changesets: []Changeset{{Node: "aa"}, {Node: "bb", Branch: "stable"}}})
+	second := s.AddPush("ci/ci-admin", Push{User: "b@example.com", Date: 20, Changesets: []Changeset{{Node: "cc"}}})
+	assert.Equal(t, 1, first.ID)
+	assert.Equal(t, 2, second.ID)
+
+	var pushes struct {
+		LastPushID int `json:"lastpushid"`
+		Pushes     map[string]struct {
+			Changesets []interface{} `json:"changesets"`
+			User       string        `json:"user"`
+		} `json:"pushes"`
+	}
+	assert.Equal(t, 200, getJson(t, s.RepoURL("ci/ci-admin")+"/json-pushes?version=2&startID=0&endID=1", &pushes))
+	assert.Equal(t, 2, pushes.LastPushID)
+	assert.Len(t, pushes.Pushes, 1)
+	assert.Equal(t, []interface{}{"aa", "bb"}, pushes.Pushes["1"].Changesets)
+
+	pushes.Pushes = nil
+	getJson(t, s.RepoURL("ci/ci-admin")+"/json-pushes?version=2&changeset=bb&full=1&tipsonly=1", &pushes)
+	assert.Equal(t, []interface{}{map[string]interface{}{
+		"node": "bb", "branch": "stable", "author": "", "desc": "", "tags": []interface{}{},
+	}}, pushes.Pushes["1"].Changesets)
+
+	assert.Equal(t, 404, getJson(t, s.RepoURL("ci/other")+"/json-pushes?version=2", &pushes))
+	assert.Equal(t, 400, getJson(t, s.RepoURL("ci/ci-admin")+"/json-pushes", &pushes))
+	s.SetStatus(503)
+	assert.Equal(t, 503, getJson(t, s.RepoURL("ci/ci-admin")+"/json-pushes?version=2", &pushes))
+	assert.Len(t, s.Requests(), 5)
+
+	var message struct {
+		Payload struct {
+			Type string `json:"type"`
+			Data struct {
+				Heads         []string `json:"heads"`
+				PushlogPushes []struct {
+					PushJsonUrl string `json:"push_json_url"`
+				} `json:"pushlog_pushes"`
+			} `json:"data"`
+		} `json:"payload"`
+	}
+	assert.NoError(t, json.Unmarshal(s.ChangegroupMessage("ci/ci-admin", 1), &message))
+	assert.Equal(t, "changegroup.1", message.Payload.Type)
+	assert.Equal(t, []string{"bb"}, message.Payload.Data.Heads)
+	assert.Equal(t, s.RepoURL("ci/ci-admin")+"/json-pushes?version=2&startID=0&endID=1", message.Payload.Data.PushlogPushes[0].PushJsonUrl)
+}
@@ -1,16 +1,44 @@
 package proxyservice
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/cookiejar"
 	"net/url"
 	"path"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 )
 
+var (
+	dockerhubNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_\-]{2,255}$`)
+	dockerhubTagRegexp  = regexp.MustCompile(`^[a-zA-Z0-9_\-\.]{1,100}$`)
+	hgRepoPathRegexp    = regexp.MustCompile("^([A-Za-z][A-Za-z0-9-]*)/([A-Za-z][A-Za-z0-9-]*)$")
+)
+
+// ValidateNamespace returns an error if nameSpace can not be mapped to a jenkins job
+func ValidateNamespace(nameSpace string) error {
+	if !dockerhubNameRegexp.MatchString(nameSpace) {
+		return fmt.Errorf("Invalid Docker Hub namespace: %s", nameSpace)
+	}
+	return nil
+}
+
+// ValidateHgRepoPath returns an error if repoPath can not be mapped to a jenkins job
+func ValidateHgRepoPath(repoPath string) error {
+	if !hgRepoPathRegexp.MatchString(repoPath) {
+		return fmt.Errorf("Invalid hg.mozilla.org repository path: %s", repoPath)
+	}
+	return nil
+}
+
 type JenkinsCrumbIssuer struct {
 	Crumb             string `json:"crumb"`
 	CrumbRequestField string `json:"crumbRequestField"`
@@ -19,73 +47,158 @@ type JenkinsCrumbIssuer struct {
 type JenkinsServer struct {
 	BaseURL string
 
-	User     string
-	Password string
+	Credentials *Credentials
+	// APIToken is set when Credentials holds an API token instead of a
+	// password, jenkins does not require crumbs for API token requests
+	APIToken bool
+
+	// Client keeps the session cookie the cached crumb is tied to
+	Client *http.Client
+	// Timeout bounds each TriggerJob call including crumb requests
+	Timeout time.Duration
+
+	crumbMu sync.Mutex
+	crumb   *JenkinsCrumbIssuer
 }
 
 type Jenkins interface {
-	TriggerJob(jobPath string, params url.Values) error
+	TriggerJob(ctx context.Context, jobPath string, params url.Values) error
 }
 
 // NewJenkins returns a new Jenkins instance
 func NewJenkins(baseURL, user, password string) Jenkins {
+	return NewJenkinsWithCredentials(baseURL, NewCredentials(user, password))
+}
+
+// NewJenkinsWithCredentials returns a new Jenkins instance
+// which uses the current value of credentials for each request
+func NewJenkinsWithCredentials(baseURL string, credentials *Credentials) Jenkins {
+	return NewJenkinsServer(baseURL, credentials)
+}
+
+// NewJenkinsWithAPIToken returns a new Jenkins instance authenticating
+// with a user and API token, which does not need crumbs
+func NewJenkinsWithAPIToken(baseURL string, credentials *Credentials) Jenkins {
+	j := NewJenkinsServer(baseURL, credentials)
+	j.APIToken = true
+	return j
+}
+
+// NewJenkinsServer returns a *JenkinsServer authenticating with a user and password
+func NewJenkinsServer(baseURL string, credentials *Credentials) *JenkinsServer {
+	jar, _ := cookiejar.New(nil) // never returns an error
 	return &JenkinsServer{
-		BaseURL:  baseURL,
-		User:     user,
-		Password: password,
+		BaseURL:     baseURL,
+		Credentials: credentials,
+		Client:      &http.Client{Jar: jar},
 	}
 }
 
 // NewRequest builds a authed jenkins request.
 // path must be the absolute path starting with "/"
-func (j *JenkinsServer) NewRequest(method, path string, body io.Reader) (*http.Request, error) {
+func (j *JenkinsServer) NewRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
 	url := j.BaseURL + path
-	req, err := http.NewRequest(method, url, body)
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return nil, err
 	}
-	req.SetBasicAuth(j.User, j.Password)
+	req.SetBasicAuth(j.Credentials.Get())
 	return req, nil
 }
 
-func (j *JenkinsServer) setCSRFToken(req *http.Request) error {
-	csrfReq, err := j.NewRequest("GET", "/crumbIssuer/api/json", nil)
+// getCrumb returns the cached crumb, requesting one if there is none
+func (j *JenkinsServer) getCrumb(ctx context.Context) (*JenkinsCrumbIssuer, error) {
+	j.crumbMu.Lock()
+	defer j.crumbMu.Unlock()
+	if j.crumb != nil {
+		return j.crumb, nil
+	}
+
+	csrfReq, err := j.NewRequest(ctx, "GET", "/crumbIssuer/api/json", nil)
 	if err != nil {
-		return fmt.Errorf("Error building csrf request: %v", err)
+		return nil, fmt.Errorf("Error building csrf request: %v", err)
 	}
 
-	resp, err := http.DefaultClient.Do(csrfReq)
+	resp, err := j.Client.Do(csrfReq)
 	if err != nil {
-		return fmt.Errorf("Error requesting csrf token: %v", err)
+		return nil, fmt.Errorf("Error requesting csrf token: %v", err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Jenkins returned %d for %s, expected 200", resp.StatusCode, csrfReq.URL)
+	}
 
 	crumb := new(JenkinsCrumbIssuer)
 	if err := json.NewDecoder(resp.Body).Decode(crumb); err != nil {
-		return fmt.Errorf("Could not decode err: %v", err)
+		return nil, fmt.Errorf("Could not decode err: %v", err)
 	}
+	j.crumb = crumb
+	return crumb, nil
+}
+
+// clearCrumb drops the cached crumb, e.g., after the session expired
+func (j *JenkinsServer) clearCrumb() {
+	j.crumbMu.Lock()
+	defer j.crumbMu.Unlock()
+	j.crumb = nil
+}
 
+func (j *JenkinsServer) setCSRFToken(req *http.Request) error {
+	crumb, err := j.getCrumb(req.Context())
+	if err != nil {
+		return err
+	}
 	req.Header.Set(crumb.CrumbRequestField, crumb.Crumb)
 	return nil
 }
 
 // PostForm posts a authed request to jenkins BaseURL + path
-func (j *JenkinsServer) PostForm(path string, data url.Values) (*http.Response, error) {
-	req, err := j.NewRequest("POST", path, strings.NewReader(data.Encode()))
+// The request is retried once with a new crumb if jenkins rejects the cached one.
+func (j *JenkinsServer) PostForm(ctx context.Context, path string, data url.Values) (*http.Response, error) {
+	resp, err := j.postForm(ctx, path, data)
+	if err != nil || j.APIToken || !isCrumbError(resp) {
+		return resp, err
+	}
+	resp.Body.Close()
+	j.clearCrumb()
+	return j.postForm(ctx, path, data)
+}
+
+func (j *JenkinsServer) postForm(ctx context.Context, path string, data url.Values) (*http.Response, error) {
+	req, err := j.NewRequest(ctx, "POST", path, strings.NewReader(data.Encode()))
 	if err != nil {
 		return nil, err
 	}
-	if err := j.setCSRFToken(req); err != nil {
-		return nil, fmt.Errorf("Could not set CSRF: %v", err)
+	if !j.APIToken {
+		if err := j.setCSRFToken(req); err != nil {
+			return nil, fmt.Errorf("Could not set CSRF: %v", err)
+		}
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	return http.DefaultClient.Do(req)
+	return j.Client.Do(req)
+}
+
+// isCrumbError returns true if resp is jenkins rejecting a crumb
+// resp.Body is left intact
+func isCrumbError(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusForbidden {
+		return false
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return err == nil && bytes.Contains(body, []byte("No valid crumb"))
 }
 
 // TriggerJob triggers a jenkins job
 // jobPath should be the full path to the job e.g., /job/pipelines/job/myjob/
-func (j *JenkinsServer) TriggerJob(jobPath string, params url.Values) error {
-	resp, err := j.PostForm(path.Join(jobPath, "buildWithParameters"), params)
+func (j *JenkinsServer) TriggerJob(ctx context.Context, jobPath string, params url.Values) error {
+	if j.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, j.Timeout)
+		defer cancel()
+	}
+	resp, err := j.PostForm(ctx, path.Join(jobPath, "buildWithParameters"), params)
 	if err != nil {
 		return fmt.Errorf("Error posting to jenkins: %v", err)
 	}
@@ -95,46 +208,3 @@ func (j *JenkinsServer) TriggerJob(jobPath string, params url.Values) error {
 	}
 	return nil
 }
-
-// TriggerDockerhubJob triggers a jenkins job
-// given DockerHubWebhookData
-func TriggerDockerhubJob(j Jenkins, data *DockerHubWebhookData) error {
-	if !regexp.MustCompile(`^[a-zA-Z0-9_\-]{2,255}$`).MatchString(data.Repository.Name) {
-		return fmt.Errorf("Invalid data.Repository.Name: %s", data.Repository.Name)
-	}
-	if !regexp.MustCompile(`^[a-zA-Z0-9_\-]{2,255}$`).MatchString(data.Repository.Namespace) {
-		return fmt.Errorf("Invalid data.Repository.Namespace: %s", data.Repository.Namespace)
-	}
-	if !regexp.MustCompile(`^[a-zA-Z0-9_\-\.]{1,100}$`).MatchString(data.PushData.Tag) {
-		return fmt.Errorf("Invalid data.PushData.Tag: %s", data.PushData.Tag)
-	}
-
-	rawJSON, err := json.Marshal(data)
-	if err != nil {
-		return fmt.Errorf("Error marshaling data: %v", err)
-	}
-	path := path.Join("/job/dockerhub/job",
-		data.Repository.Namespace, "job", data.Repository.Name)
-	params := url.Values{}
-	params.Set("Tag", data.PushData.Tag)
-	params.Set("RawJSON", string(rawJSON))
-	return j.TriggerJob(path, params)
-}
-
-func TriggerHgJob(j Jenkins, repoPath string, repoUrl string, head string, data *HgMessage) error {
-	matches := regexp.MustCompile("^([A-Za-z][A-Za-z0-9-]*)/([A-Za-z][A-Za-z0-9-]*)$").FindStringSubmatch(repoPath)
-	if len(matches) != 3 {
-		return fmt.Errorf("Invalid hg.mozilla.org repository path: %s", repoPath)
-	}
-
-	rawJSON, err := json.Marshal(data)
-	if err != nil {
-		return fmt.Errorf("Error marshaling data: %v", err)
-	}
-	path := path.Join("/job/hgmo/job", matches[1], "job", matches[2])
-	params := url.Values{}
-	params.Set("HEAD_REPOSITORY", repoUrl)
-	params.Set("HEAD_REV", head)
-	params.Set("RawJSON", string(rawJSON))
-	return j.TriggerJob(path, params)
-}
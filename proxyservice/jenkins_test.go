@@ -1,26 +1,86 @@
 package proxyservice
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"go.mozilla.org/cloudops-deployment-proxy/proxyservice/jenkinstest"
 )
 
-var fakeJenkinsFailing = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-	if req.URL.Path == "/crumbIssuer/api/json" {
-		w.Write([]byte(`{"crumb": "crmb", "crumbRequestField": "Jenkins-Crumb"}`))
-		return
+func TestJenkinsTriggerJob(t *testing.T) {
+	fake := jenkinstest.NewServer("fakeuser", "fakepass")
+	defer fake.Close()
+
+	jenkins := NewJenkins(fake.URL, "fakeuser", "fakepass")
+	params := url.Values{"Tag": {"v1.0.0"}, "RawJSON": {"{}"}}
+	assert.NoError(t, jenkins.TriggerJob(context.Background(), "/job/pipelines/job/myjob", params))
+	builds := fake.Builds()
+	if assert.Len(t, builds, 1) {
+		assert.Equal(t, "/job/pipelines/job/myjob", builds[0].Job)
+		assert.Equal(t, params, builds[0].Params)
 	}
-	w.WriteHeader(400)
-}))
 
-func TestJenkinsTriggerJob(t *testing.T) {
-	jenkins := NewJenkins(fakeJenkinsFailing.URL, "fakeuser", "fakepass")
-	err := jenkins.TriggerJob("/job/failingjob", url.Values{})
+	fake.Fail("/buildWithParameters", 400, 1)
+	err := jenkins.TriggerJob(context.Background(), "/job/failingjob", url.Values{})
 	assert.EqualError(t, err,
-		fmt.Sprintf("Jenkins returned 400 for %s/job/failingjob/buildWithParameters, expected 201", fakeJenkinsFailing.URL))
+		fmt.Sprintf("Jenkins returned 400 for %s/job/failingjob/buildWithParameters, expected 201", fake.URL))
+
+	jenkins = NewJenkins(fake.URL, "fakeuser", "wrongpass")
+	err = jenkins.TriggerJob(context.Background(), "/job/test", url.Values{})
+	assert.EqualError(t, err, "Error posting to jenkins: Could not set CSRF: "+
+		fmt.Sprintf("Jenkins returned 401 for %s/crumbIssuer/api/json, expected 200", fake.URL))
+	assert.Len(t, fake.Builds(), 1)
+}
+
+func TestJenkinsCrumbCache(t *testing.T) {
+	fake := jenkinstest.NewServer("fakeuser", "fakepass")
+	defer fake.Close()
+
+	jenkins := NewJenkins(fake.URL, "fakeuser", "fakepass")
+	assert.NoError(t, jenkins.TriggerJob(context.Background(), "/job/test", url.Values{}))
+	assert.NoError(t, jenkins.TriggerJob(context.Background(), "/job/test", url.Values{}))
+	assert.Equal(t, 1, fake.CrumbRequests())
+
+	fake.ExpireSessions()
+	assert.NoError(t, jenkins.TriggerJob(context.Background(), "/job/test", url.Values{}))
+	assert.Equal(t, 2, fake.CrumbRequests())
+	assert.Len(t, fake.Builds(), 3)
+}
+
+func TestJenkinsAPIToken(t *testing.T) {
+	fake := jenkinstest.NewServer("fakeuser", "fakepass")
+	fake.APIToken = "apitoken"
+	defer fake.Close()
+
+	jenkins := NewJenkinsWithAPIToken(fake.URL, NewCredentials("fakeuser", "apitoken"))
+	assert.NoError(t, jenkins.TriggerJob(context.Background(), "/job/test", url.Values{}))
+	assert.Equal(t, 0, fake.CrumbRequests())
+}
+
+func TestJenkinsTimeout(t *testing.T) {
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	}))
+	defer hung.Close()
+
+	jenkins := NewJenkinsServer(hung.URL, NewCredentials("fakeuser", "fakepass"))
+	jenkins.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	err := jenkins.TriggerJob(context.Background(), "/job/test", url.Values{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "context deadline exceeded")
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	// cancelling the caller's context also cancels the request
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	jenkins.Timeout = 0
+	err = jenkins.TriggerJob(ctx, "/job/test", url.Values{})
+	assert.Contains(t, err.Error(), "context canceled")
 }
@@ -0,0 +1,285 @@
+// Package jenkinstest provides a fake Jenkins server, so that code
+// triggering jenkins jobs can be tested without a Jenkins instance.
+package jenkinstest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Results of finished builds
+const (
+	Success = "SUCCESS"
+	Failure = "FAILURE"
+	Aborted = "ABORTED"
+)
+
+// CrumbRequestField is the header crumbs are expected in
+const CrumbRequestField = "Jenkins-Crumb"
+
+// Build is a job triggered on the server. It is queued until started.
+type Build struct {
+	// QueueID is the id of the queue item returned in the Location header
+	QueueID int `json:"queue_id"`
+	// Number is 0 while the build is queued
+	Number int `json:"number,omitempty"`
+	// Job is the path of the job, e.g., /job/pipelines/job/myjob
+	Job    string     `json:"job"`
+	Params url.Values `json:"params"`
+	// Result is empty until the build finished
+	Result string `json:"result,omitempty"`
+}
+
+// Building returns true if b started and has not finished
+func (b Build) Building() bool {
+	return b.Number > 0 && b.Result == ""
+}
+
+type failure struct {
+	suffix string
+	status int
+	count  int
+}
+
+// Server answers buildWithParameters, crumb, queue item and build requests
+// like Jenkins does. Requests must authenticate with User and Password,
+// or with APIToken, which does not need a crumb. Crumbs are tied to the
+// session cookie set with them.
+type Server struct {
+	*httptest.Server
+
+	User     string
+	Password string
+	// APIToken is accepted instead of Password when set
+	APIToken string
+	// AutoResult finishes triggered builds immediately with this result when set
+	AutoResult string
+
+	mu            sync.Mutex
+	sessions      map[string]string
+	crumbRequests int
+	builds        []*Build
+	lastNumber    map[string]int
+	failures      []*failure
+}
+
+// NewServer starts a Server accepting user and password,
+// which must be closed by the caller
+func NewServer(user, password string) *Server {
+	s := &Server{
+		User:       user,
+		Password:   password,
+		sessions:   make(map[string]string),
+		lastNumber: make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Builds returns copies of the builds triggered on s, in order
+func (s *Server) Builds() []Build {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	builds := make([]Build, 0, len(s.builds))
+	for _, b := range s.builds {
+		build := *b
+		build.Params = url.Values{}
+		for key, values := range b.Params {
+			build.Params[key] = append([]string(nil), values...)
+		}
+		builds = append(builds, build)
+	}
+	return builds
+}
+
+// CrumbRequests returns the number of crumbs issued by s
+func (s *Server) CrumbRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.crumbRequests
+}
+
+// ExpireSessions invalidates the crumbs issued so far
+func (s *Server) ExpireSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = make(map[string]string)
+}
+
+// Fail makes the next count requests whose path ends with suffix fail with status
+func (s *Server) Fail(suffix string, status, count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, &failure{suffix: suffix, status: status, count: count})
+}
+
+// Start leaves the queue with the build of queue item queueID and returns its number
+func (s *Server) Start(queueID int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.build(queueID)
+	s.start(b)
+	return b.Number
+}
+
+// Finish sets the result of the build of queue item queueID, starting it if needed
+func (s *Server) Finish(queueID int, result string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.build(queueID)
+	s.start(b)
+	b.Result = result
+}
+
+func (s *Server) build(queueID int) *Build {
+	if queueID < 1 || queueID > len(s.builds) {
+		panic(fmt.Sprintf("jenkinstest: no queue item %d", queueID))
+	}
+	return s.builds[queueID-1]
+}
+
+func (s *Server) start(b *Build) {
+	if b.Number == 0 {
+		s.lastNumber[b.Job]++
+		b.Number = s.lastNumber[b.Job]
+	}
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, f := range s.failures {
+		if f.count > 0 && strings.HasSuffix(req.URL.Path, f.suffix) {
+			f.count--
+			http.Error(w, http.StatusText(f.status), f.status)
+			return
+		}
+	}
+
+	user, password, ok := req.BasicAuth()
+	apiToken := s.APIToken != "" && password == s.APIToken
+	if !ok || user != s.User || (password != s.Password && !apiToken) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Jenkins"`)
+		http.Error(w, "Invalid password/token for user", http.StatusUnauthorized)
+		return
+	}
+
+	p := strings.TrimSuffix(req.URL.Path, "/")
+	switch {
+	case p == "/crumbIssuer/api/json" && req.Method == "GET":
+		s.serveCrumb(w)
+	case strings.HasSuffix(p, "/buildWithParameters") && req.Method == "POST":
+		if !apiToken && !s.validCrumb(req) {
+			http.Error(w, "No valid crumb was included in the request", http.StatusForbidden)
+			return
+		}
+		s.serveTrigger(w, req, strings.TrimSuffix(p, "/buildWithParameters"))
+	case strings.HasPrefix(p, "/queue/item/") && strings.HasSuffix(p, "/api/json") && req.Method == "GET":
+		s.serveQueueItem(w, req, strings.TrimSuffix(strings.TrimPrefix(p, "/queue/item/"), "/api/json"))
+	case strings.HasSuffix(p, "/api/json") && req.Method == "GET":
+		s.serveBuild(w, req, strings.TrimSuffix(p, "/api/json"))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (s *Server) serveCrumb(w http.ResponseWriter) {
+	s.crumbRequests++
+	session := fmt.Sprintf("session%d", s.crumbRequests)
+	s.sessions[session] = fmt.Sprintf("crumb%d", s.crumbRequests)
+	http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: session, Path: "/"})
+	writeJson(w, map[string]string{
+		"crumb":             s.sessions[session],
+		"crumbRequestField": CrumbRequestField,
+	})
+}
+
+func (s *Server) validCrumb(req *http.Request) bool {
+	cookie, err := req.Cookie("JSESSIONID")
+	if err != nil {
+		return false
+	}
+	crumb, ok := s.sessions[cookie.Value]
+	return ok && crumb == req.Header.Get(CrumbRequestField)
+}
+
+func (s *Server) serveTrigger(w http.ResponseWriter, req *http.Request, job string) {
+	if !strings.HasPrefix(job, "/job/") {
+		http.NotFound(w, req)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b := &Build{QueueID: len(s.builds) + 1, Job: job, Params: req.PostForm}
+	s.builds = append(s.builds, b)
+	if s.AutoResult != "" {
+		s.start(b)
+		b.Result = s.AutoResult
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s/queue/item/%d/", s.URL, b.QueueID))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) serveQueueItem(w http.ResponseWriter, req *http.Request, id string) {
+	queueID, err := strconv.Atoi(id)
+	if err != nil || queueID < 1 || queueID > len(s.builds) {
+		http.NotFound(w, req)
+		return
+	}
+	b := s.builds[queueID-1]
+	item := map[string]interface{}{
+		"id":         b.QueueID,
+		"task":       map[string]string{"url": s.URL + b.Job + "/"},
+		"why":        "Waiting for next available executor",
+		"executable": nil,
+	}
+	if b.Number > 0 {
+		item["why"] = nil
+		item["executable"] = map[string]interface{}{
+			"number": b.Number,
+			"url":    fmt.Sprintf("%s%s/%d/", s.URL, b.Job, b.Number),
+		}
+	}
+	writeJson(w, item)
+}
+
+func (s *Server) serveBuild(w http.ResponseWriter, req *http.Request, p string) {
+	i := strings.LastIndex(p, "/")
+	number, err := strconv.Atoi(p[i+1:])
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	job := p[:i]
+	for _, b := range s.builds {
+		if b.Job != job || b.Number != number {
+			continue
+		}
+		var result interface{}
+		if b.Result != "" {
+			result = b.Result
+		}
+		writeJson(w, map[string]interface{}{
+			"number":   b.Number,
+			"building": b.Building(),
+			"result":   result,
+			"url":      fmt.Sprintf("%s%s/%d/", s.URL, b.Job, b.Number),
+		})
+		return
+	}
+	http.NotFound(w, req)
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
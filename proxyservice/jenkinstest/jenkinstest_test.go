@@ -0,0 +1,113 @@
+package jenkinstest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func get(t *testing.T, url string, v interface{}) int {
+	req, _ := http.NewRequest("GET", url, nil)
+	req.SetBasicAuth("user", "pass")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func trigger(t *testing.T, s *Server, job string, params url.Values) *http.Response {
+	var crumb struct {
+		Crumb             string `json:"crumb"`
+		CrumbRequestField string `json:"crumbRequestField"`
+	}
+	req, _ := http.NewRequest("GET", s.URL+"/crumbIssuer/api/json", nil)
+	req.SetBasicAuth("user", "pass")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	json.NewDecoder(resp.Body).Decode(&crumb)
+
+	req, _ = http.NewRequest("POST", s.URL+job+"/buildWithParameters", strings.NewReader(params.Encode()))
+	req.SetBasicAuth("user", "pass")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(crumb.CrumbRequestField, crumb.Crumb)
+	for _, cookie := range resp.Cookies() {
+		req.AddCookie(cookie)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer("user", "pass")
+	defer s.Close()
+
+	resp := trigger(t, s, "/job/a/job/b", url.Values{"Tag": {"v1"}})
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, s.URL+"/queue/item/1/", resp.Header.Get("Location"))
+	assert.Equal(t, []Build{{QueueID: 1, Job: "/job/a/job/b", Params: url.Values{"Tag": {"v1"}}}}, s.Builds())
+
+	var item struct {
+		Executable *struct {
+			Number int    `json:"number"`
+			URL    string `json:"url"`
+		} `json:"executable"`
+	}
+	assert.Equal(t, 200, get(t, s.URL+"/queue/item/1/api/json", &item))
+	assert.Nil(t, item.Executable)
+
+	assert.Equal(t, 1, s.Start(1))
+	assert.Equal(t, 200, get(t, s.URL+"/queue/item/1/api/json", &item))
+	assert.Equal(t, s.URL+"/job/a/job/b/1/", item.Executable.URL)
+
+	var build struct {
+		Building bool    `json:"building"`
+		Result   *string `json:"result"`
+	}
+	assert.Equal(t, 200, get(t, item.Executable.URL+"api/json", &build))
+	assert.True(t, build.Building)
+	assert.Nil(t, build.Result)
+
+	s.Finish(1, Failure)
+	assert.Equal(t, 200, get(t, item.Executable.URL+"api/json", &build))
+	assert.False(t, build.Building)
+	assert.Equal(t, Failure, *build.Result)
+
+	s.AutoResult = Success
+	trigger(t, s, "/job/a/job/b", url.Values{})
+	assert.Equal(t, Build{QueueID: 2, Number: 2, Job: "/job/a/job/b", Params: url.Values{}, Result: Success}, s.Builds()[1])
+
+	s.Fail("/buildWithParameters", 500, 1)
+	assert.Equal(t, 500, trigger(t, s, "/job/a/job/b", url.Values{}).StatusCode)
+	assert.Equal(t, 201, trigger(t, s, "/job/a/job/b", url.Values{}).StatusCode)
+
+	s.ExpireSessions()
+	req, _ := http.NewRequest("POST", s.URL+"/job/a/job/b/buildWithParameters", nil)
+	req.SetBasicAuth("user", "pass")
+	resp, _ = http.DefaultClient.Do(req)
+	assert.Equal(t, 403, resp.StatusCode)
+	assert.Equal(t, 404, get(t, s.URL+"/queue/item/9/api/json", &item))
+
+	req, _ = http.NewRequest("GET", s.URL+"/crumbIssuer/api/json", nil)
+	req.SetBasicAuth("user", "wrong")
+	resp, _ = http.DefaultClient.Do(req)
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Equal(t, 4, s.CrumbRequests())
+}
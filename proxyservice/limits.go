@@ -0,0 +1,139 @@
+package proxyservice
+
+import (
+	"bytes"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Metrics counts requests rejected by limits, it is published with expvar
+var Metrics = expvar.NewMap("deployment_proxy")
+
+// Metric names
+const (
+	MetricBodyTooLarge      = "body_too_large"
+	MetricClientRateLimited = "client_rate_limited"
+	MetricRepoRateLimited   = "repo_rate_limited"
+)
+
+// RateLimiter keeps a token bucket per key, e.g., per client address
+type RateLimiter struct {
+	// Rate is how many tokens are added per second
+	Rate float64
+	// Burst is the size of each bucket
+	Burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// NewRateLimiter returns a RateLimiter allowing rate requests per second
+// with bursts of up to burst requests per key
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		Rate:    rate,
+		Burst:   burst,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow takes a token for key. If none is left it returns false
+// and how long it will be until one is available.
+func (r *RateLimiter) Allow(key string) (bool, time.Duration) {
+	return r.allow(key, time.Now())
+}
+
+func (r *RateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sweep(now)
+
+	bucket, ok := r.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(r.Burst), updated: now}
+		r.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(r.Burst), bucket.tokens+now.Sub(bucket.updated).Seconds()*r.Rate)
+	bucket.updated = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - bucket.tokens) / r.Rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep drops buckets which have refilled, at most once a minute
+func (r *RateLimiter) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < time.Minute {
+		return
+	}
+	r.lastSweep = now
+	for key, bucket := range r.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*r.Rate >= float64(r.Burst) {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// tooManyRequests responds with 429 and Retry-After rounded up to seconds
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+}
+
+// Middleware rejects clients, as resolved by ClientIP.Middleware,
+// which ran out of tokens
+func (r *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clientIP := RequestClientIP(req)
+		if ok, retryAfter := r.Allow(clientIP); !ok {
+			log.Printf("Rate limited %s from %s", req.URL.Path, clientIP)
+			Metrics.Add(MetricClientRateLimited, 1)
+			tooManyRequests(w, retryAfter)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// BodyLimit rejects requests with bodies larger than maxBytes with 413
+func BodyLimit(maxBytes int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ContentLength > maxBytes {
+			bodyTooLarge(w, req)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBytes+1))
+		if err != nil {
+			log.Printf("Error reading request body: %v", err)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if int64(len(body)) > maxBytes {
+			bodyTooLarge(w, req)
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, req)
+	})
+}
+
+func bodyTooLarge(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Rejected %s from %s, body too large", req.URL.Path, RequestClientIP(req))
+	Metrics.Add(MetricBodyTooLarge, 1)
+	http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+}
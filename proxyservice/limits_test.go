@@ -0,0 +1,125 @@
+package proxyservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(0.5, 2)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		ok, _ := limiter.allow("a", now)
+		assert.True(t, ok)
+	}
+	ok, retryAfter := limiter.allow("a", now)
+	assert.False(t, ok)
+	assert.Equal(t, 2*time.Second, retryAfter)
+
+	// keys have their own buckets
+	ok, _ = limiter.allow("b", now)
+	assert.True(t, ok)
+
+	ok, retryAfter = limiter.allow("a", now.Add(time.Second))
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, retryAfter)
+	ok, _ = limiter.allow("a", now.Add(2*time.Second))
+	assert.True(t, ok)
+
+	// full buckets are dropped
+	limiter.allow("c", now.Add(time.Hour))
+	assert.Len(t, limiter.buckets, 1)
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	before := metricValue(Metrics.Get(MetricClientRateLimited))
+	handler := NewRateLimiter(0.1, 1).Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	send := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "http://test/dockerhub", nil)
+		req.RemoteAddr = remoteAddr
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	assert.Equal(t, http.StatusOK, send("198.51.100.1:1000").Code)
+	resp := send("198.51.100.1:1001")
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.Equal(t, "10", resp.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, send("198.51.100.2:1000").Code)
+	assert.Equal(t, before+1, metricValue(Metrics.Get(MetricClientRateLimited)))
+}
+
+// metricValue returns the count of metric, 0 if it was never added to
+func metricValue(metric expvar.Var) int64 {
+	if metric == nil {
+		return 0
+	}
+	return metric.(*expvar.Int).Value()
+}
+
+func TestBodyLimit(t *testing.T) {
+	var received []byte
+	handler := BodyLimit(8, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received, _ = ioutil.ReadAll(req.Body)
+		w.Write([]byte("OK"))
+	}))
+
+	resp := sendRequest("POST", "http://test/dockerhub", strings.NewReader("12345678"), handler)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "12345678", string(received))
+
+	received = nil
+	resp = sendRequest("POST", "http://test/dockerhub", strings.NewReader("123456789"), handler)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.Code)
+	assert.Nil(t, received)
+
+	// bodies without a content length are limited too
+	req := httptest.NewRequest("POST", "http://test/dockerhub", ioutil.NopCloser(strings.NewReader("123456789")))
+	req.ContentLength = -1
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+}
+
+func TestDockerHubHandlerRepoLimit(t *testing.T) {
+	jenkins := NewFakeJenkins()
+	events := NewMemoryEventStore(10)
+	handler := NewDockerHubWebhookHandler(false, NewJenkinsDeployer(jenkins), "mozilla")
+	handler.RepoLimiter = NewRateLimiter(1.0/60, 1)
+	handler.Events = events
+	before := metricValue(Metrics.Get(MetricRepoRateLimited))
+
+	data := baseDockerHubWebhookData()
+	for _, test := range []struct {
+		name   string
+		status int
+	}{
+		{"testrepo", http.StatusOK},
+		{"testrepo", http.StatusTooManyRequests},
+		{"otherrepo", http.StatusOK},
+	} {
+		setDockerHubRepoName(data, test.name)
+		dataBytes, err := json.Marshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := sendRequest("POST", "http://test/dockerhub", bytes.NewReader(dataBytes), handler)
+		assert.Equal(t, test.status, resp.Code, test.name)
+	}
+	assert.Len(t, jenkins.Jobs, 2)
+	assert.Equal(t, "Rate limited", events.events[1].Reason)
+	assert.Equal(t, before+1, metricValue(Metrics.Get(MetricRepoRateLimited)))
+}
@@ -0,0 +1,322 @@
+package proxyservice
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Binding routes the messages of Exchange whose routing key matches
+// the RoutingKey pattern to a queue, * matches a word and # any words
+type Binding struct {
+	Exchange   string
+	RoutingKey string
+}
+
+// Acknowledger acknowledges deliveries with the MessageSource they came from
+type Acknowledger interface {
+	Ack() error
+	// Nack rejects the delivery, which is redelivered if requeue is true
+	Nack(requeue bool) error
+}
+
+// Delivery is a message received from a MessageSource
+type Delivery struct {
+	Exchange   string
+	RoutingKey string
+	// Headers holds e.g., the CC routing keys of taskcluster messages
+	Headers     map[string]interface{}
+	Body        []byte
+	Redelivered bool
+
+	Acknowledger Acknowledger
+}
+
+var errNotAcknowledgeable = errors.New("Delivery has no acknowledger")
+
+// Ack acknowledges d
+func (d *Delivery) Ack() error {
+	if d.Acknowledger == nil {
+		return errNotAcknowledgeable
+	}
+	return d.Acknowledger.Ack()
+}
+
+// Nack rejects d, requeuing it if requeue is true
+func (d *Delivery) Nack(requeue bool) error {
+	if d.Acknowledger == nil {
+		return errNotAcknowledgeable
+	}
+	return d.Acknowledger.Nack(requeue)
+}
+
+// MessageSource delivers the messages of pulse queues, e.g., pulse-go,
+// a native AMQP client or memory for tests
+type MessageSource interface {
+	// Subscribe declares the pulse queue name, binds it and calls handle with
+	// its messages one at a time, handle must ack or nack each delivery
+	Subscribe(name string, bindings []Binding, handle func(*Delivery)) (Subscription, error)
+	// Reconnect replaces the connection of the source, ending its
+	// subscriptions, and keeps the old one if the new one fails
+	Reconnect() error
+}
+
+// Subscription is a queue consumed from a MessageSource
+type Subscription interface {
+	// Bind and Unbind change the bindings of the queue while it is consumed
+	Bind(binding Binding) error
+	Unbind(binding Binding) error
+	// Done is sent an error when the subscription ends other than by Close,
+	// e.g., when its connection dropped
+	Done() <-chan error
+	// Close stops consuming, unacknowledged messages are redelivered
+	Close() error
+}
+
+// MemorySource is a MessageSource holding its queues in memory, messages
+// are added with Publish. Queues and their messages survive reconnects.
+type MemorySource struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queues map[string]*memoryQueue
+}
+
+type memoryQueue struct {
+	bindings []Binding
+	ready    []*Delivery
+	subs     []*memorySubscription
+	acked    int
+	nacked   int
+}
+
+type memorySubscription struct {
+	source *MemorySource
+	queue  *memoryQueue
+	handle func(*Delivery)
+	done   chan error
+	ended  bool
+	// unacked is the delivery being handled
+	unacked *Delivery
+}
+
+type memoryAcknowledger struct {
+	sub      *memorySubscription
+	delivery *Delivery
+}
+
+func NewMemorySource() *MemorySource {
+	s := &MemorySource{queues: make(map[string]*memoryQueue)}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// Publish adds a message to the queues with a binding matching its routing
+// key or, like rabbitmq, one of the CC routing keys of headers. It returns
+// the number of queues the message was added to.
+func (s *MemorySource) Publish(exchange, routingKey string, body []byte, headers map[string]interface{}) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := routingKeys(&Delivery{RoutingKey: routingKey, Headers: headers})
+	routed := 0
+	for _, q := range s.queues {
+	bindings:
+		for _, binding := range q.bindings {
+			if binding.Exchange != exchange {
+				continue
+			}
+			for _, key := range keys {
+				if MatchRoutingKey(binding.RoutingKey, key) {
+					q.ready = append(q.ready, &Delivery{
+						Exchange:   exchange,
+						RoutingKey: routingKey,
+						Headers:    headers,
+						Body:       body,
+					})
+					routed++
+					break bindings
+				}
+			}
+		}
+	}
+	s.cond.Broadcast()
+	return routed
+}
+
+// Bindings returns the bindings of queue name
+func (s *MemorySource) Bindings(name string) []Binding {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if q, ok := s.queues[name]; ok {
+		return append([]Binding(nil), q.bindings...)
+	}
+	return nil
+}
+
+// Counts returns the number of messages of queue name waiting to be
+// delivered, and the number of acks and nacks it received
+func (s *MemorySource) Counts(name string) (ready, acked, nacked int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if q, ok := s.queues[name]; ok {
+		return len(q.ready), q.acked, q.nacked
+	}
+	return 0, 0, 0
+}
+
+// Drop ends the subscriptions like a dropped connection
+func (s *MemorySource) Drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.endAll(fmt.Errorf("Connection dropped"))
+}
+
+// Reconnect ends the subscriptions, the queues are kept
+func (s *MemorySource) Reconnect() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.endAll(fmt.Errorf("Reconnected"))
+	return nil
+}
+
+// endAll ends every subscription with err, s.mu must be held
+func (s *MemorySource) endAll(err error) {
+	for _, q := range s.queues {
+		for _, sub := range q.subs {
+			sub.end(err)
+		}
+	}
+}
+
+func (s *MemorySource) Subscribe(name string, bindings []Binding, handle func(*Delivery)) (Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.queues[name]
+	if !ok {
+		q = &memoryQueue{}
+		s.queues[name] = q
+	}
+	sub := &memorySubscription{source: s, queue: q, handle: handle, done: make(chan error, 1)}
+	q.subs = append(q.subs, sub)
+	for _, binding := range bindings {
+		q.bind(binding)
+	}
+	go sub.run()
+	return sub, nil
+}
+
+func (q *memoryQueue) bind(binding Binding) {
+	q.unbind(binding)
+	q.bindings = append(q.bindings, binding)
+}
+
+func (q *memoryQueue) unbind(binding Binding) {
+	bindings := make([]Binding, 0, len(q.bindings))
+	for _, existing := range q.bindings {
+		if existing != binding {
+			bindings = append(bindings, existing)
+		}
+	}
+	q.bindings = bindings
+}
+
+// run delivers messages one at a time until sub ends
+func (sub *memorySubscription) run() {
+	s := sub.source
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		for !sub.ended && (sub.unacked != nil || len(sub.queue.ready) == 0) {
+			s.cond.Wait()
+		}
+		if sub.ended {
+			return
+		}
+		d := sub.queue.ready[0]
+		sub.queue.ready = sub.queue.ready[1:]
+		delivery := *d
+		delivery.Acknowledger = &memoryAcknowledger{sub: sub, delivery: d}
+		sub.unacked = d
+		s.mu.Unlock()
+		sub.handle(&delivery)
+		s.mu.Lock()
+	}
+}
+
+// end requeues the unacked delivery and sends err to Done
+// unless err is nil, s.mu must be held
+func (sub *memorySubscription) end(err error) {
+	if sub.ended {
+		return
+	}
+	sub.ended = true
+	if sub.unacked != nil {
+		sub.unacked.Redelivered = true
+		sub.queue.ready = append([]*Delivery{sub.unacked}, sub.queue.ready...)
+		sub.unacked = nil
+	}
+	subs := make([]*memorySubscription, 0, len(sub.queue.subs))
+	for _, other := range sub.queue.subs {
+		if other != sub {
+			subs = append(subs, other)
+		}
+	}
+	sub.queue.subs = subs
+	if err != nil {
+		sub.done <- err
+	}
+	sub.source.cond.Broadcast()
+}
+
+func (sub *memorySubscription) Bind(binding Binding) error {
+	sub.source.mu.Lock()
+	defer sub.source.mu.Unlock()
+	sub.queue.bind(binding)
+	return nil
+}
+
+func (sub *memorySubscription) Unbind(binding Binding) error {
+	sub.source.mu.Lock()
+	defer sub.source.mu.Unlock()
+	sub.queue.unbind(binding)
+	return nil
+}
+
+func (sub *memorySubscription) Done() <-chan error {
+	return sub.done
+}
+
+func (sub *memorySubscription) Close() error {
+	sub.source.mu.Lock()
+	defer sub.source.mu.Unlock()
+	sub.end(nil)
+	return nil
+}
+
+func (a *memoryAcknowledger) settle(requeue, ack bool) error {
+	s := a.sub.source
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a.sub.unacked != a.delivery {
+		return fmt.Errorf("Delivery was already acknowledged or its subscription ended")
+	}
+	a.sub.unacked = nil
+	if ack {
+		a.sub.queue.acked++
+	} else {
+		a.sub.queue.nacked++
+		if requeue {
+			a.delivery.Redelivered = true
+			a.sub.queue.ready = append([]*Delivery{a.delivery}, a.sub.queue.ready...)
+		}
+	}
+	s.cond.Broadcast()
+	return nil
+}
+
+func (a *memoryAcknowledger) Ack() error {
+	return a.settle(false, true)
+}
+
+func (a *memoryAcknowledger) Nack(requeue bool) error {
+	return a.settle(requeue, false)
+}
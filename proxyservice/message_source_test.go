@@ -0,0 +1,109 @@
+package proxyservice
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mozilla.org/cloudops-deployment-proxy/proxyservice/jenkinstest"
+)
+
+func TestMemorySource(t *testing.T) {
+	source := NewMemorySource()
+	deliveries := make(chan *Delivery)
+	sub, err := source.Subscribe("test", []Binding{{Exchange: "exchange/a", RoutingKey: "a.#"}}, func(d *Delivery) {
+		deliveries <- d
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, source.Publish("exchange/a", "a.b", []byte("1"), map[string]interface{}{"CC": []interface{}{"route.x"}}))
+	assert.Equal(t, 0, source.Publish("exchange/b", "a.b", []byte("x"), nil))
+	source.Publish("exchange/a", "a.c", []byte("2"), nil)
+	d := <-deliveries
+	assert.Equal(t, "a.b", d.RoutingKey)
+	assert.Equal(t, []string{"a.b", "route.x"}, routingKeys(d))
+
+	// the next message waits for the ack
+	ready, _, _ := source.Counts("test")
+	assert.Equal(t, 1, ready)
+	assert.NoError(t, d.Nack(true))
+	d = <-deliveries
+	assert.Equal(t, "1", string(d.Body))
+	assert.True(t, d.Redelivered)
+	assert.NoError(t, d.Ack())
+	assert.Error(t, d.Ack())
+	d = <-deliveries
+	assert.Equal(t, "2", string(d.Body))
+
+	// dropping the connection requeues the unacked message
+	source.Drop()
+	assert.Error(t, <-sub.Done())
+	assert.Error(t, d.Ack())
+	ready, acked, nacked := source.Counts("test")
+	assert.Equal(t, []int{1, 1, 1}, []int{ready, acked, nacked})
+
+	sub, _ = source.Subscribe("test", nil, func(d *Delivery) { deliveries <- d })
+	assert.NoError(t, sub.Bind(Binding{Exchange: "exchange/b", RoutingKey: "b"}))
+	assert.NoError(t, sub.Unbind(Binding{Exchange: "exchange/a", RoutingKey: "a.#"}))
+	assert.Equal(t, []Binding{{Exchange: "exchange/b", RoutingKey: "b"}}, source.Bindings("test"))
+	d = <-deliveries
+	assert.Equal(t, "2", string(d.Body))
+	assert.NoError(t, sub.Close())
+	select {
+	case err := <-sub.Done():
+		t.Errorf("Closed subscription sent %v", err)
+	default:
+	}
+
+	assert.Error(t, new(Delivery).Ack())
+}
+
+func TestMemorySourceHandlers(t *testing.T) {
+	jenkins := jenkinstest.NewServer("jenkins", "jenkins")
+	defer jenkins.Close()
+	deployer := NewJenkinsDeployer(NewJenkins(jenkins.URL, "jenkins", "jenkins"))
+
+	// handlers have their own connection, reconnecting one source
+	// ends all of its subscriptions
+	tcSource := NewMemorySource()
+	taskcluster := NewTaskclusterPulseHandler(deployer, nil, tcSource, "taskcluster")
+	taskcluster.Config = NewConfigStore(&Config{
+		TaskclusterBindings: []*TaskclusterBinding{{RoutingKey: "route.index.project.#", Repo: "mozilla/myapp"}},
+	})
+	assert.NoError(t, taskcluster.Consume())
+	assert.Equal(t, []Binding{{Exchange: taskCompletedExchange, RoutingKey: "route.index.project.#"}}, tcSource.Bindings("taskcluster"))
+
+	subscriptions := NewPulseSubscriptionHandler(deployer, NewConfigStore(&Config{
+		PulseSubscriptions: []*PulseSubscription{{
+			Name:       "builds",
+			Exchange:   "exchange/builds/v1/completed",
+			RoutingKey: "#",
+			Fields:     map[string]string{"repo": "$.repo", "ref": "$.ref"},
+		}},
+	}))
+	source := NewMemorySource()
+	assert.NoError(t, subscriptions.Consume(func() MessageSource { return source }))
+	queue := subscriptions.Config.Get().PulseSubscriptions[0].QueueName()
+	assert.Equal(t, []Binding{{Exchange: "exchange/builds/v1/completed", RoutingKey: "#"}}, source.Bindings(queue))
+
+	// messages which can't be decoded are acknowledged and ignored
+	tcSource.Publish(taskCompletedExchange, "primary.x", []byte("not json"), map[string]interface{}{"CC": []interface{}{"route.index.project.x"}})
+	source.Publish("exchange/builds/v1/completed", "any", []byte(`{"repo": "mozilla/builds", "ref": "v1"}`), nil)
+	waitFor(t, "messages to be acked", func() bool {
+		_, tcAcked, _ := tcSource.Counts("taskcluster")
+		_, subAcked, _ := source.Counts(queue)
+		return tcAcked == 1 && subAcked == 1
+	})
+	builds := jenkins.Builds()
+	if assert.Len(t, builds, 1) {
+		assert.Equal(t, "/job/builds/job/mozilla/job/builds", builds[0].Job)
+	}
+
+	// consumers resubscribe when the connection drops
+	assert.NoError(t, subscriptions.Reconnect())
+	source.Drop()
+	source.Publish("exchange/builds/v1/completed", "any", []byte(`{"repo": "mozilla/builds", "ref": "v2"}`), nil)
+	waitFor(t, "message to be acked after resubscribing", func() bool {
+		_, acked, _ := source.Counts(queue)
+		return acked == 2
+	})
+}
@@ -0,0 +1,254 @@
+package proxyservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/taskcluster/pulse-go/pulse"
+)
+
+// pulseConsumer consumes a pulse queue one message at a time and
+// resubscribes when the subscription ends. Handlers set bindings and handle.
+type pulseConsumer struct {
+	Source    MessageSource
+	QueueName string
+
+	// bindings returns the bindings of the queue when (re)subscribing
+	bindings func() []Binding
+	// handle must acknowledge delivery
+	handle func(delivery *Delivery)
+
+	// mu is held while a message is processed and while reconnecting
+	mu sync.Mutex
+	// generation is incremented for each new subscription
+	generation   int
+	subscription Subscription
+}
+
+// consume subscribes to the queue on c.Source, c.mu must be held
+func (c *pulseConsumer) consume() error {
+	c.generation++
+	generation := c.generation
+
+	subscription, err := c.Source.Subscribe(
+		c.QueueName,
+		c.bindings(),
+		func(delivery *Delivery) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			// deliveries from a replaced subscription can't be
+			// acknowledged and are redelivered to the new one
+			if generation != c.generation {
+				return
+			}
+			c.handle(delivery)
+		},
+	)
+	if err != nil {
+		return err
+	}
+	c.subscription = subscription
+	go c.reconnectOnClose(generation, subscription.Done())
+	return nil
+}
+
+// reconnectOnClose waits for the subscription of a consumer to end
+// and reconnects unless the consumer has already been replaced
+func (c *pulseConsumer) reconnectOnClose(generation int, done <-chan error) {
+	closeErr := <-done
+	for {
+		c.mu.Lock()
+		if generation != c.generation {
+			c.mu.Unlock()
+			return
+		}
+		log.Printf("Pulse connection closed: %v, reconnecting", closeErr)
+		err := c.reconnect()
+		generation = c.generation
+		c.mu.Unlock()
+		if err == nil {
+			return
+		}
+		log.Printf("Error reconnecting to pulse: %v", err)
+		time.Sleep(pulseReconnectDelay)
+	}
+}
+
+var pulseReconnectDelay = 10 * time.Second
+
+// Reconnect replaces the pulse connection using the current credentials,
+// e.g., after they were rotated. It waits for the message being processed
+// to be acknowledged and keeps the old connection if the new one fails.
+func (c *pulseConsumer) Reconnect() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reconnect()
+}
+
+func (c *pulseConsumer) reconnect() error {
+	if err := c.Source.Reconnect(); err != nil {
+		return err
+	}
+	return c.consume()
+}
+
+// PulseSource is a MessageSource using pulse-go
+type PulseSource struct {
+	Pulse *pulse.Connection
+	// Credentials are used when reconnecting to pulse when set
+	Credentials *Credentials
+
+	mu sync.Mutex
+}
+
+func NewPulseSource(conn *pulse.Connection, credentials *Credentials) *PulseSource {
+	return &PulseSource{Pulse: conn, Credentials: credentials}
+}
+
+// Subscribe consumes name with pulse-go, which only knows how to decode
+// messages from the exchanges of bindings
+func (s *PulseSource) Subscribe(name string, bindings []Binding, handle func(*Delivery)) (Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pulseBindings := make([]pulse.Binding, 0, len(bindings))
+	for _, binding := range bindings {
+		pulseBindings = append(pulseBindings, pulse.Bind(binding.RoutingKey, binding.Exchange))
+	}
+	_, err := s.Pulse.Consume(
+		name,
+		func(message interface{}, delivery amqp.Delivery) {
+			handle(newPulseDelivery(delivery))
+		},
+		1,     // prefetch 1 message at a time
+		false, // don't autoacknowledge messages
+		pulseBindings...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return newPulseSubscription(s.Pulse.AMQPConn, "queue/"+s.Pulse.User+"/"+name), nil
+}
+
+// Reconnect replaces s.Pulse with a connection using the current credentials
+func (s *PulseSource) Reconnect() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, password := s.Pulse.User, s.Pulse.Password
+	if s.Credentials != nil {
+		user, password = s.Credentials.Get()
+	}
+	conn := pulse.NewConnection(user, password, s.Pulse.URL)
+
+	// pulse-go panics if it can't connect, so check the
+	// new credentials before giving up the old connection
+	probe, err := amqp.Dial(conn.URL)
+	if err != nil {
+		return fmt.Errorf("Could not connect to pulse: %v", err)
+	}
+	probe.Close()
+
+	old := s.Pulse.AMQPConn
+	*s.Pulse = conn
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// newPulseDelivery wraps a delivery of pulse-go, whose headers are amqp tables
+func newPulseDelivery(delivery amqp.Delivery) *Delivery {
+	return &Delivery{
+		Exchange:     delivery.Exchange,
+		RoutingKey:   delivery.RoutingKey,
+		Headers:      delivery.Headers,
+		Body:         delivery.Body,
+		Redelivered:  delivery.Redelivered,
+		Acknowledger: pulseAcknowledger{delivery},
+	}
+}
+
+type pulseAcknowledger struct {
+	delivery amqp.Delivery
+}
+
+func (a pulseAcknowledger) Ack() error {
+	return a.delivery.Ack(false)
+}
+
+func (a pulseAcknowledger) Nack(requeue bool) error {
+	return a.delivery.Nack(false, requeue)
+}
+
+// pulseSubscription is a queue consumed by pulse-go, which doesn't expose
+// the channel of its consumers, so the subscription ends with the connection
+type pulseSubscription struct {
+	conn  *amqp.Connection
+	queue string
+	done  chan error
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newPulseSubscription(conn *amqp.Connection, queue string) *pulseSubscription {
+	sub := &pulseSubscription{conn: conn, queue: queue, done: make(chan error, 1)}
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		err := <-closed
+		sub.mu.Lock()
+		defer sub.mu.Unlock()
+		if sub.closed {
+			return
+		}
+		if err != nil {
+			sub.done <- err
+		} else {
+			sub.done <- fmt.Errorf("Connection closed")
+		}
+	}()
+	return sub
+}
+
+// Bind uses its own channel, as a failed bind closes the channel
+func (sub *pulseSubscription) Bind(binding Binding) error {
+	ch, err := sub.conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	return ch.QueueBind(sub.queue, binding.RoutingKey, binding.Exchange, false, nil)
+}
+
+func (sub *pulseSubscription) Unbind(binding Binding) error {
+	ch, err := sub.conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	return ch.QueueUnbind(sub.queue, binding.RoutingKey, binding.Exchange, nil)
+}
+
+func (sub *pulseSubscription) Done() <-chan error {
+	return sub.done
+}
+
+// Close closes the connection of the subscription
+func (sub *pulseSubscription) Close() error {
+	sub.mu.Lock()
+	sub.closed = true
+	sub.mu.Unlock()
+	return sub.conn.Close()
+}
+
+// decodeMessage unmarshals the body of delivery into message, logging errors
+func decodeMessage(delivery *Delivery, message interface{}) bool {
+	if err := json.Unmarshal(delivery.Body, message); err != nil {
+		log.Printf("Error decoding %s message with routing key %s: %v", delivery.Exchange, delivery.RoutingKey, err)
+		return false
+	}
+	return true
+}
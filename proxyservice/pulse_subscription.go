@@ -0,0 +1,250 @@
+package proxyservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// validateJSONPath checks path is a dotted path like $.payload.heads.0
+func validateJSONPath(path string) error {
+	for _, part := range jsonPathParts(path) {
+		if part == "" {
+			return fmt.Errorf("Invalid JSON path %q", path)
+		}
+	}
+	return nil
+}
+
+// jsonPathParts splits path into object keys and array indexes
+func jsonPathParts(path string) []string {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	return strings.Split(path, ".")
+}
+
+// ExtractJSONPath returns the value at path in the json document data.
+// Strings are returned as is and other values as json.
+func ExtractJSONPath(data []byte, path string) (string, error) {
+	if err := validateJSONPath(path); err != nil {
+		return "", err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// keep large numbers such as push ids exact
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return "", fmt.Errorf("Error parsing message: %v", err)
+	}
+
+	for _, part := range jsonPathParts(path) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			next, ok := v[part]
+			if !ok {
+				return "", fmt.Errorf("No %s in message", path)
+			}
+			value = next
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return "", fmt.Errorf("No %s in message", path)
+			}
+			value = v[i]
+		default:
+			return "", fmt.Errorf("No %s in message", path)
+		}
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("Error encoding %s: %v", path, err)
+	}
+	return string(encoded), nil
+}
+
+var (
+	subscriptionRepoRegexp     = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*/[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+	subscriptionRefRegexp      = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_./-]{0,254}$`)
+	subscriptionRevisionRegexp = regexp.MustCompile(`^[0-9a-f]{7,64}$`)
+)
+
+// DeployEvent extracts the fields of s from message. The repo, which the
+// default job path is built from, must look like org/name, the ref like a
+// branch or tag and the revision like a changeset hash.
+func (s *PulseSubscription) DeployEvent(message []byte) (*DeployEvent, error) {
+	event := &DeployEvent{
+		Source:     s.Name,
+		Repository: s.Name,
+		Timestamp:  time.Now().UTC(),
+		Fields:     make(map[string]string),
+		Raw:        json.RawMessage(message),
+	}
+	for _, name := range sortedKeys(s.Fields) {
+		value, err := ExtractJSONPath(message, s.Fields[name])
+		if err != nil {
+			return nil, err
+		}
+		event.Fields[name] = value
+	}
+	if repo, ok := event.Fields["repo"]; ok {
+		if !subscriptionRepoRegexp.MatchString(repo) {
+			return nil, fmt.Errorf("Invalid repo %q, expected org/name", repo)
+		}
+		event.Repository = repo
+	}
+	if ref, ok := event.Fields["ref"]; ok {
+		if !subscriptionRefRegexp.MatchString(ref) || strings.Contains(ref, "..") {
+			return nil, fmt.Errorf("Invalid ref %q", ref)
+		}
+		event.Ref = ref
+	}
+	if revision, ok := event.Fields["revision"]; ok {
+		if !subscriptionRevisionRegexp.MatchString(revision) {
+			return nil, fmt.Errorf("Invalid revision %q, expected a changeset hash", revision)
+		}
+		event.Revision = revision
+	}
+	event.Actor = event.Fields["actor"]
+	return event, nil
+}
+
+// PulseSubscriptionHandler deploys messages of Config.PulseSubscriptions.
+// Pulse only lets the owner of an exchange publish to it, so messages are
+// trusted as is.
+type PulseSubscriptionHandler struct {
+	Deployer Deployer
+	Config   *ConfigStore
+
+	// Events records received messages when set
+	Events EventStore
+
+	consumers []*pulseConsumer
+}
+
+func NewPulseSubscriptionHandler(deployer Deployer, config *ConfigStore) *PulseSubscriptionHandler {
+	return &PulseSubscriptionHandler{
+		Deployer: deployer,
+		Config:   config,
+	}
+}
+
+// Consume starts a consumer with its own source from newSource for each
+// queue of the subscriptions in the config. Subscriptions added on reload
+// only take effect after a restart.
+func (handler *PulseSubscriptionHandler) Consume(newSource func() MessageSource) error {
+	queues := make(map[string]bool)
+	for _, sub := range handler.Config.Get().PulseSubscriptions {
+		queues[sub.QueueName()] = true
+	}
+	names := make([]string, 0, len(queues))
+	for queue := range queues {
+		names = append(names, queue)
+	}
+	sort.Strings(names)
+
+	for _, queue := range names {
+		consumer := &pulseConsumer{
+			Source:    newSource(),
+			QueueName: queue,
+		}
+		consumer.bindings = func() []Binding {
+			return handler.bindings(consumer.QueueName)
+		}
+		consumer.handle = func(delivery *Delivery) {
+			handler.handleMessage(consumer.QueueName, delivery)
+		}
+		consumer.mu.Lock()
+		err := consumer.consume()
+		consumer.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("Error consuming pulse queue %s: %v", queue, err)
+		}
+		handler.consumers = append(handler.consumers, consumer)
+	}
+	return nil
+}
+
+// Reconnect reconnects every consumer, e.g., after the credentials were
+// rotated, and returns the errors of the consumers which failed
+func (handler *PulseSubscriptionHandler) Reconnect() error {
+	var errs []string
+	for _, consumer := range handler.consumers {
+		if err := consumer.Reconnect(); err != nil {
+			errs = append(errs, fmt.Sprintf("Error reconnecting pulse queue %s: %v", consumer.QueueName, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// bindings returns the bindings of the subscriptions consumed from queue
+func (handler *PulseSubscriptionHandler) bindings(queue string) []Binding {
+	bindings := make([]Binding, 0)
+	for _, sub := range handler.Config.Get().PulseSubscriptions {
+		if sub.QueueName() == queue {
+			bindings = append(bindings, Binding{Exchange: sub.Exchange, RoutingKey: sub.RoutingKey})
+		}
+	}
+	return bindings
+}
+
+func (handler *PulseSubscriptionHandler) handleMessage(queue string, delivery *Delivery) {
+	defer delivery.Ack() // acknowledge message *after* processing
+	sub := handler.Config.Get().MatchPulseSubscription(queue, delivery.Exchange, routingKeys(delivery)...)
+	if sub == nil {
+		log.Printf("No pulse subscription for %s message with routing key %s", delivery.Exchange, delivery.RoutingKey)
+		return
+	}
+
+	event := NewEvent(sub.Name, delivery.Body)
+	event.RoutingKey = delivery.RoutingKey
+	err := handler.processMessage(context.Background(), event.Deployer(handler.Deployer), sub, delivery.Body)
+	if event.Deploy != nil {
+		event.Repo = event.Deploy.Repository
+	}
+	event.SetResult(err)
+	if err != nil {
+		log.Printf("%s", err)
+	}
+	if handler.Events != nil {
+		if err := handler.Events.Record(event); err != nil {
+			log.Printf("Error recording event: %v", err)
+		}
+	}
+}
+
+// processMessage deploys message to the matching route, or to the route of sub
+func (handler *PulseSubscriptionHandler) processMessage(ctx context.Context, deployer Deployer, sub *PulseSubscription, message []byte) error {
+	event, err := sub.DeployEvent(message)
+	if err != nil {
+		return fmt.Errorf("Error extracting %s fields: %v", sub.Name, err)
+	}
+	route := handler.Config.Get().Route(event.Source, event.Repository)
+	if route == nil {
+		route = sub.Route()
+	}
+	if err := deployer.Deploy(ctx, route, event); err != nil {
+		return fmt.Errorf("Error triggering %s job: %s", sub.Name, err)
+	}
+	return nil
+}
+
+// Replay deploys a previously recorded subscription event
+func (handler *PulseSubscriptionHandler) Replay(ctx context.Context, event *Event) error {
+	sub := handler.Config.Get().PulseSubscription(event.Source)
+	if sub == nil {
+		return fmt.Errorf("Unknown source %s", event.Source)
+	}
+	return handler.processMessage(ctx, handler.Deployer, sub, event.Payload)
+}
@@ -0,0 +1,229 @@
+package proxyservice
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractJSONPath(t *testing.T) {
+	message := []byte(`{"payload": {"repo": "mozilla/app", "tags": ["v1.0", "latest"], "push_id": 12345678901234567890, "meta": {"a": 1}}}`)
+	for _, fixture := range []struct {
+		Path  string
+		Value string
+		Error string
+	}{
+		{Path: "payload.repo", Value: "mozilla/app"},
+		{Path: "$.payload.tags.1", Value: "latest"},
+		{Path: "payload.push_id", Value: "12345678901234567890"},
+		{Path: "payload.meta", Value: `{"a":1}`},
+		{Path: "payload.tags.2", Error: "No payload.tags.2 in message"},
+		{Path: "payload.repo.name", Error: "No payload.repo.name in message"},
+		{Path: "payload..repo", Error: `Invalid JSON path "payload..repo"`},
+		{Path: "$", Error: `Invalid JSON path "$"`},
+	} {
+		value, err := ExtractJSONPath(message, fixture.Path)
+		if fixture.Error != "" {
+			assert.EqualError(t, err, fixture.Error, fixture.Path)
+			continue
+		}
+		assert.NoError(t, err, fixture.Path)
+		assert.Equal(t, fixture.Value, value, fixture.Path)
+	}
+}
+
+func TestPulseSubscriptionHandler(t *testing.T) {
+	var logs LogCapture
+	defer logs.Reset()
+	logs.Start()
+
+	jenkins := NewFakeJenkins()
+	events := NewMemoryEventStore(10)
+	handler := NewPulseSubscriptionHandler(NewJenkinsDeployer(jenkins), NewConfigStore(&Config{
+		PulseSubscriptions: []*PulseSubscription{
+			{
+				Name:       "app-releases",
+				Exchange:   "exchange/releases/v1/published",
+				RoutingKey: "mozilla.*.#",
+				Queue:      "proxy",
+				Fields:     map[string]string{"repo": "repository", "ref": "version", "CHANNEL": "channel"},
+			},
+			{
+				Name:       "builds",
+				Exchange:   "exchange/builds/v1/completed",
+				RoutingKey: "#",
+				Queue:      "proxy",
+				Fields:     map[string]string{"BUILD_ID": "build.id"},
+				JobPath:    "/job/builds",
+			},
+		},
+		Routes: []*Route{
+			{Source: "app-releases", Repo: "mozilla/special", JobPath: "/job/special"},
+		},
+	}))
+	handler.Events = events
+
+	for _, fixture := range []struct {
+		TestName string
+		Queue    string
+		Exchange string
+		Key      string
+		Body     string
+		Jobs     []JenkinsJob
+		Error    string
+	}{
+		{
+			TestName: "Default Job Path",
+			Queue:    "proxy",
+			Exchange: "exchange/releases/v1/published",
+			Key:      "mozilla.app.stable",
+			Body:     `{"repository": "mozilla/app", "version": "v1.2", "channel": "stable"}`,
+			Jobs: []JenkinsJob{{"/job/app-releases/job/mozilla/job/app", url.Values{
+				"repo":    {"mozilla/app"},
+				"ref":     {"v1.2"},
+				"CHANNEL": {"stable"},
+			}}},
+		},
+		{
+			TestName: "Matching Route",
+			Queue:    "proxy",
+			Exchange: "exchange/releases/v1/published",
+			Key:      "mozilla.special",
+			Body:     `{"repository": "mozilla/special", "version": "v2", "channel": "beta"}`,
+			Jobs: []JenkinsJob{{"/job/special", url.Values{
+				"repo":    {"mozilla/special"},
+				"ref":     {"v2"},
+				"CHANNEL": {"beta"},
+			}}},
+		},
+		{
+			TestName: "Subscription Job Path",
+			Queue:    "proxy",
+			Exchange: "exchange/builds/v1/completed",
+			Key:      "any.key",
+			Body:     `{"build": {"id": 42}}`,
+			Jobs:     []JenkinsJob{{"/job/builds", url.Values{"BUILD_ID": {"42"}}}},
+		},
+		{
+			TestName: "Missing Field",
+			Queue:    "proxy",
+			Exchange: "exchange/releases/v1/published",
+			Key:      "mozilla.app",
+			Body:     `{"repository": "mozilla/app", "version": "v1.2"}`,
+			Error:    "Error extracting app-releases fields: No channel in message",
+		},
+		{
+			TestName: "Repository Traversal",
+			Queue:    "proxy",
+			Exchange: "exchange/releases/v1/published",
+			Key:      "mozilla.app",
+			Body:     `{"repository": "../../admin", "version": "v1.2", "channel": "stable"}`,
+			Error:    `Error extracting app-releases fields: Invalid repo "../../admin", expected org/name`,
+		},
+		{
+			TestName: "Nested Repository Traversal",
+			Queue:    "proxy",
+			Exchange: "exchange/releases/v1/published",
+			Key:      "mozilla.app",
+			Body:     `{"repository": "mozilla/../../admin", "version": "v1.2", "channel": "stable"}`,
+			Error:    `Invalid repo "mozilla/../../admin"`,
+		},
+		{
+			TestName: "Invalid Ref",
+			Queue:    "proxy",
+			Exchange: "exchange/releases/v1/published",
+			Key:      "mozilla.app",
+			Body:     `{"repository": "mozilla/app", "version": "v1/../../x", "channel": "stable"}`,
+			Error:    `Invalid ref "v1/../../x"`,
+		},
+		{
+			TestName: "Unmatched Routing Key",
+			Queue:    "proxy",
+			Exchange: "exchange/releases/v1/published",
+			Key:      "other.app",
+			Body:     `{}`,
+			Error:    "No pulse subscription for exchange/releases/v1/published message with routing key other.app",
+		},
+		{
+			TestName: "Other Queue",
+			Queue:    "other",
+			Exchange: "exchange/builds/v1/completed",
+			Key:      "any.key",
+			Body:     `{"build": {"id": 42}}`,
+			Error:    "No pulse subscription for exchange/builds/v1/completed",
+		},
+	} {
+		jenkins.Jobs = nil
+		logs.Messages.Truncate(0)
+		t.Run(fixture.TestName, func(t *testing.T) {
+			handler.handleMessage(fixture.Queue, &Delivery{
+				Exchange:   fixture.Exchange,
+				RoutingKey: fixture.Key,
+				Body:       []byte(fixture.Body),
+			})
+			assert.Equal(t, fixture.Jobs, jenkins.Jobs)
+			if fixture.Error != "" {
+				assert.Contains(t, logs.Messages.String(), fixture.Error)
+			}
+		})
+	}
+
+	event := events.events[0]
+	assert.Equal(t, "app-releases", event.Source)
+	assert.Equal(t, "mozilla/app", event.Repo)
+	assert.Equal(t, "mozilla.app.stable", event.RoutingKey)
+	assert.Equal(t, OutcomeTriggered, event.Outcome)
+	assert.Equal(t, OutcomeRejected, events.events[3].Outcome)
+	assert.Equal(t, OutcomeRejected, events.events[4].Outcome)
+	assert.Len(t, events.events, 7)
+
+	jenkins.Jobs = nil
+	assert.NoError(t, handler.Replay(context.Background(), event))
+	assert.Equal(t, "/job/app-releases/job/mozilla/job/app", jenkins.Jobs[0].path)
+	assert.EqualError(t, handler.Replay(context.Background(), &Event{Source: "gone"}), "Unknown source gone")
+}
+
+// reconnectSource counts reconnects and fails them when err is set
+type reconnectSource struct {
+	*MemorySource
+	err        error
+	reconnects int
+}
+
+func (s *reconnectSource) Reconnect() error {
+	s.reconnects++
+	if s.err != nil {
+		return s.err
+	}
+	return s.MemorySource.Reconnect()
+}
+
+func TestPulseSubscriptionHandlerReconnect(t *testing.T) {
+	handler := NewPulseSubscriptionHandler(NewJenkinsDeployer(NewFakeJenkins()), NewConfigStore(&Config{
+		PulseSubscriptions: []*PulseSubscription{
+			{Name: "first", Exchange: "exchange/a", RoutingKey: "#"},
+			{Name: "second", Exchange: "exchange/b", RoutingKey: "#"},
+		},
+	}))
+	sources := []*reconnectSource{
+		{MemorySource: NewMemorySource(), err: fmt.Errorf("Bad credentials")},
+		{MemorySource: NewMemorySource()},
+	}
+	next := 0
+	assert.NoError(t, handler.Consume(func() MessageSource {
+		next++
+		return sources[next-1]
+	}))
+
+	// a failing queue doesn't keep the others on the old credentials
+	assert.EqualError(t, handler.Reconnect(), "Error reconnecting pulse queue first: Bad credentials")
+	assert.Equal(t, 1, sources[0].reconnects)
+	assert.Equal(t, 1, sources[1].reconnects)
+
+	sources[0].err = nil
+	assert.NoError(t, handler.Reconnect())
+	assert.Equal(t, 2, sources[1].reconnects)
+}
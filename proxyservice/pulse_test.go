@@ -0,0 +1,192 @@
+package proxyservice
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/taskcluster/pulse-go/pulse"
+	"go.mozilla.org/cloudops-deployment-proxy/proxyservice/amqptest"
+	"go.mozilla.org/cloudops-deployment-proxy/proxyservice/hgmotest"
+	"go.mozilla.org/cloudops-deployment-proxy/proxyservice/jenkinstest"
+)
+
+// waitFor polls cond until it is true and fails the test after a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// gatedDeployer holds deploys between hold and release
+type gatedDeployer struct {
+	Deployer
+	started chan string
+
+	mu   sync.Mutex
+	gate chan struct{}
+}
+
+func (d *gatedDeployer) Deploy(ctx context.Context, route *Route, event *DeployEvent) error {
+	d.started <- event.Revision
+	d.mu.Lock()
+	gate := d.gate
+	d.mu.Unlock()
+	if gate != nil {
+		<-gate
+	}
+	return d.Deployer.Deploy(ctx, route, event)
+}
+
+func (d *gatedDeployer) hold() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.gate = make(chan struct{})
+}
+
+func (d *gatedDeployer) release() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	close(d.gate)
+	d.gate = nil
+}
+
+func TestPulseConsumerHgmo(t *testing.T) {
+	for name, newSource := range map[string]func(url string, credentials *Credentials) MessageSource{
+		"pulse-go": func(url string, credentials *Credentials) MessageSource {
+			user, password := credentials.Get()
+			conn := pulse.NewConnection(user, password, url)
+			return NewPulseSource(&conn, credentials)
+		},
+		"amqp": func(url string, credentials *Credentials) MessageSource {
+			return NewAMQPSource(url, credentials)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			testPulseConsumerHgmo(t, newSource)
+		})
+	}
+}
+
+func testPulseConsumerHgmo(t *testing.T, newSource func(url string, credentials *Credentials) MessageSource) {
+	broker := amqptest.NewBroker()
+	defer broker.Close()
+	broker.AddUser("proxy", "secret")
+	broker.DeclareExchange(hgPushExchange)
+
+	hg := hgmotest.NewServer()
+	defer hg.Close()
+	hg.AddPush("ci/ci-admin", hgmotest.Push{ID: 158, User: "mozilla@hocat.ca", Changesets: []hgmotest.Changeset{
+		{Node: "9c9a898b351909b2e0fe8420ac9d649ded523af3"},
+	}})
+	hg.AddPush("ci/taskgraph", hgmotest.Push{ID: 12, User: "mozilla@hocat.ca", Changesets: []hgmotest.Changeset{
+		{Node: "9442967f483a7c61b520c3f559a8db9fb29aa573"},
+	}})
+
+	jenkins := jenkinstest.NewServer("jenkins", "jenkins")
+	defer jenkins.Close()
+	deployer := &gatedDeployer{
+		Deployer: NewJenkinsDeployer(NewJenkins(jenkins.URL, "jenkins", "jenkins")),
+		started:  make(chan string, 10),
+	}
+
+	credentials := NewCredentials("proxy", "secret")
+	handler := NewHgmoPulseHandler(deployer, newSource(broker.URL, credentials), "deploy-proxy", "ci/ci-admin", "ci/ci-configuration")
+	handler.HgBaseURL = hg.URL
+	handler.Events = NewMemoryEventStore(20)
+	if !assert.NoError(t, handler.Consume()) {
+		return
+	}
+
+	queue := "queue/proxy/deploy-proxy"
+	stats := func() amqptest.QueueStats {
+		stats, _ := broker.Queue(queue)
+		return stats
+	}
+	publish := func(repoPath string, pushID int) int {
+		routed, err := broker.Publish(hgPushExchange, repoPath, hg.ChangegroupMessage(repoPath, pushID), nil)
+		assert.NoError(t, err)
+		return routed
+	}
+
+	// the queue is bound to the watched repositories
+	assert.Equal(t, []amqptest.Binding{
+		{Exchange: hgPushExchange, RoutingKey: "ci/ci-admin"},
+		{Exchange: hgPushExchange, RoutingKey: "ci/ci-configuration"},
+	}, broker.Bindings(queue))
+	assert.Equal(t, 1, stats().Consumers)
+
+	assert.Equal(t, 1, publish("ci/ci-admin", 158))
+	waitFor(t, "push to be acked", func() bool { return stats().Acked == 1 })
+	builds := jenkins.Builds()
+	if assert.Len(t, builds, 1) {
+		assert.Equal(t, "/job/hgmo/job/ci/job/ci-admin", builds[0].Job)
+		assert.Equal(t, "9c9a898b351909b2e0fe8420ac9d649ded523af3", builds[0].Params.Get("HEAD_REV"))
+	}
+	events, _ := handler.Events.Query(&EventFilter{Outcome: OutcomeTriggered})
+	assert.Len(t, events, 1)
+
+	// unwatched repositories are not routed to the queue
+	assert.Equal(t, 0, publish("ci/taskgraph", 12))
+
+	// bindings follow config reloads
+	assert.NoError(t, handler.Config.Set(&Config{HgmoRepos: []string{"ci/ci-admin", "ci/taskgraph"}}))
+	assert.Equal(t, []amqptest.Binding{
+		{Exchange: hgPushExchange, RoutingKey: "ci/ci-admin"},
+		{Exchange: hgPushExchange, RoutingKey: "ci/taskgraph"},
+	}, broker.Bindings(queue))
+	assert.Equal(t, 1, publish("ci/taskgraph", 12))
+	waitFor(t, "taskgraph push to be acked", func() bool { return stats().Acked == 2 })
+
+	// messages are acked after processing, and a message being processed
+	// when the connection drops is redelivered after reconnecting
+	deployer.hold()
+	push := hg.AddPush("ci/ci-admin", hgmotest.Push{User: "mozilla@hocat.ca", Changesets: []hgmotest.Changeset{
+		{Node: "ce7ae9a988cd41bf9ab5852ba8923cc43e62ea34"},
+	}})
+	for len(deployer.started) > 0 {
+		<-deployer.started
+	}
+	publish("ci/ci-admin", push.ID)
+	select {
+	case rev := <-deployer.started:
+		assert.Equal(t, "ce7ae9a988cd41bf9ab5852ba8923cc43e62ea34", rev)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the push to be deployed")
+	}
+	assert.Equal(t, amqptest.QueueStats{Unacked: 1, Acked: 2, Consumers: 1}, stats())
+
+	broker.CloseConnections()
+	waitFor(t, "connection to drop", func() bool { return broker.Connections() == 0 })
+	assert.Equal(t, amqptest.QueueStats{Ready: 1, Acked: 2}, stats())
+	deployer.release()
+	waitFor(t, "redelivered push to be acked", func() bool { return stats().Acked == 3 })
+	assert.Equal(t, amqptest.QueueStats{Acked: 3, Consumers: 1}, stats())
+	assert.Len(t, jenkins.Builds(), 4)
+
+	// Reconnect uses rotated credentials and keeps the bindings
+	broker.AddUser("proxy", "rotated")
+	credentials.SetPassword("rotated")
+	assert.NoError(t, handler.Reconnect())
+	waitFor(t, "old connection to close", func() bool { return broker.Connections() == 1 })
+	assert.Len(t, broker.Bindings(queue), 2)
+	publish("ci/ci-admin", 158)
+	waitFor(t, "push to be acked after reconnecting", func() bool { return stats().Acked == 4 })
+
+	// the connection is kept when the new credentials are rejected
+	credentials.SetPassword("wrong")
+	err := handler.Reconnect()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Could not connect to pulse")
+	}
+	publish("ci/ci-admin", 158)
+	waitFor(t, "push to be acked on the kept connection", func() bool { return stats().Acked == 5 })
+	assert.Equal(t, 1, broker.Connections())
+}
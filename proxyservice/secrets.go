@@ -0,0 +1,125 @@
+package proxyservice
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credentials is a username and password which can be replaced at runtime
+type Credentials struct {
+	mu       sync.RWMutex
+	user     string
+	password string
+}
+
+func NewCredentials(user, password string) *Credentials {
+	return &Credentials{
+		user:     user,
+		password: password,
+	}
+}
+
+// Get returns the current username and password
+func (c *Credentials) Get() (string, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.user, c.password
+}
+
+// SetPassword replaces the password
+func (c *Credentials) SetPassword(password string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.password = password
+}
+
+// SecretFile holds the contents of a file, e.g., a mounted kubernetes secret,
+// and re-reads it when it changes
+type SecretFile struct {
+	Path string
+
+	mu        sync.Mutex
+	value     string
+	listeners []func(value string)
+}
+
+// NewSecretFile reads the secret at path
+func NewSecretFile(path string) (*SecretFile, error) {
+	s := &SecretFile{Path: path}
+	value, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	s.value = value
+	return s, nil
+}
+
+func (s *SecretFile) read() (string, error) {
+	return readSecret(s.Path)
+}
+
+// readSecret returns the trimmed contents of the file at path
+func readSecret(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Error reading secret: %v", err)
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return "", fmt.Errorf("Secret file %s is empty", path)
+	}
+	return value, nil
+}
+
+// Value returns the secret
+func (s *SecretFile) Value() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.value
+}
+
+// OnChange registers fn to be called with the new secret when it changes
+func (s *SecretFile) OnChange(fn func(value string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, fn)
+}
+
+// Refresh re-reads the secret and notifies listeners if it changed
+func (s *SecretFile) Refresh() error {
+	value, err := s.read()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if value == s.value {
+		s.mu.Unlock()
+		return nil
+	}
+	s.value = value
+	listeners := s.listeners
+	s.mu.Unlock()
+
+	log.Printf("Secret %s changed", s.Path)
+	for _, fn := range listeners {
+		fn(value)
+	}
+	return nil
+}
+
+// Watch refreshes the secret every interval.
+// The contents are compared rather than modification times because
+// kubernetes updates secrets by swapping symlinks.
+func (s *SecretFile) Watch(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := s.Refresh(); err != nil {
+				log.Printf("Keeping previous secret: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,67 @@
+package proxyservice
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "password")
+
+	if err := ioutil.WriteFile(path, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := NewSecretFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "first", secret.Value())
+
+	credentials := NewCredentials("fakeuser", secret.Value())
+	secret.OnChange(credentials.SetPassword)
+
+	var passwords []string
+	jenkinsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, password, _ := req.BasicAuth()
+		if req.URL.Path == "/crumbIssuer/api/json" {
+			w.Write([]byte(`{"crumb": "crmb", "crumbRequestField": "Jenkins-Crumb"}`))
+			return
+		}
+		passwords = append(passwords, password)
+		w.WriteHeader(201)
+	}))
+	defer jenkinsServer.Close()
+	jenkins := NewJenkinsWithCredentials(jenkinsServer.URL, credentials)
+
+	assert.NoError(t, jenkins.TriggerJob(context.Background(), "/job/test", url.Values{}))
+
+	// unchanged and empty files are ignored
+	assert.NoError(t, secret.Refresh())
+	if err := ioutil.WriteFile(path, []byte(""), 0600); err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, secret.Refresh())
+	assert.Equal(t, "first", secret.Value())
+
+	if err := ioutil.WriteFile(path, []byte("second\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, secret.Refresh())
+	assert.Equal(t, "second", secret.Value())
+
+	assert.NoError(t, jenkins.TriggerJob(context.Background(), "/job/test", url.Values{}))
+	assert.Equal(t, []string{"first", "second"}, passwords)
+}
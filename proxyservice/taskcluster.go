@@ -0,0 +1,163 @@
+package proxyservice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TaskclusterQueue reads task state from the taskcluster Queue API
+type TaskclusterQueue struct {
+	RootURL string
+	Client  *http.Client
+}
+
+// NewTaskclusterQueue returns a TaskclusterQueue whose requests time out
+// after timeout, 0 means no timeout
+func NewTaskclusterQueue(rootURL string, timeout time.Duration) *TaskclusterQueue {
+	return &TaskclusterQueue{
+		RootURL: strings.TrimSuffix(rootURL, "/"),
+		Client:  &http.Client{Timeout: timeout},
+	}
+}
+
+// TaskStatus is the status of a task
+// https://docs.taskcluster.net/docs/reference/platform/queue/api#status
+type TaskStatus struct {
+	TaskID      string    `json:"taskId"`
+	TaskGroupID string    `json:"taskGroupId"`
+	State       string    `json:"state"`
+	Runs        []TaskRun `json:"runs"`
+}
+
+type TaskRun struct {
+	RunID    int       `json:"runId"`
+	State    string    `json:"state"`
+	Resolved time.Time `json:"resolved"`
+}
+
+// Run returns the run with id runID, or nil
+func (s *TaskStatus) Run(runID int) *TaskRun {
+	for i := range s.Runs {
+		if s.Runs[i].RunID == runID {
+			return &s.Runs[i]
+		}
+	}
+	return nil
+}
+
+// TaskDefinition is the part of a task definition used to verify messages
+// https://docs.taskcluster.net/docs/reference/platform/queue/api#task
+type TaskDefinition struct {
+	TaskGroupID string   `json:"taskGroupId"`
+	Routes      []string `json:"routes"`
+	Metadata    struct {
+		Name   string `json:"name"`
+		Owner  string `json:"owner"`
+		Source string `json:"source"`
+	} `json:"metadata"`
+}
+
+// Artifact is an artifact of a task run
+type Artifact struct {
+	Name        string `json:"name"`
+	StorageType string `json:"storageType"`
+	ContentType string `json:"contentType"`
+}
+
+func (q *TaskclusterQueue) get(ctx context.Context, path string, v interface{}) error {
+	apiURL := q.RootURL + "/api/queue/v1" + path
+	req, err := http.NewRequestWithContext(ctx, "GET", apiURL, nil)
+	if err != nil {
+		return fmt.Errorf("Error building queue request: %v", err)
+	}
+	resp, err := q.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error calling %s: %v", apiURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s returned %d: %s", apiURL, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("Error parsing %s response: %v", apiURL, err)
+	}
+	return nil
+}
+
+// Status returns the status of task taskID
+func (q *TaskclusterQueue) Status(ctx context.Context, taskID string) (*TaskStatus, error) {
+	var resp struct {
+		Status TaskStatus `json:"status"`
+	}
+	if err := q.get(ctx, "/task/"+url.PathEscape(taskID)+"/status", &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Status, nil
+}
+
+// Task returns the definition of task taskID
+func (q *TaskclusterQueue) Task(ctx context.Context, taskID string) (*TaskDefinition, error) {
+	task := new(TaskDefinition)
+	if err := q.get(ctx, "/task/"+url.PathEscape(taskID), task); err != nil {
+		return nil, err
+	}
+	return task, nil
+}
+
+// Artifacts lists the artifacts of a task run
+func (q *TaskclusterQueue) Artifacts(ctx context.Context, taskID string, runID int) ([]Artifact, error) {
+	var artifacts []Artifact
+	query := ""
+	for {
+		var resp struct {
+			Artifacts         []Artifact `json:"artifacts"`
+			ContinuationToken string     `json:"continuationToken"`
+		}
+		path := fmt.Sprintf("/task/%s/runs/%d/artifacts%s", url.PathEscape(taskID), runID, query)
+		if err := q.get(ctx, path, &resp); err != nil {
+			return nil, err
+		}
+		artifacts = append(artifacts, resp.Artifacts...)
+		if resp.ContinuationToken == "" {
+			return artifacts, nil
+		}
+		query = "?continuationToken=" + url.QueryEscape(resp.ContinuationToken)
+	}
+}
+
+// ArtifactURL returns the url redirecting to an artifact of a task run
+func (q *TaskclusterQueue) ArtifactURL(taskID string, runID int, name string) string {
+	return fmt.Sprintf("%s/api/queue/v1/task/%s/runs/%d/artifacts/%s", q.RootURL, url.PathEscape(taskID), runID, name)
+}
+
+// MatchRoutingKey returns true if key matches the AMQP topic pattern, where
+// * matches a single word and # matches zero or more words
+func MatchRoutingKey(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+	if pattern[0] == "#" {
+		for i := 0; i <= len(key); i++ {
+			if matchWords(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(key) == 0 || (pattern[0] != "*" && pattern[0] != key[0]) {
+		return false
+	}
+	return matchWords(pattern[1:], key[1:])
+}
@@ -0,0 +1,274 @@
+package proxyservice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// TaskCompletedMessage is a message from the task-completed exchange
+// https://docs.taskcluster.net/docs/reference/platform/queue/exchanges#taskCompleted
+type TaskCompletedMessage struct {
+	Status      TaskStatus `json:"status"`
+	RunID       int        `json:"runId"`
+	WorkerGroup string     `json:"workerGroup"`
+	WorkerID    string     `json:"workerId"`
+}
+
+const taskCompletedExchange = "exchange/taskcluster-queue/v1/task-completed"
+
+var validTaskID = regexp.MustCompile(`^[A-Za-z0-9_-]{8}[Q-T][A-Za-z0-9_-][CGKOSWaeimquy26-][A-Za-z0-9_-]{10}[AQgw]$`)
+
+// ValidateTaskID checks taskID is a taskcluster slug id
+func ValidateTaskID(taskID string) error {
+	if !validTaskID.MatchString(taskID) {
+		return fmt.Errorf("Invalid task id %s", taskID)
+	}
+	return nil
+}
+
+// TaskclusterPulseHandler deploys the image artifacts of completed
+// taskcluster tasks matching Config.TaskclusterBindings
+type TaskclusterPulseHandler struct {
+	pulseConsumer
+
+	Deployer Deployer
+	Queue    *TaskclusterQueue
+	Config   *ConfigStore
+
+	// Events records received messages when set
+	Events EventStore
+
+	// QueueTimeout bounds requests to the Queue API
+	QueueTimeout time.Duration
+}
+
+func NewTaskclusterPulseHandler(deployer Deployer, queue *TaskclusterQueue, source MessageSource, queueName string) *TaskclusterPulseHandler {
+	handler := &TaskclusterPulseHandler{
+		pulseConsumer: pulseConsumer{
+			Source:    source,
+			QueueName: queueName,
+		},
+		Deployer: deployer,
+		Queue:    queue,
+		Config:   NewConfigStore(&Config{}),
+	}
+	handler.pulseConsumer.bindings = handler.bindings
+	handler.pulseConsumer.handle = handler.handleDelivery
+	return handler
+}
+
+// Consume binds the routing keys of the current config, bindings
+// added on reload only take effect after a restart
+func (handler *TaskclusterPulseHandler) Consume() error {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	return handler.consume()
+}
+
+func (handler *TaskclusterPulseHandler) bindings() []Binding {
+	bindings := make([]Binding, 0)
+	for _, binding := range handler.Config.Get().TaskclusterBindings {
+		bindings = append(bindings, Binding{Exchange: taskCompletedExchange, RoutingKey: binding.RoutingKey})
+	}
+	return bindings
+}
+
+// routingKeys returns the primary routing key of delivery followed
+// by the task routes it was sent to, which taskcluster puts in the CC header
+func routingKeys(delivery *Delivery) []string {
+	keys := []string{delivery.RoutingKey}
+	if cc, ok := delivery.Headers["CC"].([]interface{}); ok {
+		for _, key := range cc {
+			if s, ok := key.(string); ok {
+				keys = append(keys, s)
+			}
+		}
+	}
+	return keys
+}
+
+// handleDelivery decodes delivery and handles it
+func (handler *TaskclusterPulseHandler) handleDelivery(delivery *Delivery) {
+	var message interface{}
+	if m := new(TaskCompletedMessage); decodeMessage(delivery, m) {
+		message = m
+	}
+	handler.handleMessage(message, delivery)
+}
+
+func (handler *TaskclusterPulseHandler) handleMessage(message interface{}, delivery *Delivery) {
+	event := NewEvent(SourceTaskcluster, delivery.Body)
+	event.RoutingKey = delivery.RoutingKey
+	if m, ok := message.(*TaskCompletedMessage); ok {
+		binding, key := handler.Config.Get().TaskclusterBinding(routingKeys(delivery)...)
+		if binding != nil {
+			event.RoutingKey = key
+			event.Repo = binding.Repo
+		}
+		err := handler.processMessage(context.Background(), event.Deployer(handler.Deployer), m, key)
+		event.SetResult(err)
+		if err != nil {
+			log.Printf("%s", err)
+		}
+	} else {
+		event.SetResult(nil)
+	}
+	handler.recordEvent(event)
+	delivery.Ack() // acknowledge message *after* processing
+}
+
+func (handler *TaskclusterPulseHandler) recordEvent(event *Event) {
+	if handler.Events == nil {
+		return
+	}
+	if err := handler.Events.Record(event); err != nil {
+		log.Printf("Error recording event: %v", err)
+	}
+}
+
+// processMessage verifies message with the Queue API and deploys its task.
+// routingKey is the key message was received with that matched a binding.
+func (handler *TaskclusterPulseHandler) processMessage(ctx context.Context, deployer Deployer, message *TaskCompletedMessage, routingKey string) error {
+	config := handler.Config.Get()
+	binding, _ := config.TaskclusterBinding(routingKey)
+	if binding == nil {
+		return fmt.Errorf("No taskcluster binding matches task %s", message.Status.TaskID)
+	}
+	event, err := handler.verifyTask(ctx, binding, message, routingKey)
+	if err != nil {
+		return err
+	}
+	event.Raw, err = json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("Error marshaling message: %v", err)
+	}
+	if err := Deploy(ctx, deployer, config, event); err != nil {
+		return fmt.Errorf("Error triggering taskcluster job: %s", err)
+	}
+	return nil
+}
+
+// withQueueTimeout bounds ctx by handler.QueueTimeout
+func (handler *TaskclusterPulseHandler) withQueueTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if handler.QueueTimeout > 0 {
+		return context.WithTimeout(ctx, handler.QueueTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// verifyTask checks with the Queue API that the run of message completed with
+// the image artifact of binding, and that the task was routed to routingKey
+// if it is a route. It returns the DeployEvent of the run.
+func (handler *TaskclusterPulseHandler) verifyTask(ctx context.Context, binding *TaskclusterBinding, message *TaskCompletedMessage, routingKey string) (*DeployEvent, error) {
+	taskID, runID := message.Status.TaskID, message.RunID
+	if err := ValidateTaskID(taskID); err != nil {
+		return nil, err
+	}
+	ctx, cancel := handler.withQueueTimeout(ctx)
+	defer cancel()
+
+	status, err := handler.Queue.Status(ctx, taskID)
+	if err != nil {
+		return nil, err
+	}
+	run := status.Run(runID)
+	if run == nil || run.State != "completed" {
+		return nil, fmt.Errorf("Run %d of task %s is not completed", runID, taskID)
+	}
+	if status.TaskGroupID != message.Status.TaskGroupID {
+		return nil, fmt.Errorf("Task %s has task group %s which doesn't match message %s", taskID, status.TaskGroupID, message.Status.TaskGroupID)
+	}
+
+	task, err := handler.Queue.Task(ctx, taskID)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(routingKey, "route.") && !containsString(task.Routes, strings.TrimPrefix(routingKey, "route.")) {
+		return nil, fmt.Errorf("Task %s does not have route %s", taskID, strings.TrimPrefix(routingKey, "route."))
+	}
+
+	artifacts, err := handler.Queue.Artifacts(ctx, taskID, runID)
+	if err != nil {
+		return nil, err
+	}
+	event := &DeployEvent{
+		Source:        SourceTaskcluster,
+		Repository:    binding.Repo,
+		RepositoryURL: task.Metadata.Source,
+		Ref:           taskID,
+		Actor:         task.Metadata.Owner,
+		Timestamp:     run.Resolved.UTC(),
+		Artifacts:     make(map[string]string),
+		ImageArtifact: binding.ImageArtifactName(),
+	}
+	for _, artifact := range artifacts {
+		event.Artifacts[artifact.Name] = handler.Queue.ArtifactURL(taskID, runID, artifact.Name)
+	}
+	if _, ok := event.Artifacts[event.ImageArtifact]; !ok {
+		return nil, fmt.Errorf("Task %s has no artifact %s", taskID, event.ImageArtifact)
+	}
+	return event, nil
+}
+
+// TriggerTask deploys the latest completed run of taskID as repo. The task
+// must have a route matching a binding for repo.
+func (handler *TaskclusterPulseHandler) TriggerTask(ctx context.Context, repo, taskID string) error {
+	if err := ValidateTaskID(taskID); err != nil {
+		return err
+	}
+	queueCtx, cancel := handler.withQueueTimeout(ctx)
+	defer cancel()
+	status, err := handler.Queue.Status(queueCtx, taskID)
+	if err != nil {
+		return err
+	}
+	task, err := handler.Queue.Task(queueCtx, taskID)
+	if err != nil {
+		return err
+	}
+	routingKey := ""
+	for _, binding := range handler.Config.Get().TaskclusterBindings {
+		for _, route := range task.Routes {
+			if routingKey == "" && binding.Repo == repo && MatchRoutingKey(binding.RoutingKey, "route."+route) {
+				routingKey = "route." + route
+			}
+		}
+	}
+	if routingKey == "" {
+		return fmt.Errorf("Task %s has no route matching a binding for %s", taskID, repo)
+	}
+
+	message := &TaskCompletedMessage{Status: *status, RunID: -1}
+	for _, run := range status.Runs {
+		if run.State == "completed" {
+			message.RunID = run.RunID
+		}
+	}
+	if message.RunID < 0 {
+		return fmt.Errorf("Task %s has no completed run", taskID)
+	}
+	return handler.processMessage(ctx, handler.Deployer, message, routingKey)
+}
+
+// Replay deploys a previously recorded taskcluster event
+func (handler *TaskclusterPulseHandler) Replay(ctx context.Context, event *Event) error {
+	message := new(TaskCompletedMessage)
+	if err := json.Unmarshal(event.Payload, message); err != nil {
+		return fmt.Errorf("Error unmarshaling event %s: %v", event.ID, err)
+	}
+	return handler.processMessage(ctx, handler.Deployer, message, event.RoutingKey)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,230 @@
+package proxyservice
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testTaskID = "fN1SbArXTPSVFNUvaOlinQ"
+
+// fakeQueue serves the Queue API endpoints used to verify testTaskID
+type fakeQueue struct {
+	server    *httptest.Server
+	status    map[string]interface{}
+	task      map[string]interface{}
+	artifacts []map[string]interface{}
+}
+
+func newFakeQueue(t *testing.T) *fakeQueue {
+	var message map[string]interface{}
+	if err := json.Unmarshal(loadFixture("fixtures/taskcluster_task_completed.json"), &message); err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeQueue{
+		status: message["status"].(map[string]interface{}),
+		task: map[string]interface{}{
+			"taskGroupId": "Z1ZMTiWmQiq2xPmgrr6rXA",
+			"routes":      []string{"index.project.myapp.docker-image.latest", "checks"},
+			"metadata": map[string]string{
+				"name":   "build docker image",
+				"owner":  "builds@example.com",
+				"source": "https://github.com/mozilla/myapp",
+			},
+		},
+		artifacts: []map[string]interface{}{
+			{"name": "public/image.tar.zst", "storageType": "s3"},
+			{"name": "public/logs/live.log", "storageType": "reference"},
+		},
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body interface{}
+		switch req.URL.Path {
+		case "/api/queue/v1/task/" + testTaskID + "/status":
+			body = map[string]interface{}{"status": f.status}
+		case "/api/queue/v1/task/" + testTaskID:
+			body = f.task
+		case "/api/queue/v1/task/" + testTaskID + "/runs/0/artifacts":
+			// paginated like the real API
+			if req.URL.Query().Get("continuationToken") == "" {
+				body = map[string]interface{}{"artifacts": f.artifacts[:1], "continuationToken": "next"}
+			} else {
+				body = map[string]interface{}{"artifacts": f.artifacts[1:]}
+			}
+		default:
+			http.NotFound(w, req)
+			return
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+	return f
+}
+
+func TestMatchRoutingKey(t *testing.T) {
+	for _, test := range []struct {
+		pattern, key string
+		match        bool
+	}{
+		{"route.index.project.myapp.#", "route.index.project.myapp.docker-image.latest", true},
+		{"route.index.project.myapp.#", "route.index.project.myapp", true},
+		{"route.index.project.*.docker-image.*", "route.index.project.myapp.docker-image.latest", true},
+		{"route.index.project.*", "route.index.project.myapp.docker-image", false},
+		{"primary.#.proj-myapp.#", "primary.fN1SbArXTPSVFNUvaOlinQ.0.us-east1.123.proj-myapp.ci.s.g._", true},
+		{"route.checks", "route.index.checks", false},
+	} {
+		assert.Equal(t, test.match, MatchRoutingKey(test.pattern, test.key), "%s %s", test.pattern, test.key)
+	}
+}
+
+func TestTaskclusterHandler(t *testing.T) {
+	var logs LogCapture
+	defer logs.Reset()
+	logs.Start()
+
+	queue := newFakeQueue(t)
+	defer queue.server.Close()
+
+	jenkins := NewFakeJenkins()
+	events := NewMemoryEventStore(10)
+	handler := NewTaskclusterPulseHandler(NewJenkinsDeployer(jenkins), NewTaskclusterQueue(queue.server.URL, 0), nil, "proxy-queue")
+	handler.Config = NewConfigStore(&Config{
+		TaskclusterBindings: []*TaskclusterBinding{
+			{RoutingKey: "route.index.project.myapp.docker-image.#", Repo: "mozilla/myapp"},
+		},
+	})
+	handler.Events = events
+
+	artifactURL := queue.server.URL + "/api/queue/v1/task/" + testTaskID + "/runs/0/artifacts/"
+	job := JenkinsJob{"/job/taskcluster/job/mozilla/job/myapp", url.Values{
+		"TASK_ID":        {testTaskID},
+		"ARTIFACT_URLS":  {artifactURL + "public/image.tar.zst " + artifactURL + "public/logs/live.log"},
+		"IMAGE_ARTIFACT": {"public/image.tar.zst"},
+	}}
+
+	for _, fixture := range []struct {
+		TestName string
+		CC       []interface{}
+		ModFunc  func(*TaskCompletedMessage)
+		Setup    func()
+		Jobs     []JenkinsJob
+		Error    string
+	}{
+		{
+			TestName: "Valid Message",
+			CC:       []interface{}{"route.index.project.myapp.docker-image.latest"},
+			Jobs:     []JenkinsJob{job},
+		},
+		{
+			TestName: "Unbound Routes",
+			CC:       []interface{}{"route.checks"},
+			Error:    "No taskcluster binding matches task " + testTaskID,
+		},
+		{
+			TestName: "Route Not In Task",
+			CC:       []interface{}{"route.index.project.myapp.docker-image.forged"},
+			Error:    "Task " + testTaskID + " does not have route index.project.myapp.docker-image.forged",
+		},
+		{
+			TestName: "Wrong Task Group",
+			CC:       []interface{}{"route.index.project.myapp.docker-image.latest"},
+			ModFunc:  func(m *TaskCompletedMessage) { m.Status.TaskGroupID = "other" },
+			Error:    "doesn't match message other",
+		},
+		{
+			TestName: "Invalid Task Id",
+			CC:       []interface{}{"route.index.project.myapp.docker-image.latest"},
+			ModFunc:  func(m *TaskCompletedMessage) { m.Status.TaskID = "../../task" },
+			Error:    "Invalid task id ../../task",
+		},
+		{
+			TestName: "Run Not Completed",
+			CC:       []interface{}{"route.index.project.myapp.docker-image.latest"},
+			ModFunc:  func(m *TaskCompletedMessage) { m.RunID = 1 },
+			Error:    "Run 1 of task " + testTaskID + " is not completed",
+		},
+		{
+			TestName: "Missing Image",
+			CC:       []interface{}{"route.index.project.myapp.docker-image.latest"},
+			Setup: func() {
+				queue.artifacts = []map[string]interface{}{{"name": "public/build/target.zip"}, {"name": "public/logs/live.log"}}
+			},
+			Error: "Task " + testTaskID + " has no artifact public/image.tar.zst",
+		},
+	} {
+		jenkins.Jobs = nil
+		logs.Messages.Truncate(0)
+		t.Run(fixture.TestName, func(t *testing.T) {
+			if fixture.Setup != nil {
+				fixture.Setup()
+			}
+			body := loadFixture("fixtures/taskcluster_task_completed.json")
+			message := new(TaskCompletedMessage)
+			if err := json.Unmarshal(body, message); err != nil {
+				t.Fatal(err)
+			}
+			if fixture.ModFunc != nil {
+				fixture.ModFunc(message)
+			}
+			handler.handleMessage(message, &Delivery{
+				RoutingKey: "primary." + testTaskID + ".0.us-east1.1234567890.proj-myapp.ci.taskcluster-github.Z1ZMTiWmQiq2xPmgrr6rXA._",
+				Headers:    map[string]interface{}{"CC": fixture.CC},
+				Body:       body,
+			})
+			assert.Equal(t, fixture.Jobs, jenkins.Jobs)
+			if fixture.Error != "" {
+				assert.Contains(t, logs.Messages.String(), fixture.Error)
+			}
+		})
+	}
+
+	event := events.events[0]
+	assert.Equal(t, OutcomeTriggered, event.Outcome)
+	assert.Equal(t, "route.index.project.myapp.docker-image.latest", event.RoutingKey)
+	assert.Equal(t, "mozilla/myapp", event.Repo)
+	assert.Equal(t, "builds@example.com", event.Deploy.Actor)
+	assert.Equal(t, OutcomeRejected, events.events[1].Outcome)
+}
+
+func TestTaskclusterTriggerTask(t *testing.T) {
+	queue := newFakeQueue(t)
+	defer queue.server.Close()
+
+	jenkins := NewFakeJenkins()
+	handler := NewTaskclusterPulseHandler(NewJenkinsDeployer(jenkins), NewTaskclusterQueue(queue.server.URL, 0), nil, "proxy-queue")
+	handler.Config = NewConfigStore(&Config{
+		TaskclusterBindings: []*TaskclusterBinding{
+			{RoutingKey: "route.index.project.myapp.docker-image.#", Repo: "mozilla/myapp"},
+		},
+	})
+
+	assert.NoError(t, handler.TriggerTask(context.Background(), "mozilla/myapp", testTaskID))
+	assert.Len(t, jenkins.Jobs, 1)
+	assert.Equal(t, testTaskID, jenkins.Jobs[0].params.Get("TASK_ID"))
+
+	err := handler.TriggerTask(context.Background(), "mozilla/other", testTaskID)
+	assert.EqualError(t, err, "Task "+testTaskID+" has no route matching a binding for mozilla/other")
+
+	err = handler.TriggerTask(context.Background(), "mozilla/myapp", "fN1SbArXTPSVFNUvaOlinA")
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "returned 404"), err.Error())
+	assert.Len(t, jenkins.Jobs, 1)
+
+	// a hanging Queue API fails the trigger after QueueTimeout
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	}))
+	defer hanging.Close()
+	handler.Queue = NewTaskclusterQueue(hanging.URL, 0)
+	handler.QueueTimeout = 50 * time.Millisecond
+	err = handler.TriggerTask(context.Background(), "mozilla/myapp", testTaskID)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "context deadline exceeded")
+	}
+}
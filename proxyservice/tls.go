@@ -0,0 +1,136 @@
+package proxyservice
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CertificateFile holds a certificate and key which are reloaded when
+// the files change, e.g., when cert-manager renews them
+type CertificateFile struct {
+	CertPath string
+	KeyPath  string
+
+	mu      sync.RWMutex
+	content []byte
+	cert    *tls.Certificate
+}
+
+// NewCertificateFile loads the PEM encoded certificate chain and key
+func NewCertificateFile(certPath, keyPath string) (*CertificateFile, error) {
+	c := &CertificateFile{CertPath: certPath, KeyPath: keyPath}
+	if err := c.Refresh(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config.GetCertificate
+func (c *CertificateFile) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// Refresh reloads the certificate if either file changed,
+// the previous certificate is kept if they can't be loaded
+func (c *CertificateFile) Refresh() error {
+	certPEM, err := ioutil.ReadFile(c.CertPath)
+	if err != nil {
+		return fmt.Errorf("Error reading certificate: %v", err)
+	}
+	keyPEM, err := ioutil.ReadFile(c.KeyPath)
+	if err != nil {
+		return fmt.Errorf("Error reading certificate key: %v", err)
+	}
+	content := append(append([]byte{}, certPEM...), keyPEM...)
+	c.mu.RLock()
+	unchanged := c.cert != nil && bytes.Equal(content, c.content)
+	c.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("Error loading certificate %s: %v", c.CertPath, err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert != nil {
+		log.Printf("Certificate %s changed", c.CertPath)
+	}
+	c.content = content
+	c.cert = &cert
+	return nil
+}
+
+// Watch refreshes the certificate every interval
+func (c *CertificateFile) Watch(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := c.Refresh(); err != nil {
+				log.Printf("Keeping previous certificate: %v", err)
+			}
+		}
+	}()
+}
+
+// LoadCertPool reads a PEM encoded CA bundle
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading CA bundle: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificates in CA bundle %s", path)
+	}
+	return pool, nil
+}
+
+// NewTLSConfig returns a server tls.Config serving certs. If clientCAs is set,
+// client certificates are verified against it when presented, and
+// ClientCertRequired decides which paths need them.
+func NewTLSConfig(certs *CertificateFile, clientCAs *x509.CertPool) *tls.Config {
+	config := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if clientCAs != nil {
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config
+}
+
+// ClientCertRequired rejects requests to Paths without a verified client certificate
+type ClientCertRequired struct {
+	// Paths also apply to everything below them
+	Paths []string
+}
+
+// Middleware rejects requests without a verified client certificate
+// to c.Paths with 403
+func (c *ClientCertRequired) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if matchPathTree(c.Paths, req.URL.Path) == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			log.Printf("Rejected %s from %s, no client certificate", req.URL.Path, RequestClientIP(req))
+			http.Error(w, "Client certificate required", http.StatusForbidden)
+			return
+		}
+		log.Printf("Client certificate %s for %s", req.TLS.VerifiedChains[0][0].Subject, req.URL.Path)
+		next.ServeHTTP(w, req)
+	})
+}
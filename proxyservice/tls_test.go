@@ -0,0 +1,181 @@
+package proxyservice
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCert is a certificate signed by parent, or self-signed if parent is nil
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func TestCertificateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := newTestCert(t, "first", nil)
+	certPath := writeTestFile(t, dir, "tls.crt", first.certPEM)
+	keyPath := writeTestFile(t, dir, "tls.key", first.keyPEM)
+	certs, err := NewCertificateFile(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := certs.GetCertificate(nil)
+	assert.Equal(t, first.cert.Raw, cert.Certificate[0])
+
+	second := newTestCert(t, "second", nil)
+	writeTestFile(t, dir, "tls.crt", second.certPEM)
+	writeTestFile(t, dir, "tls.key", second.keyPEM)
+	assert.NoError(t, certs.Refresh())
+	cert, _ = certs.GetCertificate(nil)
+	assert.Equal(t, second.cert.Raw, cert.Certificate[0])
+
+	// a half written renewal keeps the previous certificate
+	writeTestFile(t, dir, "tls.crt", first.certPEM)
+	assert.Error(t, certs.Refresh())
+	cert, _ = certs.GetCertificate(nil)
+	assert.Equal(t, second.cert.Raw, cert.Certificate[0])
+
+	_, err = NewCertificateFile(certPath, dir+"/missing.key")
+	assert.Error(t, err)
+}
+
+func TestClientCertRequired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "127.0.0.1", ca)
+	client := newTestCert(t, "admin-client", ca)
+	untrusted := newTestCert(t, "untrusted", newTestCert(t, "other-ca", nil))
+
+	certs, err := NewCertificateFile(
+		writeTestFile(t, dir, "tls.crt", server.certPEM),
+		writeTestFile(t, dir, "tls.key", server.keyPEM),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs, err := LoadCertPool(writeTestFile(t, dir, "ca.crt", ca.certPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadCertPool(writeTestFile(t, dir, "empty.crt", []byte("no certs")))
+	assert.Error(t, err)
+
+	required := &ClientCertRequired{Paths: []string{"/admin/"}}
+	// httptest.Server.StartTLS would replace GetCertificate with its own certificate
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", NewTLSConfig(certs, clientCAs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go http.Serve(listener, required.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("OK"))
+	})))
+	baseURL := "https://" + listener.Addr().String()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(ca.cert)
+	newClient := func(cert *testCert) *http.Client {
+		config := &tls.Config{RootCAs: rootCAs}
+		if cert != nil {
+			config.Certificates = []tls.Certificate{{
+				Certificate: [][]byte{cert.cert.Raw},
+				PrivateKey:  cert.key,
+			}}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	}
+
+	for _, test := range []struct {
+		name   string
+		client *http.Client
+		path   string
+		status int
+	}{
+		{"dockerhub without certificate", newClient(nil), "/dockerhub", http.StatusOK},
+		{"admin without certificate", newClient(nil), "/admin/events", http.StatusForbidden},
+		{"admin with certificate", newClient(client), "/admin/events", http.StatusOK},
+		{"dockerhub with certificate", newClient(client), "/dockerhub", http.StatusOK},
+		// clients only send certificates issued by one of the server's CAs
+		{"admin with untrusted certificate", newClient(untrusted), "/admin/events", http.StatusForbidden},
+	} {
+		resp, err := test.client.Get(baseURL + test.path)
+		if !assert.NoError(t, err, test.name) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, test.status, resp.StatusCode, test.name)
+	}
+}
@@ -0,0 +1,203 @@
+package proxyservice
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Webhook signature headers, the signature is the hex encoded
+// HMAC-SHA256 of "<timestamp>.<body>" keyed with the target secret
+const (
+	WebhookSignatureHeader = "X-Deployment-Proxy-Signature"
+	WebhookTimestampHeader = "X-Deployment-Proxy-Timestamp"
+)
+
+const (
+	// webhookRetryDelay is the delay before the first retry when
+	// the response has no Retry-After, doubling for each retry
+	webhookRetryDelay = time.Second
+	// defaultWebhookRetries is used for targets without retries
+	defaultWebhookRetries = 3
+	// defaultWebhookMaxRetryAfter is used for targets without max_retry_after,
+	// retries hold the webhook request or pulse message being deployed
+	defaultWebhookMaxRetryAfter = 10 * time.Second
+)
+
+// WebhookEvent is the json body posted by WebhookDeployer
+type WebhookEvent struct {
+	Source string `json:"source"`
+	Repo   string `json:"repo"`
+	Tag    string `json:"tag,omitempty"`
+	Rev    string `json:"rev,omitempty"`
+	Digest string `json:"digest,omitempty"`
+	Pusher string `json:"pusher,omitempty"`
+	// Artifacts are the artifact urls of taskcluster tasks by name
+	Artifacts map[string]string `json:"artifacts,omitempty"`
+	Raw       json.RawMessage   `json:"raw,omitempty"`
+}
+
+// NewWebhookEvent returns the webhook body for event
+func NewWebhookEvent(event *DeployEvent) *WebhookEvent {
+	body := &WebhookEvent{
+		Source:    event.Source,
+		Repo:      event.Repository,
+		Digest:    event.Revision,
+		Pusher:    event.Actor,
+		Artifacts: event.Artifacts,
+		Raw:       event.Raw,
+	}
+	if event.Source == SourceDockerhub {
+		body.Tag = event.Ref
+	} else {
+		body.Rev = event.Ref
+	}
+	return body
+}
+
+// WebhookDeployer posts signed WebhookEvents to a url
+type WebhookDeployer struct {
+	URL string
+
+	TokenFile string
+	// SecretFile holds the HMAC key requests are signed with
+	SecretFile string
+	// Retries is how many times failed requests are retried
+	Retries int
+	// MaxRetryAfter is the longest wait before a retry, deploys asked
+	// to retry later by Retry-After fail instead
+	MaxRetryAfter time.Duration
+	Client        *http.Client
+
+	// after waits before retries, time.After unless set by tests
+	after func(time.Duration) <-chan time.Time
+}
+
+func NewWebhookDeployer(target *Target) *WebhookDeployer {
+	retries := defaultWebhookRetries
+	if target.Retries != nil {
+		retries = *target.Retries
+	}
+	return &WebhookDeployer{
+		URL:           target.URL,
+		TokenFile:     target.TokenFile,
+		SecretFile:    target.SecretFile,
+		Retries:       retries,
+		MaxRetryAfter: target.MaxRetryAfterDuration(),
+		Client:        &http.Client{Timeout: target.TimeoutDuration()},
+	}
+}
+
+func (w *WebhookDeployer) Destination(route *Route, event *DeployEvent) string {
+	return w.URL
+}
+
+// Deploy posts event to w.URL, retrying connection errors, 429 and 5xx
+// responses after the delay given by Retry-After, unless it is longer
+// than w.MaxRetryAfter
+func (w *WebhookDeployer) Deploy(ctx context.Context, route *Route, event *DeployEvent) error {
+	body, err := json.Marshal(NewWebhookEvent(event))
+	if err != nil {
+		return fmt.Errorf("Error marshaling webhook event: %v", err)
+	}
+	token, err := bearerToken(w.TokenFile)
+	if err != nil {
+		return err
+	}
+	// receivers rely on the signature and timestamp, never post unsigned
+	if w.SecretFile == "" {
+		return fmt.Errorf("Webhook %s has no secret_file to sign requests with", w.URL)
+	}
+	secret, err := readSecret(w.SecretFile)
+	if err != nil {
+		return err
+	}
+
+	delay := webhookRetryDelay
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := w.post(ctx, body, token, secret)
+		if err == nil || retryAfter < 0 || attempt >= w.Retries {
+			return err
+		}
+		if retryAfter == 0 {
+			retryAfter = delay
+			delay *= 2
+			if retryAfter > w.MaxRetryAfter {
+				retryAfter = w.MaxRetryAfter
+			}
+		} else if retryAfter > w.MaxRetryAfter {
+			return fmt.Errorf("%v, not retried: Retry-After %v is longer than %v", err, retryAfter, w.MaxRetryAfter)
+		}
+		after := w.after
+		if after == nil {
+			after = time.After
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%v, not retried: %v", err, ctx.Err())
+		case <-after(retryAfter):
+		}
+	}
+}
+
+// post sends one signed request. If it fails retryAfter is how long to wait
+// before retrying, 0 for the default backoff and -1 if it must not be retried.
+func (w *WebhookDeployer) post(ctx context.Context, body []byte, token, secret string) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return -1, fmt.Errorf("Error building request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhook(secret, timestamp, body))
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("Error posting to %s: %v", w.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return 0, nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("%s returned %d: %s", w.URL, resp.StatusCode, bytes.TrimSpace(msg))
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+		return -1, err
+	}
+	return parseRetryAfter(resp.Header.Get("Retry-After")), err
+}
+
+// SignWebhook returns the hex encoded signature of a webhook body sent at timestamp
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseRetryAfter parses seconds or an http date, returning 0 if unset or invalid
+func parseRetryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
@@ -0,0 +1,106 @@
+package proxyservice
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookDeployer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secretFile := writeTestFile(t, dir, "secret", []byte("hmackey\n"))
+
+	statuses := []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}
+	var bodies []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		timestamp := req.Header.Get(WebhookTimestampHeader)
+		sent, _ := strconv.ParseInt(timestamp, 10, 64)
+		signature := strings.TrimPrefix(req.Header.Get(WebhookSignatureHeader), "sha256=")
+		if signature != SignWebhook("hmackey", timestamp, body) || time.Since(time.Unix(sent, 0)) > time.Minute {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		decoded := make(map[string]interface{})
+		json.Unmarshal(body, &decoded)
+		bodies = append(bodies, decoded)
+
+		status := statuses[0]
+		statuses = statuses[1:]
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "120")
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	deployer := NewWebhookDeployer(&Target{Type: TargetWebhook, URL: server.URL, SecretFile: secretFile, MaxRetryAfter: "5m"})
+	var waits []time.Duration
+	deployer.after = func(d time.Duration) <-chan time.Time {
+		waits = append(waits, d)
+		return time.After(0)
+	}
+	event := testDeployEvent()
+	event.Actor = "mozilla-pusher"
+	event.Raw = json.RawMessage(`{"push_data":{"tag":"v1.1.1"}}`)
+	assert.NoError(t, deployer.Deploy(context.Background(), nil, event))
+
+	assert.Len(t, bodies, 3)
+	assert.Equal(t, []time.Duration{time.Second, 120 * time.Second}, waits)
+	assert.Equal(t, map[string]interface{}{
+		"source": "dockerhub",
+		"repo":   "mozilla/testrepo",
+		"tag":    "v1.1.1",
+		"pusher": "mozilla-pusher",
+		"raw":    map[string]interface{}{"push_data": map[string]interface{}{"tag": "v1.1.1"}},
+	}, bodies[0])
+
+	// client errors and exhausted retries are returned
+	statuses = []int{http.StatusBadRequest}
+	assert.Error(t, deployer.Deploy(context.Background(), nil, event))
+	assert.Len(t, statuses, 0)
+
+	deployer.Retries = 1
+	statuses = []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusOK}
+	assert.Error(t, deployer.Deploy(context.Background(), nil, event))
+	assert.Len(t, statuses, 1)
+
+	// Retry-After longer than the max is not waited for
+	deployer.MaxRetryAfter = time.Minute
+	statuses = []int{http.StatusTooManyRequests, http.StatusOK}
+	waits = nil
+	err = deployer.Deploy(context.Background(), nil, event)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "not retried: Retry-After 2m0s is longer than 1m0s")
+	}
+	assert.Nil(t, waits)
+	assert.Len(t, statuses, 1)
+
+	// requests are never sent unsigned
+	deployer.SecretFile = ""
+	assert.EqualError(t, deployer.Deploy(context.Background(), nil, event),
+		"Webhook "+server.URL+" has no secret_file to sign requests with")
+	assert.Len(t, statuses, 1)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, 30*time.Second, parseRetryAfter("30"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(""))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)))
+	delay := parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	assert.True(t, delay > 59*time.Minute && delay <= time.Hour, delay)
+}